@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+
+	"github.com/leinonen/sql-history/pkg/database"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runApply generates the history objects and executes them in a database in
+// one transaction, and returns the process exit code.
+func runApply(args []string) int {
+	fs, out := newFlagSet("apply", []string{
+		"apply [flags] --dsn <dsn> [input...]",
+	}, "Installs history for the tables in the input files, or every table in the database when it is omitted.")
+	var dryRun bool
+	var filter database.Filter
+	dsnArg := registerDSNFlag(fs, "dsn", "PostgreSQL connection string (default: $DATABASE_URL)")
+	fs.BoolVar(&dryRun, "dry-run", false, "Execute everything, then roll back instead of committing")
+	registerFilterFlags(fs, &filter, "Without input files, ")
+	configFlags := registerConfigFlags(fs)
+	if !parseFlags(fs, out, args, 0, -1) {
+		return exitUsage
+	}
+	dsn := dsnArg.get()
+	if dsn == "" {
+		return out.UsageErrorf("--dsn is required")
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	ctx := context.Background()
+	conn, err := database.Connect(ctx, dsn)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+	defer conn.Close(ctx)
+
+	var tables []parser.Table
+	if fs.NArg() > 0 {
+		tables, err = readTables(out, fs.Args(), "", config)
+	} else {
+		tables, err = readDatabaseTables(ctx, conn, filter, config)
+	}
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	steps, err := parser.GenerateHistorySteps(tables, config)
+	if err != nil {
+		return out.Errorf("generating history SQL: %v", err)
+	}
+
+	byName := map[string]parser.Table{}
+	for _, table := range tables {
+		byName[parser.GetOriginalTableName(table)] = table
+	}
+
+	err = database.Apply(ctx, conn, steps, dryRun, func(step parser.Step) {
+		if table, ok := byName[step.Table]; ok {
+			out.Printf("  - %s -> %s\n", step.Name, parser.GetHistoryTableName(table, config))
+		} else {
+			out.Printf("  - %s\n", step.Name)
+		}
+		out.Verbosef("%s", indent(step.SQL, "      "))
+	})
+	if err != nil {
+		out.Errorf("%v", err)
+		out.Printf("Rolled back; nothing was changed\n")
+		return exitFailure
+	}
+
+	if dryRun {
+		out.Printf("Dry run succeeded for %d table(s); rolled back\n", len(tables))
+		return exitOK
+	}
+	out.Printf("Applied history for %d table(s)\n", len(tables))
+	return exitOK
+}
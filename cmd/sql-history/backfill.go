@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+
+	"github.com/leinonen/sql-history/pkg/database"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runBackfill writes, or with --dsn runs, the backfill recording the existing
+// rows of each table as their first history version, and returns the process
+// exit code.
+func runBackfill(args []string) int {
+	fs, out := newFlagSet("backfill", []string{
+		"backfill [flags] <input.sql> [output.sql]",
+		"backfill [flags] --output <output.sql> <input>...",
+		"backfill [flags] --dsn <dsn> [input...]",
+	}, "Use the same flags the history SQL was generated with.")
+	var backfillFrom, outputFile string
+	var batchSize int
+	var filter database.Filter
+	tableBackfillFrom := tableValues{}
+	dsnArg := registerDSNFlag(fs, "dsn", "Run the backfill in this database instead of writing a file (default without input files: $DATABASE_URL)")
+	fs.IntVar(&batchSize, "batch-size", parser.DefaultBackfillBatchSize, "Rows recorded per transaction")
+	fs.StringVar(&backfillFrom, "backfill-from", "", "Column used as valid_from of backfilled versions, e.g. created_at (default: time of the backfill)")
+	fs.Var(tableBackfillFrom, "table-backfill-from", "Per-table valid_from column as table=column (repeatable)")
+	registerFilterFlags(fs, &filter, "With --dsn and without input files, ")
+	registerOutputFlag(fs, &outputFile)
+	configFlags := registerConfigFlags(fs)
+	if !parseFlags(fs, out, args, 0, -1) {
+		return exitUsage
+	}
+	dsn := dsnArg.forArgs(fs.Args())
+	if dsn == "" && fs.NArg() < 1 {
+		fs.Usage()
+		return exitUsage
+	}
+	if dsn != "" && outputFile != "" {
+		return out.UsageErrorf("--output cannot be combined with --dsn")
+	}
+
+	if batchSize <= 0 {
+		return out.UsageErrorf("--batch-size must be positive")
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+	if backfillFrom != "" {
+		config.BackfillFrom = backfillFrom
+	}
+	for table, column := range tableBackfillFrom {
+		tableConfig := config.Tables[table]
+		tableConfig.BackfillFrom = column
+		config.Tables[table] = tableConfig
+	}
+
+	if dsn == "" {
+		inputs, outputFile, err := splitOutput(fs.Args(), outputFile, "_history_backfill")
+		if err != nil {
+			return out.UsageErrorf("%v", err)
+		}
+		return writeBackfill(out, inputs, outputFile, config, batchSize)
+	}
+
+	ctx := context.Background()
+	conn, err := database.Connect(ctx, dsn)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+	defer conn.Close(ctx)
+
+	var tables []parser.Table
+	if fs.NArg() > 0 {
+		tables, err = readTables(out, fs.Args(), "", config)
+	} else {
+		tables, err = readDatabaseTables(ctx, conn, filter, config)
+	}
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	backfills, err := parser.GenerateBackfills(tables, config, batchSize)
+	if err != nil {
+		return out.Errorf("generating backfill: %v", err)
+	}
+
+	var total int64
+	err = database.Backfill(ctx, conn, backfills, func(backfill parser.Backfill, recorded int64) {
+		out.Printf("  - %s: %d row(s) recorded\n", backfill.Table, recorded)
+		total += recorded
+	})
+	if err != nil {
+		out.Errorf("%v", err)
+		out.Printf("Batches committed so far are kept; run the backfill again to resume\n")
+		return exitFailure
+	}
+
+	out.Printf("Backfilled %d row(s) in %d table(s)\n", total, len(tables))
+	return exitOK
+}
+
+func writeBackfill(out *output, inputs []string, outputFile string, config parser.Config, batchSize int) int {
+	tables, err := readTables(out, inputs, outputFile, config)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	output, err := parser.GenerateBackfillSQL(tables, config, batchSize)
+	if err != nil {
+		return out.Errorf("generating backfill: %v", err)
+	}
+
+	if err := out.write(outputFile, output); err != nil {
+		return out.Errorf("writing output file: %v", err)
+	}
+
+	out.Printf("Generated backfill for %d table(s) in: %s\n", len(tables), outputDisplayName(outputFile))
+	out.Printf("Run it outside a transaction block, after the history SQL\n")
+	return exitOK
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+
+	"github.com/leinonen/sql-history/pkg/database"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runCheck compares the history objects installed in a database with what
+// would be generated for its tables and returns the process exit code, which
+// is non-zero when anything drifted.
+func runCheck(args []string) int {
+	fs, out := newFlagSet("check", []string{
+		"check [flags] --dsn <dsn> [input...]",
+	}, "Checks the tables in the input files, or every table in the database when it is omitted.\nUse the same flags the history SQL was generated with.")
+	var filter database.Filter
+	dsnArg := registerDSNFlag(fs, "dsn", "PostgreSQL connection string (default: $DATABASE_URL)")
+	registerFilterFlags(fs, &filter, "Without input files, ")
+	configFlags := registerConfigFlags(fs)
+	if !parseFlags(fs, out, args, 0, -1) {
+		return exitUsage
+	}
+	dsn := dsnArg.get()
+	if dsn == "" {
+		return out.UsageErrorf("--dsn is required")
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	ctx := context.Background()
+	conn, err := database.Connect(ctx, dsn)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+	defer conn.Close(ctx)
+
+	var tables []parser.Table
+	if fs.NArg() > 0 {
+		tables, err = readTables(out, fs.Args(), "", config)
+	} else {
+		tables, err = readDatabaseTables(ctx, conn, filter, config)
+	}
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	drifts, err := database.CheckDrift(ctx, conn, tables, config)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	byTable := map[string][]database.Drift{}
+	for _, drift := range drifts {
+		byTable[drift.Table] = append(byTable[drift.Table], drift)
+	}
+
+	for _, table := range tables {
+		name := parser.GetOriginalTableName(table)
+		tableDrifts := byTable[name]
+		if len(tableDrifts) == 0 {
+			out.Printf("  - %s: OK\n", name)
+			continue
+		}
+		out.Printf("  - %s: DRIFT\n", name)
+		for _, drift := range tableDrifts {
+			out.Printf("      %s\n", drift)
+		}
+	}
+
+	if len(byTable) > 0 {
+		out.Printf("History drifted in %d of %d table(s)\n", len(byTable), len(tables))
+		return exitFailure
+	}
+	out.Printf("History up to date in %d table(s)\n", len(tables))
+	return exitOK
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// checkFile compares generated output with the file it would be written to,
+// prints the difference as a unified diff, and returns exitFailure when the
+// file is out of date.
+func checkFile(out *output, path, generated string) int {
+	diff, err := diffFile(path, generated)
+	if err != nil {
+		return out.Errorf("reading output file: %v", err)
+	}
+	if diff == "" {
+		out.Printf("%s is up to date\n", path)
+		return exitOK
+	}
+
+	out.Printf("%s", diff)
+	return out.Errorf("%s is out of date; run the same command without --check to update it", path)
+}
+
+// checkFiles compares split output with the files in dir like checkFile.
+// .sql files in dir that would not be generated count as out of date.
+func checkFiles(out *output, dir string, files []parser.OutputFile) int {
+	var stale []string
+	generated := map[string]bool{}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file.Name))
+		generated[path] = true
+
+		diff, err := diffFile(path, file.SQL)
+		if err != nil {
+			return out.Errorf("reading output file: %v", err)
+		}
+		if diff != "" {
+			out.Printf("%s", diff)
+			stale = append(stale, path)
+		}
+	}
+
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || filepath.Ext(path) != ".sql" || generated[path] {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		out.Printf("%s", unifiedDiff(path, "/dev/null", string(content), ""))
+		stale = append(stale, path)
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return out.Errorf("reading output directory: %v", err)
+	}
+
+	if len(stale) == 0 {
+		out.Printf("%s is up to date\n", dir)
+		return exitOK
+	}
+	return out.Errorf("%s is out of date (%s); run the same command without --check to update it", dir, strings.Join(stale, ", "))
+}
+
+// diffFile returns the unified diff from the file at path to generated. A
+// missing file differs from any output.
+func diffFile(path, generated string) (string, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return unifiedDiff("/dev/null", path, "", generated), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return unifiedDiff(path, path, string(content), generated), nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	out := &output{quiet: true}
+	path := filepath.Join(t.TempDir(), "history.sql")
+
+	if code := checkFile(out, path, "x\n"); code != exitFailure {
+		t.Errorf("Expected a missing file to be out of date, got exit code %d", code)
+	}
+	diff, err := diffFile(path, "x\n")
+	if err != nil || diff != "--- /dev/null\n+++ "+path+"\n@@ -0,0 +1 @@\n+x\n" {
+		t.Errorf("Expected a missing file to diff from /dev/null, got %q, %v", diff, err)
+	}
+
+	writeTestFile(t, path, "x\n")
+	if code := checkFile(out, path, "x\n"); code != exitOK {
+		t.Errorf("Expected an identical file to be up to date, got exit code %d", code)
+	}
+
+	if code := checkFile(out, path, "y\n"); code != exitFailure {
+		t.Errorf("Expected a changed file to be out of date, got exit code %d", code)
+	}
+	diff, err = diffFile(path, "y\n")
+	if err != nil || diff != "--- "+path+"\n+++ "+path+"\n@@ -1 +1 @@\n-x\n+y\n" {
+		t.Errorf("Expected a diff of the changed line, got %q, %v", diff, err)
+	}
+}
+
+func TestCheckFiles(t *testing.T) {
+	out := &output{quiet: true}
+	files := []parser.OutputFile{
+		{Name: "index.sql", SQL: "\\i tables/users.sql\n"},
+		{Name: "tables/users.sql", SQL: "CREATE TABLE users_history ();\n"},
+	}
+
+	dir := filepath.Join(t.TempDir(), "history")
+	if code := checkFiles(out, dir, files); code != exitFailure {
+		t.Errorf("Expected a missing directory to be out of date, got exit code %d", code)
+	}
+
+	for _, file := range files {
+		writeTestFile(t, filepath.Join(dir, filepath.FromSlash(file.Name)), file.SQL)
+	}
+	if code := checkFiles(out, dir, files); code != exitOK {
+		t.Errorf("Expected identical files to be up to date, got exit code %d", code)
+	}
+
+	users := filepath.Join(dir, "tables", "users.sql")
+	writeTestFile(t, users, "-- edited\n")
+	if code := checkFiles(out, dir, files); code != exitFailure {
+		t.Errorf("Expected a changed file to be out of date, got exit code %d", code)
+	}
+
+	if err := os.Remove(users); err != nil {
+		t.Fatal(err)
+	}
+	if code := checkFiles(out, dir, files); code != exitFailure {
+		t.Errorf("Expected a missing file to be out of date, got exit code %d", code)
+	}
+
+	writeTestFile(t, users, files[1].SQL)
+	writeTestFile(t, filepath.Join(dir, "tables", "orders.sql"), "CREATE TABLE orders_history ();\n")
+	if code := checkFiles(out, dir, files); code != exitFailure {
+		t.Errorf("Expected a file that is no longer generated to be out of date, got exit code %d", code)
+	}
+}
+
+func TestGenerateCheck(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "schema.sql")
+	output := filepath.Join(dir, "schema_history.sql")
+	split := filepath.Join(dir, "history")
+	writeTestFile(t, input, "CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT);\n")
+
+	if code := runGenerate([]string{"-quiet", "--check", input, output}); code != exitFailure {
+		t.Errorf("Expected --check without an output file to exit %d, got %d", exitFailure, code)
+	}
+	if _, err := os.Stat(output); err == nil {
+		t.Error("Expected --check not to write the output file")
+	}
+
+	if code := runGenerate([]string{"-quiet", input, output}); code != exitOK {
+		t.Fatalf("Expected generate to succeed, got exit code %d", code)
+	}
+	if code := runGenerate([]string{"-quiet", "--check", input, output}); code != exitOK {
+		t.Errorf("Expected --check of fresh output to exit %d, got %d", exitOK, code)
+	}
+
+	writeTestFile(t, input, "CREATE TABLE users (id SERIAL PRIMARY KEY, email TEXT);\n")
+	if code := runGenerate([]string{"-quiet", "--check", input, output}); code != exitFailure {
+		t.Errorf("Expected --check of stale output to exit %d, got %d", exitFailure, code)
+	}
+
+	if code := runGenerate([]string{"-quiet", "--split", "table", input, split}); code != exitOK {
+		t.Fatalf("Expected split generate to succeed, got exit code %d", code)
+	}
+	if code := runGenerate([]string{"-quiet", "--check", "--split", "table", input, split}); code != exitOK {
+		t.Errorf("Expected --check of a fresh split directory to exit %d, got %d", exitOK, code)
+	}
+	writeTestFile(t, filepath.Join(split, "stale.sql"), "-- left over\n")
+	if code := runGenerate([]string{"-quiet", "--check", "--split", "table", input, split}); code != exitFailure {
+		t.Errorf("Expected --check of a split directory with a stale file to exit %d, got %d", exitFailure, code)
+	}
+
+	if code := runGenerate([]string{"-quiet", "--check", "-o", "-", input}); code != exitUsage {
+		t.Errorf("Expected --check of stdout to exit %d, got %d", exitUsage, code)
+	}
+	if content, err := os.ReadFile(output); err != nil || !strings.Contains(string(content), "name") {
+		t.Errorf("Expected --check to leave the output file unchanged, got %v", err)
+	}
+}
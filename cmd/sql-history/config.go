@@ -0,0 +1,204 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// configFlags holds the flags that shape the generated history objects. They
+// are shared by every command that needs to know what was generated.
+type configFlags struct {
+	fs             *flag.FlagSet
+	configFile     string
+	trackUser      bool
+	userSource     string
+	historyID      bool
+	versioning     bool
+	indexStrategy  string
+	partitioning   string
+	partitionStart string
+	partitionCount int
+	retention      string
+	tableRetention tableValues
+	appendOnly     bool
+	historyOwner   string
+	hashChain      bool
+	historySchema  string
+	tableSchema    tableValues
+	naming         parser.Naming
+	idempotent     bool
+}
+
+func registerConfigFlags(fs *flag.FlagSet) *configFlags {
+	f := &configFlags{fs: fs, tableRetention: tableValues{}, tableSchema: tableValues{}}
+
+	fs.StringVar(&f.configFile, "config", "", "Project config file (default: "+parser.ConfigFileName+" when present); flags given explicitly override it")
+	fs.BoolVar(&f.trackUser, "track-user", false, "Add user tracking to history tables")
+	fs.StringVar(&f.userSource, "user-source", "current_user", "Source for user info: 'current_user' or 'session'")
+	fs.BoolVar(&f.historyID, "history-id", false, "Add a surrogate history_id primary key to history tables")
+	fs.BoolVar(&f.versioning, "versioning", false, "Add a per-primary-key version number to history tables")
+	fs.StringVar(&f.indexStrategy, "index-strategy", "btree", "Index method for valid_from/valid_to: 'btree' or 'brin'")
+	fs.StringVar(&f.partitioning, "partition", "", "Range partition history tables on valid_from: 'month' or 'year'")
+	fs.StringVar(&f.partitionStart, "partition-start", "", "First partition date as YYYY-MM-DD, required with --partition")
+	fs.IntVar(&f.partitionCount, "partitions", 12, "Number of partitions to create up front")
+	fs.StringVar(&f.retention, "retention", "", "Keep closed history versions for this PostgreSQL interval, e.g. '7 years'")
+	fs.Var(f.tableRetention, "table-retention", "Per-table retention as table=interval or table=forever (repeatable)")
+	fs.BoolVar(&f.appendOnly, "append-only", false, "Reject UPDATE/DELETE/TRUNCATE on history tables except by the generated functions")
+	fs.StringVar(&f.historyOwner, "history-owner", "", "Role that owns history tables and functions")
+	fs.StringVar(&f.historySchema, "history-schema", "", "Schema for history tables and functions (default: schema of each table)")
+	fs.Var(f.tableSchema, "table-history-schema", "Per-table history schema as table=schema (repeatable)")
+	fs.BoolVar(&f.idempotent, "idempotent", false, "Generate SQL that can be applied repeatedly, one transaction per table")
+	fs.StringVar(&f.naming.HistoryTable, "history-table-name", "", "Template for history table names (default: "+parser.DefaultHistoryTableTemplate+")")
+	fs.StringVar(&f.naming.Function, "function-name", "", "Template for function names (default: "+parser.DefaultFunctionTemplate+")")
+	fs.StringVar(&f.naming.Trigger, "trigger-name", "", "Template for trigger names (default: "+parser.DefaultTriggerTemplate+")")
+	fs.StringVar(&f.naming.Index, "index-name", "", "Template for index names (default: "+parser.DefaultIndexTemplate+")")
+	fs.BoolVar(&f.hashChain, "hash-chain", false, "Store a SHA-256 row_hash chained per key (requires pgcrypto, implies --versioning)")
+
+	return f
+}
+
+// config builds the generator configuration from the flag defaults, the
+// project config file, and the flags given on the command line, each
+// overriding the one before.
+func (f *configFlags) config() (parser.Config, error) {
+	config := parser.Config{Tables: map[string]parser.TableConfig{}}
+
+	var err error
+	apply := func(fl *flag.Flag) {
+		if err == nil {
+			err = f.apply(&config, fl.Name)
+		}
+	}
+
+	f.fs.VisitAll(apply)
+	if err != nil {
+		return parser.Config{}, err
+	}
+
+	path := f.path()
+	if path == "" {
+		return config, nil
+	}
+
+	config, err = parser.LoadConfigFile(path, config)
+	if err != nil {
+		return parser.Config{}, err
+	}
+
+	f.fs.Visit(apply)
+	if err != nil {
+		return parser.Config{}, err
+	}
+	return config, nil
+}
+
+// path returns the project config file read by config: the one named with
+// --config, or parser.ConfigFileName when present, or "" for none.
+func (f *configFlags) path() string {
+	if f.configFile != "" {
+		return f.configFile
+	}
+	if _, err := os.Stat(parser.ConfigFileName); err == nil {
+		return parser.ConfigFileName
+	}
+	return ""
+}
+
+// apply validates the flag with the given name and stores its value in
+// config. Flags that do not shape the configuration are ignored.
+func (f *configFlags) apply(config *parser.Config, name string) error {
+	switch name {
+	case "track-user":
+		config.TrackUser = f.trackUser
+	case "user-source":
+		if f.userSource != "current_user" && f.userSource != "session" {
+			return fmt.Errorf("--user-source must be either 'current_user' or 'session'")
+		}
+		config.UserSource = f.userSource
+	case "history-id":
+		config.HistoryID = f.historyID
+	case "versioning":
+		config.Versioning = f.versioning
+	case "index-strategy":
+		if f.indexStrategy != "btree" && f.indexStrategy != "brin" {
+			return fmt.Errorf("--index-strategy must be either 'btree' or 'brin'")
+		}
+		config.IndexStrategy = f.indexStrategy
+	case "partition":
+		if f.partitioning != "" && f.partitioning != "month" && f.partitioning != "year" {
+			return fmt.Errorf("--partition must be either 'month' or 'year'")
+		}
+		config.Partitioning = f.partitioning
+	case "partition-start":
+		if f.partitionStart != "" {
+			start, err := time.Parse("2006-01-02", f.partitionStart)
+			if err != nil {
+				return fmt.Errorf("--partition-start must be a date in YYYY-MM-DD format")
+			}
+			config.PartitionStart = start
+		}
+	case "partitions":
+		if f.partitionCount < 0 {
+			return fmt.Errorf("--partitions must not be negative")
+		}
+		config.PartitionCount = f.partitionCount
+	case "retention":
+		config.Retention = f.retention
+	case "table-retention":
+		for table, interval := range f.tableRetention {
+			tableConfig := config.Tables[table]
+			tableConfig.Retention = interval
+			config.Tables[table] = tableConfig
+		}
+	case "append-only":
+		config.AppendOnly = f.appendOnly
+	case "history-owner":
+		config.HistoryOwner = f.historyOwner
+	case "hash-chain":
+		config.HashChain = f.hashChain
+	case "history-schema":
+		config.HistorySchema = f.historySchema
+	case "table-history-schema":
+		for table, schema := range f.tableSchema {
+			tableConfig := config.Tables[table]
+			tableConfig.HistorySchema = schema
+			config.Tables[table] = tableConfig
+		}
+	case "idempotent":
+		config.Idempotent = f.idempotent
+	case "history-table-name":
+		config.Naming.HistoryTable = f.naming.HistoryTable
+	case "function-name":
+		config.Naming.Function = f.naming.Function
+	case "trigger-name":
+		config.Naming.Trigger = f.naming.Trigger
+	case "index-name":
+		config.Naming.Index = f.naming.Index
+	}
+	return nil
+}
+
+// tableValues collects repeatable table=value flags.
+type tableValues map[string]string
+
+func (v tableValues) String() string {
+	pairs := make([]string, 0, len(v))
+	for table, value := range v {
+		pairs = append(pairs, table+"="+value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (v tableValues) Set(value string) error {
+	table, setting, ok := strings.Cut(value, "=")
+	if !ok || table == "" || setting == "" {
+		return fmt.Errorf("expected table=value, got %q", value)
+	}
+	v[table] = setting
+	return nil
+}
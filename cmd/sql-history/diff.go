@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffEdits caps the lines added and removed that unifiedDiff looks for.
+// Finding the edit script takes memory quadratic in their number, so larger
+// changes are only reported as a difference.
+const maxDiffEdits = 2000
+
+// diffOp is one line of an edit script, with its line ending: ' ' kept,
+// '-' removed or '+' added.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the changes from oldText to newText in unified diff
+// format, or "" when they are equal. Changes of more than maxDiffEdits lines
+// are summarized in one line instead.
+func unifiedDiff(oldName, newName, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+
+	ops, ok := diffLines(splitLines(oldText), splitLines(newText))
+	if !ok {
+		return fmt.Sprintf("Files %s and %s differ in more than %d lines\n", oldName, newName, maxDiffEdits)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", oldName, newName))
+
+	// Walk the edit script, cutting it into hunks of changes separated by
+	// more than twice the context.
+	oldLine, newLine := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		start := i
+		for back := 0; back < diffContext && start > 0 && ops[start-1].kind == ' '; back++ {
+			start--
+		}
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].kind == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContext {
+				end += min(run-end, diffContext)
+				break
+			}
+			end = run
+		}
+
+		hunkOld, hunkNew := oldLine-(i-start), newLine-(i-start)
+		oldCount, newCount := 0, 0
+		var body strings.Builder
+		for _, op := range ops[start:end] {
+			body.WriteString(string(op.kind) + op.line)
+			if !strings.HasSuffix(op.line, "\n") {
+				body.WriteString("\n\\ No newline at end of file\n")
+			}
+			if op.kind != '+' {
+				oldCount++
+			}
+			if op.kind != '-' {
+				newCount++
+			}
+		}
+		sb.WriteString(fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(hunkOld, oldCount), hunkRange(hunkNew, newCount)))
+		sb.WriteString(body.String())
+
+		for _, op := range ops[i:end] {
+			if op.kind != '+' {
+				oldLine++
+			}
+			if op.kind != '-' {
+				newLine++
+			}
+		}
+		i = end
+	}
+
+	return sb.String()
+}
+
+// hunkRange formats the start and length of a hunk side. An empty side
+// starts at the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
+
+// splitLines splits text into lines, keeping their line endings so that a
+// missing newline at the end is a difference.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// diffLines returns a shortest edit script turning a into b, using Myers'
+// algorithm on what remains after the common prefix and suffix. It returns
+// false when the script would have more than maxDiffEdits changes.
+func diffLines(a, b []string) ([]diffOp, bool) {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var ops []diffOp
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	middle, ok := myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], maxDiffEdits)
+	if !ok {
+		return nil, false
+	}
+	ops = append(ops, middle...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops, true
+}
+
+// myers finds a shortest edit script with the greedy algorithm from "An O(ND)
+// Difference Algorithm and Its Variations", keeping the furthest reaching
+// path of the diagonals -d..d per edit distance d to trace the script back.
+// It gives up with false once the edit distance exceeds maxEdits, which
+// bounds the memory kept to O(maxEdits²).
+func myers(a, b []string, maxEdits int) ([]diffOp, bool) {
+	n, m := len(a), len(b)
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+
+	for d := 0; d <= n+m; d++ {
+		if d > maxEdits {
+			return nil, false
+		}
+		// The diagonals reached with d-1 edits, indexed from -d.
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				return backtrack(a, b, trace, d), true
+			}
+		}
+	}
+	return nil, true
+}
+
+// backtrack walks the saved paths of myers back from the end of both inputs.
+func backtrack(a, b []string, trace [][]int, d int) []diffOp {
+	var reversed []diffOp
+	x, y := len(a), len(b)
+
+	for ; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && v[d+k-1] < v[d+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[d+prevK]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			reversed = append(reversed, diffOp{' ', a[x]})
+		}
+		if x == prevX {
+			y--
+			reversed = append(reversed, diffOp{'+', b[y]})
+		} else {
+			x--
+			reversed = append(reversed, diffOp{'-', a[x]})
+		}
+	}
+	for x > 0 {
+		x--
+		reversed = append(reversed, diffOp{' ', a[x]})
+	}
+
+	ops := make([]diffOp, len(reversed))
+	for i, op := range reversed {
+		ops[len(reversed)-1-i] = op
+	}
+	return ops
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	if diff := unifiedDiff("a.sql", "b.sql", "x\ny\n", "x\ny\n"); diff != "" {
+		t.Errorf("Expected no diff for identical text, got %q", diff)
+	}
+
+	oldText := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	newText := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n11\n"
+	expected := `--- a.sql
++++ b.sql
+@@ -2,9 +2,10 @@
+ 2
+ 3
+ 4
+-5
++five
+ 6
+ 7
+ 8
+ 9
+ 10
++11
+`
+	if diff := unifiedDiff("a.sql", "b.sql", oldText, newText); diff != expected {
+		t.Errorf("Expected diff:\n%s\ngot:\n%s", expected, diff)
+	}
+
+	// Changes more than twice the context apart are separate hunks.
+	oldText = "a\n1\n2\n3\n4\n5\n6\n7\nb\n"
+	newText = "A\n1\n2\n3\n4\n5\n6\n7\nB\n"
+	if diff := unifiedDiff("a.sql", "b.sql", oldText, newText); !strings.Contains(diff, "@@ -1,4 +1,4 @@\n-a\n+A\n") || !strings.Contains(diff, "@@ -6,4 +6,4 @@\n") {
+		t.Errorf("Expected two hunks, got:\n%s", diff)
+	}
+
+	expected = "--- /dev/null\n+++ b.sql\n@@ -0,0 +1,2 @@\n+x\n+y\n"
+	if diff := unifiedDiff("/dev/null", "b.sql", "", "x\ny\n"); diff != expected {
+		t.Errorf("Expected diff:\n%s\ngot:\n%s", expected, diff)
+	}
+
+	expected = "--- a.sql\n+++ b.sql\n@@ -1 +1 @@\n-x\n\\ No newline at end of file\n+x\n"
+	if diff := unifiedDiff("a.sql", "b.sql", "x", "x\n"); diff != expected {
+		t.Errorf("Expected diff:\n%s\ngot:\n%s", expected, diff)
+	}
+}
+
+func TestUnifiedDiffTooLarge(t *testing.T) {
+	var oldText, newText strings.Builder
+	for i := 0; i < maxDiffEdits; i++ {
+		fmt.Fprintf(&oldText, "old %d\n", i)
+		fmt.Fprintf(&newText, "new %d\n", i)
+	}
+
+	diff := unifiedDiff("a.sql", "b.sql", oldText.String(), newText.String())
+	if diff != fmt.Sprintf("Files a.sql and b.sql differ in more than %d lines\n", maxDiffEdits) {
+		t.Errorf("Expected a large change to be summarized, got %d bytes starting %.40q", len(diff), diff)
+	}
+
+	// A long file with a small change still gets a diff.
+	long := oldText.String()
+	diff = unifiedDiff("a.sql", "b.sql", long, strings.Replace(long, "old 1000\n", "changed\n", 1))
+	if !strings.Contains(diff, "-old 1000\n+changed\n") {
+		t.Errorf("Expected a diff of the changed line, got:\n%s", diff)
+	}
+}
+
+func TestDiffLinesEditScript(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, random.Intn(12))
+		for i := range lines {
+			lines[i] = fmt.Sprintf("%c\n", 'a'+random.Intn(4))
+		}
+		return lines
+	}
+
+	for i := 0; i < 500; i++ {
+		a, b := randomLines(), randomLines()
+		ops, ok := diffLines(a, b)
+		if !ok {
+			t.Fatalf("Expected a diff of %q and %q", a, b)
+		}
+
+		var gotA, gotB []string
+		edits := 0
+		for _, op := range ops {
+			if op.kind != ' ' {
+				edits++
+			}
+			if op.kind != '+' {
+				gotA = append(gotA, op.line)
+			}
+			if op.kind != '-' {
+				gotB = append(gotB, op.line)
+			}
+		}
+		if strings.Join(gotA, "") != strings.Join(a, "") || strings.Join(gotB, "") != strings.Join(b, "") {
+			t.Fatalf("Edit script %v does not turn %q into %q", ops, a, b)
+		}
+		if shortest := len(a) + len(b) - 2*commonLines(a, b); edits != shortest {
+			t.Fatalf("Expected %d edits from %q to %q, got %v", shortest, a, b, ops)
+		}
+	}
+}
+
+// commonLines returns the length of the longest common subsequence of a and b.
+func commonLines(a, b []string) int {
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else {
+				lengths[i][j] = max(lengths[i+1][j], lengths[i][j+1])
+			}
+		}
+	}
+	return lengths[0][0]
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runDown writes the uninstall script for the history objects generated for
+// the tables in an input file or database, and returns the process exit code.
+func runDown(args []string) int {
+	fs, out := newFlagSet("down", []string{
+		"down [flags] <input.sql> [output.sql]",
+		"down [flags] --output <output.sql> <input>...",
+		"down [flags] --from-db <dsn> [output.sql]",
+	}, "Use the same flags the history SQL was generated with.")
+	var dropHistory bool
+	fs.BoolVar(&dropHistory, "drop-history", false, "Also drop history tables and all recorded history")
+	configFlags := registerConfigFlags(fs)
+	source := registerSourceFlags(fs)
+	var outputFile string
+	registerOutputFlag(fs, &outputFile)
+	if !parseFlags(fs, out, args, 0, -1) {
+		return exitUsage
+	}
+	source.parsed(fs.Args())
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	inputs, outputFile, err := source.splitOutput(fs.Args(), outputFile, "_history_down")
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	tables, err := source.readTables(out, inputs, outputFile, config)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	output, err := parser.GenerateDownSQL(tables, config, dropHistory)
+	if err != nil {
+		return out.Errorf("generating uninstall SQL: %v", err)
+	}
+
+	if err := out.write(outputFile, output); err != nil {
+		return out.Errorf("writing output file: %v", err)
+	}
+
+	out.Printf("Generated uninstall script for %d table(s) in: %s\n", len(tables), outputDisplayName(outputFile))
+	if !dropHistory {
+		out.Printf("History tables are kept; pass --drop-history to drop them as well\n")
+	}
+	return exitOK
+}
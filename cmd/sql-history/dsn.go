@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"os"
+)
+
+// dsnFlag is a PostgreSQL connection string flag that defaults to
+// $DATABASE_URL. The environment is read after parsing rather than used as
+// the flag default, so that a password in it is not printed with the usage.
+type dsnFlag struct {
+	value string
+}
+
+// registerDSNFlag registers the connection string flag of a command under
+// name, e.g. "dsn" or "from-db". usage says when $DATABASE_URL is used.
+func registerDSNFlag(fs *flag.FlagSet, name, usage string) *dsnFlag {
+	f := &dsnFlag{}
+	fs.StringVar(&f.value, name, "", usage)
+	return f
+}
+
+// get returns the connection string of a command that always connects.
+func (f *dsnFlag) get() string {
+	if f.value != "" {
+		return f.value
+	}
+	return os.Getenv("DATABASE_URL")
+}
+
+// forArgs returns the connection string of a command that only connects
+// with the flag or without arguments, such as a read from a database instead
+// of input files. $DATABASE_URL is only used without arguments, so that it
+// never turns a command on files into one on a database.
+func (f *dsnFlag) forArgs(args []string) string {
+	if f.value != "" || len(args) > 0 {
+		return f.value
+	}
+	return os.Getenv("DATABASE_URL")
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"time"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// migrationFlags select the migration tool format generate writes for.
+type migrationFlags struct {
+	format      string
+	version     string
+	name        string
+	author      string
+	dropHistory bool
+}
+
+func registerMigrationFlags(fs *flag.FlagSet) *migrationFlags {
+	f := &migrationFlags{}
+
+	fs.StringVar(&f.format, "format", "", "Write a migration for a migration tool: "+strings.Join(parser.MigrationFormats, ", "))
+	fs.StringVar(&f.version, "migration-version", "", "Version of the migration (default: current UTC time as YYYYMMDDHHMMSS)")
+	fs.StringVar(&f.name, "migration-name", "add_history", "Name of the migration")
+	fs.StringVar(&f.author, "migration-author", "sql-history", "Author of the Liquibase changesets")
+	fs.BoolVar(&f.dropHistory, "drop-history", false, "With --format, make the down migration drop history tables as well")
+
+	return f
+}
+
+// options validates the flags and returns the options of the migration.
+func (f *migrationFlags) options() (parser.MigrationOptions, error) {
+	options := parser.MigrationOptions{
+		Format:      f.format,
+		Version:     f.version,
+		Name:        f.name,
+		Author:      f.author,
+		DropHistory: f.dropHistory,
+	}
+	if options.Version == "" {
+		options.Version = time.Now().UTC().Format("20060102150405")
+	}
+
+	if err := options.Validate(); err != nil {
+		return parser.MigrationOptions{}, err
+	}
+	return options, nil
+}
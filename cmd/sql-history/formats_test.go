@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestGenerateFormats(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "schema.sql")
+	writeTestFile(t, input, "CREATE TABLE users (id SERIAL PRIMARY KEY, name TEXT);\n")
+
+	// The first line of each file, by file name.
+	tests := []struct {
+		format  string
+		headers map[string]string
+	}{
+		{"golang-migrate", map[string]string{
+			"42_add_users_history.up.sql":   "-- users",
+			"42_add_users_history.down.sql": "-- Remove history for: users",
+		}},
+		{"goose", map[string]string{"42_add_users_history.sql": "-- +goose Up"}},
+		{"flyway", map[string]string{"V42__add_users_history.sql": "-- users"}},
+		{"liquibase", map[string]string{"42_add_users_history.sql": "--liquibase formatted sql"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			migrations := filepath.Join(dir, tt.format)
+			args := []string{"-quiet", "--format", tt.format, "--migration-version", "42", "--migration-name", "add_users_history", "--migration-author", "dev", "-o", migrations, input}
+			if code := runGenerate(args); code != exitOK {
+				t.Fatalf("Expected generate to succeed, got exit code %d", code)
+			}
+
+			entries, err := os.ReadDir(migrations)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != len(tt.headers) {
+				t.Errorf("Expected %d file(s), got %d", len(tt.headers), len(entries))
+			}
+			for _, entry := range entries {
+				header, ok := tt.headers[entry.Name()]
+				if !ok {
+					t.Errorf("Unexpected file %s", entry.Name())
+					continue
+				}
+				content := mustReadFile(t, filepath.Join(migrations, entry.Name()))
+				if first, _, _ := strings.Cut(content, "\n"); first != header {
+					t.Errorf("Expected %s to start with %q, got %q", entry.Name(), header, first)
+				}
+			}
+
+			// Existing migrations are never overwritten.
+			if code := runGenerate(args); code != exitFailure {
+				t.Errorf("Expected generating the same migration again to exit %d, got %d", exitFailure, code)
+			}
+		})
+	}
+
+	if !strings.Contains(mustReadFile(t, filepath.Join(dir, "liquibase", "42_add_users_history.sql")), "\n--changeset dev:42-1 splitStatements:false\n") {
+		t.Error("Expected Liquibase changesets by the given author")
+	}
+
+	defaults := filepath.Join(dir, "defaults")
+	if code := runGenerate([]string{"-quiet", "--format", "goose", "-o", defaults, input}); code != exitOK {
+		t.Fatalf("Expected generate to succeed, got exit code %d", code)
+	}
+	entries, err := os.ReadDir(defaults)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !regexp.MustCompile(`^[0-9]{14}_add_history\.sql$`).MatchString(entries[0].Name()) {
+		t.Errorf("Expected one migration named after the current time, got %v", entries)
+	}
+
+	usageErrors := [][]string{
+		{"--format", "sqitch", "-o", defaults, input},
+		{"--format", "goose", input},
+		{"--format", "goose", "--split", "table", "-o", defaults, input},
+		{"--format", "flyway", "--migration-name", "add history", "-o", defaults, input},
+		{"--drop-history", input},
+	}
+	for _, args := range usageErrors {
+		if code := runGenerate(append([]string{"-quiet"}, args...)); code != exitUsage {
+			t.Errorf("Expected %v to exit %d, got %d", args, exitUsage, code)
+		}
+	}
+}
+
+func mustReadFile(t *testing.T, path string) string {
+	t.Helper()
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runGenerate writes the history tables and triggers for the tables in an
+// input file or database, and returns the process exit code.
+func runGenerate(args []string) int {
+	fs, out := newFlagSet("generate", []string{
+		"generate [flags] <input.sql> [output.sql]",
+		"generate [flags] --output <output.sql> <input>...",
+		"generate [flags] --from-db <dsn> [output.sql]",
+		"generate [flags] --split table|type <input.sql> [output-dir]",
+		"generate [flags] --format <tool> --output <migrations-dir> <input>...",
+	}, "Writes history tables and triggers for the CREATE TABLE statements in input.sql.")
+	var showVersion, check bool
+	var split string
+	configFlags := registerConfigFlags(fs)
+	source := registerSourceFlags(fs)
+	fs.BoolVar(&showVersion, "version", false, "Show version information")
+	fs.StringVar(&split, "split", "", "Write a directory with one file per 'table' or per object 'type', and an index.sql including them")
+	fs.BoolVar(&check, "check", false, "Compare with the existing output instead of writing it; print a diff and exit 1 when it is out of date")
+	migration := registerMigrationFlags(fs)
+	var outputFile string
+	registerOutputFlag(fs, &outputFile)
+	if !parseFlags(fs, out, args, 0, -1) {
+		return exitUsage
+	}
+	source.parsed(fs.Args())
+
+	if showVersion {
+		fmt.Printf("sql-history version %s\n", version)
+		return exitOK
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	if split != "" && split != parser.SplitByTable && split != parser.SplitByType {
+		return out.UsageErrorf("--split must be '%s' or '%s'", parser.SplitByTable, parser.SplitByType)
+	}
+	var options parser.MigrationOptions
+	if migration.format != "" {
+		if split != "" {
+			return out.UsageErrorf("--split and --format cannot be combined")
+		}
+		options, err = migration.options()
+		if err != nil {
+			return out.UsageErrorf("%v", err)
+		}
+	} else if migration.dropHistory {
+		return out.UsageErrorf("--drop-history needs --format")
+	}
+
+	explicitOutput := outputFile != ""
+	inputs, outputFile, err := source.splitOutput(fs.Args(), outputFile, "_history")
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+	explicitOutput = explicitOutput || len(fs.Args()) > len(inputs)
+
+	if split != "" {
+		if outputFile == stdio {
+			return out.UsageErrorf("--split writes a directory, not stdout")
+		}
+		if !explicitOutput {
+			outputFile = strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+		}
+	}
+	if migration.format != "" && (!explicitOutput || outputFile == stdio) {
+		return out.UsageErrorf("name the migrations directory with --output")
+	}
+	if check && (migration.format != "" || outputFile == stdio) {
+		return out.UsageErrorf("--check compares with an output file or --split directory")
+	}
+
+	tables, err := source.readTables(out, inputs, outputFile, config)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	written := outputDisplayName(outputFile)
+	if split != "" {
+		files, err := parser.GenerateHistoryFiles(tables, config, split)
+		if err != nil {
+			return out.Errorf("generating history SQL: %v", err)
+		}
+		if check {
+			return checkFiles(out, outputFile, files)
+		}
+		if err := out.writeFiles(outputFile, files, true); err != nil {
+			return out.Errorf("writing output files: %v", err)
+		}
+	} else if migration.format != "" {
+		files, err := parser.GenerateMigrationFiles(tables, config, options)
+		if err != nil {
+			return out.Errorf("generating migration: %v", err)
+		}
+		if err := out.writeFiles(outputFile, files, false); err != nil {
+			return out.Errorf("writing migration: %v", err)
+		}
+		var names []string
+		for _, file := range files {
+			names = append(names, filepath.Join(outputFile, file.Name))
+		}
+		written = strings.Join(names, ", ")
+	} else {
+		output, err := parser.GenerateHistorySQL(tables, config)
+		if err != nil {
+			return out.Errorf("generating history SQL: %v", err)
+		}
+		if check {
+			return checkFile(out, outputFile, output)
+		}
+		if err := out.write(outputFile, output); err != nil {
+			return out.Errorf("writing output file: %v", err)
+		}
+	}
+
+	out.Printf("Successfully processed %d table(s)\n", len(tables))
+	out.Printf("Generated history tables and triggers in: %s\n", written)
+
+	for _, table := range tables {
+		originalName := parser.GetOriginalTableName(table)
+		historyName := parser.GetHistoryTableName(table, config)
+		out.Printf("  - %s -> %s\n", originalName, historyName)
+
+		// Names were validated while generating, so this cannot fail here.
+		names, _ := parser.GeneratedNames(table, config)
+		for _, name := range names {
+			if name.Shortened() {
+				out.Printf("      %s %s shortened to %s\n", name.Kind, name.Full, name.Name)
+			} else {
+				out.Verbosef("      %s %s\n", name.Kind, name.Name)
+			}
+		}
+	}
+
+	return exitOK
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// stdio names standard input as an input and standard output as an output.
+const stdio = "-"
+
+// registerOutputFlag registers --output and its short form -o.
+func registerOutputFlag(fs *flag.FlagSet, output *string) {
+	fs.StringVar(output, "output", "", "Output file, or - for stdout; needed with several inputs")
+	fs.StringVar(output, "o", "", "Short for --output")
+}
+
+// splitOutput separates the inputs of a command from its output file. With
+// --output every argument is an input; otherwise the arguments are
+// <input> [output], the output defaulting to the input name with suffix, or
+// stdout when reading stdin.
+func splitOutput(args []string, output, suffix string) ([]string, string, error) {
+	if len(args) == 0 {
+		return nil, "", fmt.Errorf("no input file given")
+	}
+	if output != "" {
+		return args, output, nil
+	}
+
+	switch len(args) {
+	case 1:
+		name, err := defaultOutputName(args[0], suffix)
+		return args, name, err
+	case 2:
+		return args[:1], args[1], nil
+	}
+	return nil, "", fmt.Errorf("name the output with --output when giving several inputs")
+}
+
+// defaultOutputName derives the output name from a single input file.
+func defaultOutputName(input, suffix string) (string, error) {
+	if input == stdio {
+		return stdio, nil
+	}
+	if isPattern(input) {
+		return "", fmt.Errorf("name the output with --output when reading a pattern")
+	}
+	if info, err := os.Stat(input); err == nil && info.IsDir() {
+		return "", fmt.Errorf("name the output with --output when reading a directory")
+	}
+	return outputName(input, suffix), nil
+}
+
+// outputName derives an output file name from the input file, e.g.
+// schema.sql with suffix "_history" becomes schema_history.sql.
+func outputName(inputFile, suffix string) string {
+	ext := filepath.Ext(inputFile)
+	return strings.TrimSuffix(inputFile, ext) + suffix + ext
+}
+
+// isPattern reports whether an input is a glob pattern rather than a path.
+func isPattern(input string) bool {
+	if _, err := os.Stat(input); err == nil {
+		return false
+	}
+	return strings.ContainsAny(input, "*?[")
+}
+
+// expandInputs resolves the inputs of a command to the files to read, in a
+// deterministic order: inputs in the order given, the files matched by a glob
+// pattern or found below a directory sorted by path. Directories contribute
+// their .sql files. exclude, usually the output file or directory, is
+// skipped, and a file named twice is read once.
+func expandInputs(inputs []string, exclude string) ([]string, error) {
+	var files []string
+	seen := map[string]bool{}
+	add := func(file string) {
+		key := filepath.Clean(file)
+		if isWithin(key, exclude) || seen[key] {
+			return
+		}
+		seen[key] = true
+		files = append(files, file)
+	}
+
+	for _, input := range inputs {
+		if input == stdio {
+			if seen[stdio] {
+				return nil, fmt.Errorf("stdin can only be read once")
+			}
+			seen[stdio] = true
+			files = append(files, stdio)
+			continue
+		}
+
+		if isPattern(input) {
+			matches, err := filepath.Glob(input)
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %w", input, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match %s", input)
+			}
+			sort.Strings(matches)
+			for _, match := range matches {
+				add(match)
+			}
+			continue
+		}
+
+		info, err := os.Stat(input)
+		if err != nil {
+			return nil, fmt.Errorf("reading input file: %w", err)
+		}
+		if !info.IsDir() {
+			add(input)
+			continue
+		}
+
+		// WalkDir visits entries in lexical order.
+		found := false
+		err = filepath.WalkDir(input, func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !entry.IsDir() && strings.EqualFold(filepath.Ext(path), ".sql") {
+				add(path)
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("reading input directory: %w", err)
+		}
+		if !found {
+			return nil, fmt.Errorf("no .sql files found in %s", input)
+		}
+	}
+
+	return files, nil
+}
+
+// isWithin reports whether file is path or lies below it.
+func isWithin(file, path string) bool {
+	if path == "" || path == stdio {
+		return false
+	}
+	rel, err := filepath.Rel(filepath.Clean(path), file)
+	return err == nil && (rel == "." || !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && rel != "..")
+}
+
+// readTables parses the CREATE TABLE statements of the inputs into one table
+// set and applies the per-table configuration, whose table sections must all
+// match a table.
+func readTables(out *output, inputs []string, exclude string, config parser.Config) ([]parser.Table, error) {
+	tables, err := parseTables(out, inputs, exclude)
+	if err != nil {
+		return nil, err
+	}
+	if err := parser.CheckTableConfig(tables, config); err != nil {
+		return nil, err
+	}
+	return parser.ApplyTableConfig(tables, config)
+}
+
+// parseTables parses the CREATE TABLE statements of the inputs into one table
+// set. A table defined in two files is an error; foreign keys referencing
+// tables in none of them are reported as warnings.
+func parseTables(out *output, inputs []string, exclude string) ([]parser.Table, error) {
+	files, err := expandInputs(inputs, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var tables []parser.Table
+	definedIn := map[string]string{}
+	for _, file := range files {
+		content, err := readFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading input file: %w", err)
+		}
+
+		parsed, err := parser.ParseCreateTables(content)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", displayName(file), err)
+		}
+
+		for _, table := range parsed {
+			name := parser.GetOriginalTableName(table)
+			if previous, ok := definedIn[name]; ok {
+				return nil, fmt.Errorf("table %s is defined in both %s and %s", name, displayName(previous), displayName(file))
+			}
+			definedIn[name] = file
+		}
+		tables = append(tables, parsed...)
+	}
+
+	if len(tables) == 0 {
+		names := make([]string, len(inputs))
+		for i, input := range inputs {
+			names[i] = displayName(input)
+		}
+		return nil, fmt.Errorf("no CREATE TABLE statements found in %s", strings.Join(names, ", "))
+	}
+
+	for _, reference := range parser.UnresolvedReferences(tables) {
+		out.Warnf("%s\n", reference)
+	}
+
+	return tables, nil
+}
+
+// displayName names an input in messages.
+func displayName(file string) string {
+	if file == stdio {
+		return "stdin"
+	}
+	return file
+}
+
+// readFile reads a file, or stdin for "-".
+func readFile(filename string) (string, error) {
+	if filename == stdio {
+		content, err := io.ReadAll(os.Stdin)
+		return string(content), err
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return "", err
+	}
+
+	return string(content), nil
+}
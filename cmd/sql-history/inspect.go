@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runInspect prints the tables read from an input file or database and the
+// names of the objects generated for them, and returns the process exit code.
+func runInspect(args []string) int {
+	fs, out := newFlagSet("inspect", []string{
+		"inspect [flags] <input> [table...]",
+		"inspect [flags] --from-db <dsn> [table...]",
+	}, "Shows how the tables are read and what would be generated for them, without writing anything.")
+	configFlags := registerConfigFlags(fs)
+	source := registerSourceFlags(fs)
+	if !parseFlags(fs, out, args, 0, -1) {
+		return exitUsage
+	}
+	source.parsed(fs.Args())
+
+	args = fs.Args()
+	if source.fromDB == "" && len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	var inputs []string
+	if source.fromDB == "" {
+		inputs = args[:1]
+		args = args[1:]
+	}
+
+	tables, err := source.readTables(out, inputs, "", config)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+	if err := parser.ValidateNames(tables, config); err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	if len(args) > 0 {
+		tables, err = selectTables(tables, args)
+		if err != nil {
+			return out.UsageErrorf("%v", err)
+		}
+	}
+
+	for i, table := range tables {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("%s -> %s\n", parser.GetOriginalTableName(table), parser.GetHistoryTableName(table, config))
+
+		fmt.Println("  columns:")
+		for _, col := range table.Columns {
+			fmt.Printf("    %s\n", strings.TrimSpace(parser.QuoteIdentifier(col.Name)+" "+col.DataType+" "+col.Options))
+		}
+
+		if len(table.IgnoredColumns) > 0 {
+			fmt.Printf("  ignored columns: %s\n", strings.Join(table.IgnoredColumns, ", "))
+		}
+
+		fmt.Printf("  primary key: %s\n", strings.Join(parser.GetPrimaryKeyColumns(table), ", "))
+
+		if len(table.ForeignKeys) > 0 {
+			fmt.Println("  foreign keys:")
+			for _, fk := range table.ForeignKeys {
+				line := fmt.Sprintf("(%s) -> %s (%s)", fk.ColumnName, fk.ReferencedTable, fk.ReferencedColumn)
+				if fk.OnDelete != "" {
+					line += " ON DELETE " + fk.OnDelete
+				}
+				if fk.OnUpdate != "" {
+					line += " ON UPDATE " + fk.OnUpdate
+				}
+				fmt.Printf("    %s\n", line)
+			}
+		}
+
+		// Names were validated above, so this cannot fail here.
+		names, _ := parser.GeneratedNames(table, config)
+		fmt.Println("  generated:")
+		for _, name := range names {
+			kind := name.Kind
+			if name.Operation != "" {
+				kind += " (" + name.Operation + ")"
+			}
+			line := fmt.Sprintf("%-28s %s", kind, name.Name)
+			if name.Shortened() {
+				line += ", shortened from " + name.Full
+			}
+			fmt.Printf("    %s\n", line)
+		}
+	}
+	return exitOK
+}
@@ -1,127 +1,79 @@
 package main
 
 import (
-	"flag"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
-	"strings"
-
-	"github.com/leinonen/sql-history/pkg/parser"
 )
 
 var version = "1.0.0"
 
-func main() {
-	var trackUser bool
-	var userSource string
-	var showVersion bool
-	
-	flag.BoolVar(&trackUser, "track-user", false, "Add user tracking to history tables")
-	flag.StringVar(&userSource, "user-source", "current_user", "Source for user info: 'current_user' or 'session'")
-	flag.BoolVar(&showVersion, "version", false, "Show version information")
-	flag.Parse()
-
-	if showVersion {
-		fmt.Printf("sql-history version %s\n", version)
-		os.Exit(0)
-	}
-
-	args := flag.Args()
-	if len(args) < 1 {
-		fmt.Println("Usage: sql-history [flags] <input.sql> [output.sql]")
-		fmt.Println("  input.sql  - SQL file containing CREATE TABLE statements")
-		fmt.Println("  output.sql - Output file for history tables and triggers (optional)")
-		fmt.Println("\nFlags:")
-		fmt.Println("  --track-user        Add user tracking to history tables")
-		fmt.Println("  --user-source       Source for user info: 'current_user' or 'session' (default: current_user)")
-		fmt.Println("  --version           Show version information")
-		os.Exit(1)
-	}
-
-	if userSource != "current_user" && userSource != "session" {
-		fmt.Println("Error: --user-source must be either 'current_user' or 'session'")
-		os.Exit(1)
-	}
-
-	inputFile := args[0]
-	outputFile := ""
-
-	if len(args) >= 2 {
-		outputFile = args[1]
-	} else {
-		ext := filepath.Ext(inputFile)
-		base := strings.TrimSuffix(inputFile, ext)
-		outputFile = base + "_history" + ext
-	}
-
-	content, err := readFile(inputFile)
-	if err != nil {
-		fmt.Printf("Error reading input file: %v\n", err)
-		os.Exit(1)
-	}
-
-	tables, err := parser.ParseCreateTables(content)
-	if err != nil {
-		fmt.Printf("Error parsing SQL: %v\n", err)
-		os.Exit(1)
-	}
-
-	if len(tables) == 0 {
-		fmt.Println("No CREATE TABLE statements found in the input file")
-		os.Exit(1)
-	}
-
-	config := parser.Config{
-		TrackUser:  trackUser,
-		UserSource: userSource,
-	}
-
-	output, err := parser.GenerateHistorySQL(tables, config)
-	if err != nil {
-		fmt.Printf("Error generating history SQL: %v\n", err)
-		os.Exit(1)
-	}
-
-	err = writeFile(outputFile, output)
-	if err != nil {
-		fmt.Printf("Error writing output file: %v\n", err)
-		os.Exit(1)
-	}
+// command is a subcommand of sql-history. run receives the arguments after
+// the command name and returns the process exit code.
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) int
+}
 
-	fmt.Printf("Successfully processed %d table(s)\n", len(tables))
-	fmt.Printf("Generated history tables and triggers in: %s\n", outputFile)
+var commands = []command{
+	{"generate", "Generate history tables and triggers (default)", runGenerate},
+	{"down", "Generate a script removing the history objects", runDown},
+	{"migrate", "Generate a migration between two schema versions", runMigrate},
+	{"apply", "Install history in a database in one transaction", runApply},
+	{"check", "Report drift between installed and generated history objects", runCheck},
+	{"backfill", "Record existing rows as their first history version", runBackfill},
+	{"verify-chain", "Verify the hash chains of history tables", runVerifyChain},
+	{"inspect", "Show the tables read and the objects generated for them", runInspect},
+	{"query", "Print point-in-time queries for history tables", runQuery},
+	{"watch", "Regenerate the output whenever the inputs change", runWatch},
+}
 
-	for _, table := range tables {
-		originalName := parser.GetOriginalTableName(table)
-		historyName := parser.GetHistoryTableName(table)
-		fmt.Printf("  - %s -> %s\n", originalName, historyName)
-	}
+func main() {
+	os.Exit(run(os.Args[1:]))
 }
 
-func readFile(filename string) (string, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return "", err
+// run dispatches to a command. Arguments that do not start with a command
+// name are passed to generate, which keeps the original invocation
+// "sql-history [flags] <input.sql> [output.sql]" working.
+func run(args []string) int {
+	if len(args) == 0 {
+		printUsage(os.Stderr)
+		return exitUsage
 	}
-	defer file.Close()
 
-	content, err := io.ReadAll(file)
-	if err != nil {
-		return "", err
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		if len(args) > 1 {
+			for _, cmd := range commands {
+				if cmd.name == args[1] {
+					return cmd.run([]string{"-h"})
+				}
+			}
+		}
+		printUsage(os.Stdout)
+		return exitOK
+	case "version", "-version", "--version":
+		fmt.Printf("sql-history version %s\n", version)
+		return exitOK
 	}
 
-	return string(content), nil
+	for _, cmd := range commands {
+		if cmd.name == args[0] {
+			return cmd.run(args[1:])
+		}
+	}
+	return runGenerate(args)
 }
 
-func writeFile(filename, content string) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: sql-history <command> [flags] [arguments]")
+	fmt.Fprintln(w, "       sql-history [flags] <input.sql> [output.sql]   (same as generate)")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-13s %s\n", cmd.name, cmd.summary)
 	}
-	defer file.Close()
-
-	_, err = file.WriteString(content)
-	return err
+	fmt.Fprintln(w, "\nRun 'sql-history <command> -h' for the flags of a command.")
+	fmt.Fprintln(w, "\nExit status is 0 on success, 1 when a command fails or finds drift or broken")
+	fmt.Fprintln(w, "hash chains, and 2 for invalid arguments.")
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runMigrate writes the migration that updates history objects generated for
+// an old schema to a new one, and returns the process exit code.
+func runMigrate(args []string) int {
+	fs, out := newFlagSet("migrate", []string{
+		"migrate [flags] <old> <new> [output.sql]",
+	}, "old and new are schema files, directories or patterns.\nUse the same flags the history SQL was generated with.")
+	configFlags := registerConfigFlags(fs)
+	renames := renameValues{}
+	fs.Var(renames, "rename", "Rename a column in its history table as table.old=new (repeatable); other columns missing from the new schema are dropped")
+	if !parseFlags(fs, out, args, 2, 3) {
+		return exitUsage
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	outputFile := fs.Arg(2)
+	if outputFile == "" {
+		outputFile, err = defaultOutputName(fs.Arg(1), "_history_migration")
+		if err != nil {
+			return out.UsageErrorf("%v", err)
+		}
+	}
+	if fs.Arg(0) == stdio && fs.Arg(1) == stdio {
+		return out.UsageErrorf("stdin can only be read once")
+	}
+
+	oldTables, err := parseTables(out, fs.Args()[:1], outputFile)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+	newTables, err := parseTables(out, fs.Args()[1:2], outputFile)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	// Table sections may describe tables of either version.
+	if err := parser.CheckTableConfig(append(append([]parser.Table{}, oldTables...), newTables...), config); err != nil {
+		return out.Errorf("%v", err)
+	}
+	if oldTables, err = parser.ApplyTableConfig(oldTables, config); err != nil {
+		return out.Errorf("%v", err)
+	}
+	if newTables, err = parser.ApplyTableConfig(newTables, config); err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	output, err := parser.GenerateMigrationSQL(oldTables, newTables, config, parser.ColumnRenames(renames))
+	if err != nil {
+		return out.Errorf("generating migration SQL: %v", err)
+	}
+
+	if err := out.write(outputFile, output); err != nil {
+		return out.Errorf("writing output file: %v", err)
+	}
+
+	out.Printf("Generated history migration in: %s\n", outputDisplayName(outputFile))
+
+	oldByName := map[string]parser.Table{}
+	for _, table := range oldTables {
+		oldByName[parser.GetOriginalTableName(table)] = table
+	}
+	for _, table := range newTables {
+		name := parser.GetOriginalTableName(table)
+		old, ok := oldByName[name]
+		if !ok {
+			out.Printf("  - %s: new table\n", name)
+			continue
+		}
+		delete(oldByName, name)
+		for _, change := range parser.DiffColumns(old, table, renames[name]) {
+			if change.Kind == "rename" {
+				out.Printf("  - %s: rename %s to %s\n", name, change.OldName, change.Name)
+			} else {
+				out.Printf("  - %s: %s %s\n", name, change.Kind, change.Name)
+			}
+		}
+	}
+	for _, table := range oldTables {
+		if _, ok := oldByName[parser.GetOriginalTableName(table)]; ok {
+			out.Printf("  - %s: removed, history table kept\n", parser.GetOriginalTableName(table))
+		}
+	}
+	return exitOK
+}
+
+// renameValues collects --rename flags by table, each mapping old column
+// names to new ones.
+type renameValues parser.ColumnRenames
+
+func (v renameValues) String() string {
+	var pairs []string
+	for table, columns := range v {
+		for oldName, newName := range columns {
+			pairs = append(pairs, table+"."+oldName+"="+newName)
+		}
+	}
+	return strings.Join(pairs, ",")
+}
+
+// Set parses table.old=new. The table may be schema-qualified; the column is
+// the part after the last dot.
+func (v renameValues) Set(value string) error {
+	column, newName, ok := strings.Cut(value, "=")
+	dot := strings.LastIndex(column, ".")
+	if !ok || dot <= 0 || dot == len(column)-1 || newName == "" {
+		return fmt.Errorf("expected table.old=new, got %q", value)
+	}
+	table, oldName := column[:dot], column[dot+1:]
+	if v[table] == nil {
+		v[table] = map[string]string{}
+	}
+	if previous, ok := v[table][oldName]; ok && previous != newName {
+		return fmt.Errorf("%s.%s is renamed to both %s and %s", table, oldName, previous, newName)
+	}
+	v[table][oldName] = newName
+	return nil
+}
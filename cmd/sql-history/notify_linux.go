@@ -0,0 +1,58 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// notifier reports changes in watched directories through inotify.
+type notifier struct {
+	fd      int
+	watched map[string]bool
+	changed chan struct{}
+}
+
+func newNotifier() (*notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+
+	n := &notifier{fd: fd, watched: map[string]bool{}, changed: make(chan struct{}, 1)}
+	go n.read()
+	return n, nil
+}
+
+// add watches dir for files being written, created, moved or deleted.
+// Directories are watched rather than files, because editors often save by
+// replacing a file. A directory that cannot be watched is left to polling.
+func (n *notifier) add(dir string) {
+	if n.watched[dir] {
+		return
+	}
+	const mask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_CREATE |
+		syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE
+	if _, err := syscall.InotifyAddWatch(n.fd, dir, mask); err == nil {
+		n.watched[dir] = true
+	}
+}
+
+// read signals changed for every batch of events until the descriptor fails.
+func (n *notifier) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		count, err := syscall.Read(n.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil || count <= 0 {
+			return
+		}
+		select {
+		case n.changed <- struct{}{}:
+		default:
+		}
+	}
+}
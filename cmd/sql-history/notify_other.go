@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// notifier is not available on this platform; watch polls instead.
+type notifier struct {
+	changed chan struct{}
+}
+
+func newNotifier() (*notifier, error) {
+	return nil, fmt.Errorf("file notifications are not supported on %s", runtime.GOOS)
+}
+
+func (n *notifier) add(dir string) {}
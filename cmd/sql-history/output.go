@@ -0,0 +1,188 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// Exit codes shared by all commands.
+const (
+	exitOK = 0
+	// exitFailure is returned when a command fails, and when check or
+	// verify-chain find problems.
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+// output prints the progress of a command. Errors and warnings always go to
+// stderr; --quiet suppresses everything else and --verbose adds detail.
+// Progress moves to stderr once the result has been written to stdout.
+type output struct {
+	quiet   bool
+	verbose bool
+	stdout  bool
+}
+
+// newFlagSet creates the flag set of a command. usage lists its invocations
+// without the leading "sql-history", and description is printed below them.
+// Every command takes --quiet and --verbose.
+func newFlagSet(name string, usage []string, description string) (*flag.FlagSet, *output) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	out := &output{}
+	fs.BoolVar(&out.quiet, "quiet", false, "Only print errors")
+	fs.BoolVar(&out.verbose, "verbose", false, "Print more detail, such as the SQL being executed")
+	fs.Usage = func() {
+		for i, line := range usage {
+			prefix := "Usage: "
+			if i > 0 {
+				prefix = "       "
+			}
+			fmt.Fprintln(fs.Output(), prefix+"sql-history "+line)
+		}
+		if description != "" {
+			fmt.Fprintln(fs.Output(), "\n"+description)
+		}
+		fmt.Fprintln(fs.Output(), "\nFlags:")
+		fs.PrintDefaults()
+	}
+	return fs, out
+}
+
+// parseFlags parses the arguments of a command and checks that the number of
+// remaining arguments is within min and max, where a negative max means no
+// limit. It returns false after printing the usage when they are not.
+func parseFlags(fs *flag.FlagSet, out *output, args []string, min, max int) bool {
+	fs.Parse(args)
+
+	if out.quiet && out.verbose {
+		fmt.Fprintln(os.Stderr, "Error: --quiet and --verbose cannot be combined")
+		return false
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return false
+	}
+	return true
+}
+
+// progress is where progress is printed.
+func (o *output) progress() io.Writer {
+	if o.stdout {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// Printf prints progress unless --quiet is set.
+func (o *output) Printf(format string, args ...any) {
+	if !o.quiet {
+		fmt.Fprintf(o.progress(), format, args...)
+	}
+}
+
+// Verbosef prints detail when --verbose is set.
+func (o *output) Verbosef(format string, args ...any) {
+	if o.verbose {
+		fmt.Fprintf(o.progress(), format, args...)
+	}
+}
+
+// Warnf prints a warning to stderr unless --quiet is set.
+func (o *output) Warnf(format string, args ...any) {
+	if !o.quiet {
+		fmt.Fprintf(os.Stderr, "Warning: "+format, args...)
+	}
+}
+
+// Errorf prints an error to stderr and returns exitFailure.
+func (o *output) Errorf(format string, args ...any) int {
+	fmt.Fprintf(os.Stderr, "Error: "+format+"\n", args...)
+	return exitFailure
+}
+
+// UsageErrorf prints an error about the command line to stderr and returns
+// exitUsage.
+func (o *output) UsageErrorf(format string, args ...any) int {
+	fmt.Fprintf(os.Stderr, "Error: "+format+"\n", args...)
+	return exitUsage
+}
+
+// write writes the result of a command to a file, or to stdout for "-".
+func (o *output) write(filename, content string) error {
+	if filename == stdio {
+		o.stdout = true
+		_, err := io.WriteString(os.Stdout, content)
+		return err
+	}
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.WriteString(content)
+	return err
+}
+
+// writeFiles writes generated files below dir. With replace, existing files
+// are overwritten and .sql files in dir that are not part of the output, such
+// as those of dropped tables, are reported so they can be removed. Without
+// it, no file is written when one of them exists already, as for migrations,
+// which must not change once applied.
+func (o *output) writeFiles(dir string, files []parser.OutputFile, replace bool) error {
+	if !replace {
+		for _, file := range files {
+			path := filepath.Join(dir, filepath.FromSlash(file.Name))
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists", path)
+			}
+		}
+	}
+
+	written := map[string]bool{}
+	for _, file := range files {
+		path := filepath.Join(dir, filepath.FromSlash(file.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return err
+		}
+		if err := o.write(path, file.SQL); err != nil {
+			return err
+		}
+		written[path] = true
+	}
+	if !replace {
+		return nil
+	}
+
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() && filepath.Ext(path) == ".sql" && !written[path] {
+			o.Warnf("%s is not part of the generated output\n", path)
+		}
+		return nil
+	})
+}
+
+// outputDisplayName names an output file in messages.
+func outputDisplayName(file string) string {
+	if file == stdio {
+		return "stdout"
+	}
+	return file
+}
+
+// indent prefixes every line of text, for printing SQL under a heading.
+func indent(text, prefix string) string {
+	lines := strings.Split(strings.TrimRight(text, "\n"), "\n")
+	return prefix + strings.Join(lines, "\n"+prefix) + "\n"
+}
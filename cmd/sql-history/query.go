@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// runQuery prints queries selecting tables as they were at a point in time
+// from their history tables, and returns the process exit code.
+func runQuery(args []string) int {
+	fs, out := newFlagSet("query", []string{
+		"query [flags] [--at <timestamp>] <input> [table...]",
+		"query [flags] [--at <timestamp>] --from-db <dsn> [table...]",
+	}, "Prints a point-in-time query for each table, or for the named tables.")
+	var at string
+	fs.StringVar(&at, "at", "", "Point in time, e.g. '2024-01-01 12:00:00' (default: current rows)")
+	configFlags := registerConfigFlags(fs)
+	source := registerSourceFlags(fs)
+	if !parseFlags(fs, out, args, 0, -1) {
+		return exitUsage
+	}
+	source.parsed(fs.Args())
+
+	args = fs.Args()
+	if source.fromDB == "" && len(args) == 0 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+
+	var inputs []string
+	if source.fromDB == "" {
+		inputs = args[:1]
+		args = args[1:]
+	}
+
+	tables, err := source.readTables(out, inputs, "", config)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	if len(args) > 0 {
+		tables, err = selectTables(tables, args)
+		if err != nil {
+			return out.UsageErrorf("%v", err)
+		}
+	}
+
+	for i, table := range tables {
+		if i > 0 {
+			fmt.Println()
+		}
+		fmt.Printf("-- %s\n", parser.GetOriginalTableName(table))
+		fmt.Print(parser.GeneratePointInTimeQuery(table, config, at))
+	}
+	return exitOK
+}
+
+// selectTables picks the named tables, given as table or schema.table.
+func selectTables(tables []parser.Table, names []string) ([]parser.Table, error) {
+	var selected []parser.Table
+	for _, name := range names {
+		found := false
+		for _, table := range tables {
+			if name == parser.GetOriginalTableName(table) || name == table.Name {
+				selected = append(selected, table)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("table %s not found", name)
+		}
+	}
+	return selected, nil
+}
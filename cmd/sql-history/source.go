@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/leinonen/sql-history/pkg/database"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// sourceFlags select where tables are read from: a schema file, or a live
+// database with --from-db.
+type sourceFlags struct {
+	db     *dsnFlag
+	fromDB string
+	filter database.Filter
+}
+
+func registerSourceFlags(fs *flag.FlagSet) *sourceFlags {
+	f := &sourceFlags{}
+
+	f.db = registerDSNFlag(fs, "from-db", "Read tables from the database at this connection string instead of input files (default without arguments: $DATABASE_URL)")
+	registerFilterFlags(fs, &f.filter, "With --from-db, ")
+
+	return f
+}
+
+// registerFilterFlags registers the flags selecting the tables read from a
+// database. prefix qualifies the help text.
+func registerFilterFlags(fs *flag.FlagSet, filter *database.Filter, prefix string) {
+	fs.Var((*listValue)(&filter.Schemas), "schema", prefix+"only read schemas matching this pattern (repeatable)")
+	fs.Var((*listValue)(&filter.ExcludeSchemas), "exclude-schema", prefix+"skip schemas matching this pattern (repeatable)")
+	fs.Var((*listValue)(&filter.Tables), "table", prefix+"only read tables matching this pattern, as table or schema.table (repeatable)")
+	fs.Var((*listValue)(&filter.ExcludeTables), "exclude-table", prefix+"skip tables matching this pattern, as table or schema.table (repeatable)")
+}
+
+// parsed sets fromDB once the flags are parsed, from --from-db or, without
+// arguments, $DATABASE_URL.
+func (f *sourceFlags) parsed(args []string) {
+	f.fromDB = f.db.forArgs(args)
+}
+
+// splitOutput separates the input files from the output file, which is
+// named after the database when reading from one. See splitOutput.
+func (f *sourceFlags) splitOutput(args []string, output, suffix string) ([]string, string, error) {
+	if f.fromDB == "" {
+		return splitOutput(args, output, suffix)
+	}
+
+	if len(args) > 1 || (len(args) > 0 && output != "") {
+		return nil, "", fmt.Errorf("input files cannot be combined with --from-db")
+	}
+	if output != "" {
+		return nil, output, nil
+	}
+	if len(args) == 1 {
+		return nil, args[0], nil
+	}
+	name := "schema"
+	if parsed, err := pgx.ParseConfig(f.fromDB); err == nil && parsed.Database != "" {
+		name = parsed.Database
+	}
+	return nil, name + suffix + ".sql", nil
+}
+
+// readTables reads the tables from the input files or the database, skipping
+// exclude among the input files. History tables already installed in the
+// database are skipped.
+func (f *sourceFlags) readTables(out *output, inputs []string, exclude string, config parser.Config) ([]parser.Table, error) {
+	if f.fromDB == "" {
+		return readTables(out, inputs, exclude, config)
+	}
+
+	ctx := context.Background()
+	conn, err := database.Connect(ctx, f.fromDB)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	return readDatabaseTables(ctx, conn, f.filter, config)
+}
+
+// readDatabaseTables reads the tables selected by filter, skipping the
+// history tables generated for them, and applies the per-table configuration.
+// Without a filter, its table sections must all match a table.
+func readDatabaseTables(ctx context.Context, conn *pgx.Conn, filter database.Filter, config parser.Config) ([]parser.Table, error) {
+	tables, err := database.ReadTables(ctx, conn, filter)
+	if err != nil {
+		return nil, fmt.Errorf("reading tables from database: %w", err)
+	}
+	tables = database.ExcludeHistoryTables(tables, config)
+
+	if len(tables) == 0 {
+		return nil, fmt.Errorf("no tables found in database")
+	}
+	// A filter leaves out tables that the config may well describe.
+	if len(filter.Schemas)+len(filter.ExcludeSchemas)+len(filter.Tables)+len(filter.ExcludeTables) == 0 {
+		if err := parser.CheckTableConfig(tables, config); err != nil {
+			return nil, err
+		}
+	}
+	return parser.ApplyTableConfig(tables, config)
+}
+
+// listValue collects a repeatable flag.
+type listValue []string
+
+func (v *listValue) String() string {
+	return strings.Join(*v, ",")
+}
+
+func (v *listValue) Set(value string) error {
+	*v = append(*v, value)
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+
+	"github.com/leinonen/sql-history/pkg/database"
+)
+
+// runVerifyChain checks the hash chains of the history tables generated for
+// the tables in the input files and returns the process exit code.
+func runVerifyChain(args []string) int {
+	fs, out := newFlagSet("verify-chain", []string{
+		"verify-chain [flags] --dsn <dsn> <input>...",
+	}, "Use the same flags the history SQL was generated with.")
+	dsnArg := registerDSNFlag(fs, "dsn", "PostgreSQL connection string (default: $DATABASE_URL)")
+	configFlags := registerConfigFlags(fs)
+	if !parseFlags(fs, out, args, 1, -1) {
+		return exitUsage
+	}
+	dsn := dsnArg.get()
+	if dsn == "" {
+		return out.UsageErrorf("--dsn is required")
+	}
+
+	config, err := configFlags.config()
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+	config.HashChain = true
+
+	tables, err := readTables(out, fs.Args(), "", config)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+
+	ctx := context.Background()
+	conn, err := database.Connect(ctx, dsn)
+	if err != nil {
+		return out.Errorf("%v", err)
+	}
+	defer conn.Close(ctx)
+
+	broken := 0
+	for _, table := range tables {
+		result, err := database.VerifyChain(ctx, conn, table, config)
+		if err != nil {
+			return out.Errorf("%v", err)
+		}
+		if result.Intact {
+			out.Printf("  - %s: OK\n", result.HistoryTable)
+			continue
+		}
+		broken++
+		out.Printf("  - %s: BROKEN at %s, version %d\n", result.HistoryTable, result.Key, result.Version)
+	}
+
+	if broken > 0 {
+		out.Printf("Hash chain broken in %d of %d table(s)\n", broken, len(tables))
+		return exitFailure
+	}
+	out.Printf("Hash chains intact in %d table(s)\n", len(tables))
+	return exitOK
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"maps"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/leinonen/sql-history/pkg/database"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// settleDelay is how long to wait after a change notification before reading
+// the inputs, since editors save a file in several steps.
+const settleDelay = 100 * time.Millisecond
+
+// watcher regenerates the output of generate from its inputs.
+type watcher struct {
+	out         *output
+	configFlags *configFlags
+	inputs      []string
+	output      string
+	split       string
+	dsn         string
+	// applied holds the tables last applied to the database, from which
+	// column changes are migrated.
+	applied []parser.Table
+}
+
+// runWatch regenerates the history SQL whenever an input or the config file
+// changes, and returns the process exit code once interrupted.
+func runWatch(args []string) int {
+	fs, out := newFlagSet("watch", []string{
+		"watch [flags] <input.sql> [output.sql]",
+		"watch [flags] --output <output.sql> <input>...",
+		"watch [flags] --split table|type <input.sql> [output-dir]",
+	}, "Regenerates the output of generate whenever an input or the config file changes, until interrupted.")
+	var split string
+	var interval time.Duration
+	configFlags := registerConfigFlags(fs)
+	fs.StringVar(&split, "split", "", "Write a directory with one file per 'table' or per object 'type', and an index.sql including them")
+	dsnArg := registerDSNFlag(fs, "dsn", "Also apply the history to this development database after every change")
+	fs.DurationVar(&interval, "interval", time.Second, "How often to poll the inputs for changes")
+	var outputFile string
+	registerOutputFlag(fs, &outputFile)
+	if !parseFlags(fs, out, args, 1, -1) {
+		return exitUsage
+	}
+
+	if _, err := configFlags.config(); err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+	if split != "" && split != parser.SplitByTable && split != parser.SplitByType {
+		return out.UsageErrorf("--split must be '%s' or '%s'", parser.SplitByTable, parser.SplitByType)
+	}
+	if interval <= 0 {
+		return out.UsageErrorf("--interval must be positive")
+	}
+
+	explicitOutput := outputFile != ""
+	inputs, outputFile, err := splitOutput(fs.Args(), outputFile, "_history")
+	if err != nil {
+		return out.UsageErrorf("%v", err)
+	}
+	explicitOutput = explicitOutput || len(fs.Args()) > len(inputs)
+	for _, input := range inputs {
+		if input == stdio {
+			return out.UsageErrorf("watch reads files, not stdin")
+		}
+	}
+	if outputFile == stdio {
+		return out.UsageErrorf("watch writes a file, not stdout")
+	}
+	if split != "" && !explicitOutput {
+		outputFile = strings.TrimSuffix(outputFile, filepath.Ext(outputFile))
+	}
+
+	w := &watcher{out: out, configFlags: configFlags, inputs: inputs, output: outputFile, split: split, dsn: dsnArg.forArgs(inputs)}
+
+	// Without file notifications, changes are only seen when polling.
+	var changed <-chan struct{}
+	notifier, err := newNotifier()
+	if err == nil {
+		changed = notifier.changed
+	} else {
+		out.Verbosef("Polling every %s: %v\n", interval, err)
+	}
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	out.Printf("Watching %s; press Ctrl+C to stop\n", strings.Join(inputs, ", "))
+
+	var last map[string]fileState
+	lastErr := ""
+	for {
+		files, err := w.files()
+		current := snapshot(files)
+		errText := ""
+		if err != nil {
+			errText = err.Error()
+		}
+
+		if last == nil || !maps.Equal(current, last) || errText != lastErr {
+			if err != nil {
+				out.Errorf("%v", err)
+			} else {
+				w.regenerate()
+			}
+		}
+		last, lastErr = current, errText
+
+		if notifier != nil {
+			for _, dir := range watchDirs(w.inputs, files) {
+				notifier.add(dir)
+			}
+		}
+
+		select {
+		case <-interrupt:
+			out.Printf("Stopped watching\n")
+			return exitOK
+		case <-changed:
+			time.Sleep(settleDelay)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// files returns the input files and the config file being watched.
+func (w *watcher) files() ([]string, error) {
+	files, err := expandInputs(w.inputs, w.output)
+	if path := w.configFlags.path(); path != "" {
+		files = append(files, path)
+	}
+	return files, err
+}
+
+// regenerate reads the inputs, writes the output and applies it when --dsn is
+// set. Errors are printed rather than returned, so that watching continues
+// until the inputs are fixed.
+func (w *watcher) regenerate() {
+	config, err := w.configFlags.config()
+	if err != nil {
+		w.out.Errorf("%v", err)
+		return
+	}
+
+	tables, err := readTables(w.out, w.inputs, w.output, config)
+	if err != nil {
+		w.out.Errorf("%v", err)
+		return
+	}
+
+	if w.split != "" {
+		files, err := parser.GenerateHistoryFiles(tables, config, w.split)
+		if err != nil {
+			w.out.Errorf("generating history SQL: %v", err)
+			return
+		}
+		if err := w.out.writeFiles(w.output, files, true); err != nil {
+			w.out.Errorf("writing output files: %v", err)
+			return
+		}
+	} else {
+		output, err := parser.GenerateHistorySQL(tables, config)
+		if err != nil {
+			w.out.Errorf("generating history SQL: %v", err)
+			return
+		}
+		if err := w.out.write(w.output, output); err != nil {
+			w.out.Errorf("writing output file: %v", err)
+			return
+		}
+	}
+	w.out.Printf("[%s] Generated history for %d table(s) in: %s\n", time.Now().Format("15:04:05"), len(tables), w.output)
+
+	if w.dsn != "" {
+		w.apply(tables, config)
+	}
+}
+
+// apply installs the history objects in the development database. The SQL is
+// generated idempotent so that it can be applied again after every change:
+// trigger functions are replaced, but existing history tables are kept as
+// they are. Column changes since the last apply are migrated first, and
+// history tables whose columns still do not match are reported instead of
+// installing triggers that would fail on every write.
+func (w *watcher) apply(tables []parser.Table, config parser.Config) {
+	config.Idempotent = true
+	steps, err := parser.GenerateHistorySteps(tables, config)
+	if err != nil {
+		w.out.Errorf("generating history SQL: %v", err)
+		return
+	}
+
+	ctx := context.Background()
+	conn, err := database.Connect(ctx, w.dsn)
+	if err != nil {
+		w.out.Errorf("%v", err)
+		return
+	}
+	defer conn.Close(ctx)
+
+	if w.applied != nil {
+		migration, err := parser.GenerateMigrationSQL(w.applied, tables, config, nil)
+		if err != nil {
+			w.out.Errorf("generating history migration: %v", err)
+			return
+		}
+		if _, err := conn.Exec(ctx, migration); err != nil {
+			w.out.Errorf("migrating history: %v; rolled back", err)
+			return
+		}
+		w.applied = tables
+	}
+
+	drifts, err := database.CheckDrift(ctx, conn, tables, config)
+	if err != nil {
+		w.out.Errorf("%v", err)
+		return
+	}
+	var mismatched []string
+	for _, drift := range drifts {
+		if drift.Kind == "missing column" || drift.Kind == "type mismatch" {
+			mismatched = append(mismatched, drift.Table+": "+drift.String())
+		}
+	}
+	if len(mismatched) > 0 {
+		w.out.Errorf("history tables do not match the schema, run migrate or recreate the database:\n  %s", strings.Join(mismatched, "\n  "))
+		return
+	}
+
+	err = database.Apply(ctx, conn, steps, false, func(step parser.Step) {
+		w.out.Verbosef("  - %s\n", step.Name)
+	})
+	if err != nil {
+		w.out.Errorf("%v; rolled back", err)
+		return
+	}
+	w.applied = tables
+	w.out.Printf("[%s] Applied history for %d table(s)\n", time.Now().Format("15:04:05"), len(tables))
+}
+
+// fileState identifies a version of a watched file.
+type fileState struct {
+	modTime int64
+	size    int64
+}
+
+// snapshot records the state of files. Files that cannot be read are left
+// out, so that their reappearance counts as a change.
+func snapshot(files []string) map[string]fileState {
+	states := map[string]fileState{}
+	for _, file := range files {
+		if info, err := os.Stat(file); err == nil {
+			states[file] = fileState{modTime: info.ModTime().UnixNano(), size: info.Size()}
+		}
+	}
+	return states
+}
+
+// watchDirs returns the directories to watch for changes to the inputs: the
+// directories holding the files, every directory below a directory input,
+// and the directory of a pattern, so that new files are noticed.
+func watchDirs(inputs, files []string) []string {
+	var dirs []string
+	seen := map[string]bool{}
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, file := range files {
+		add(filepath.Dir(file))
+	}
+	for _, input := range inputs {
+		if isPattern(input) {
+			add(filepath.Dir(input))
+			continue
+		}
+		filepath.WalkDir(input, func(path string, entry fs.DirEntry, err error) error {
+			if err == nil && entry.IsDir() {
+				add(path)
+			}
+			return nil
+		})
+	}
+	return dirs
+}
@@ -0,0 +1,43 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// applyLock names the advisory lock held while applying, so that concurrent
+// runs against the same database wait for each other instead of racing.
+const applyLock = "sql-history"
+
+// Apply executes the steps in one transaction, holding a transaction-level
+// advisory lock. progress, if not nil, is called before each step. On error
+// nothing is left behind. With dryRun every step is executed and the
+// transaction is rolled back anyway, proving that applying would succeed.
+func Apply(ctx context.Context, conn *pgx.Conn, steps []parser.Step, dryRun bool, progress func(parser.Step)) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock(hashtext($1))", applyLock); err != nil {
+		return fmt.Errorf("acquiring advisory lock: %w", err)
+	}
+
+	for _, step := range steps {
+		if progress != nil {
+			progress(step)
+		}
+		if _, err := tx.Exec(ctx, step.SQL); err != nil {
+			return fmt.Errorf("applying %s: %w", step.Name, err)
+		}
+	}
+
+	if dryRun {
+		return tx.Rollback(ctx)
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// Backfill runs the backfills one table at a time. The backfill procedures
+// commit after every batch, so they are called outside a transaction block;
+// an interrupted backfill resumes after the last committed batch when run
+// again. progress, if not nil, is called after each table with the number of
+// versions it recorded.
+func Backfill(ctx context.Context, conn *pgx.Conn, backfills []parser.Backfill, progress func(parser.Backfill, int64)) error {
+	for _, backfill := range backfills {
+		if _, err := conn.Exec(ctx, backfill.Procedure); err != nil {
+			return fmt.Errorf("creating backfill of %s: %w", backfill.Table, err)
+		}
+
+		var recorded int64
+		if err := conn.QueryRow(ctx, backfill.Call, pgx.QueryExecModeSimpleProtocol).Scan(&recorded); err != nil {
+			return fmt.Errorf("backfilling %s: %w", backfill.Table, err)
+		}
+
+		if _, err := conn.Exec(ctx, backfill.Drop); err != nil {
+			return fmt.Errorf("dropping backfill of %s: %w", backfill.Table, err)
+		}
+
+		if progress != nil {
+			progress(backfill, recorded)
+		}
+	}
+	return nil
+}
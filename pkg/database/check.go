@@ -0,0 +1,231 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// Drift is one difference between the history objects installed for a table
+// and those the generator produces for it. Kind is "no history", "missing
+// column", "type mismatch", "missing trigger", "disabled trigger", "missing
+// function" or "function differs".
+type Drift struct {
+	Table  string
+	Kind   string
+	Object string
+	Detail string
+}
+
+func (d Drift) String() string {
+	if d.Detail == "" {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Object)
+	}
+	return fmt.Sprintf("%s: %s (%s)", d.Kind, d.Object, d.Detail)
+}
+
+// CheckDrift compares the installed history tables, triggers and trigger
+// functions of the given tables with what GenerateHistorySQL produces for them
+// with config. Extra columns in a history table are not drift, since migrations
+// keep dropped columns for the versions recorded before. Nothing is changed in
+// the database.
+func CheckDrift(ctx context.Context, conn *pgx.Conn, tables []parser.Table, config parser.Config) ([]Drift, error) {
+	// Expected column types are resolved by creating temporary tables, which
+	// the rollback discards.
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var drifts []Drift
+	for _, table := range tables {
+		tableDrifts, err := checkTable(ctx, tx, table, config)
+		if err != nil {
+			return nil, fmt.Errorf("checking %s: %w", parser.GetOriginalTableName(table), err)
+		}
+		drifts = append(drifts, tableDrifts...)
+	}
+
+	return drifts, nil
+}
+
+func checkTable(ctx context.Context, tx pgx.Tx, table parser.Table, config parser.Config) ([]Drift, error) {
+	name := parser.GetOriginalTableName(table)
+	historyTable := parser.GetHistoryTableName(table, config)
+
+	var exists bool
+	if err := tx.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL", historyTable).Scan(&exists); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []Drift{{Table: name, Kind: "no history", Object: historyTable}}, nil
+	}
+
+	drifts, err := checkColumns(ctx, tx, table, config, historyTable)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := parser.GeneratedNames(table, config)
+	if err != nil {
+		return nil, err
+	}
+	bodies := parser.TriggerFunctionBodies(table, config)
+	sourceTable := quoteQualified(table.SchemaName, table.Name)
+
+	for _, generated := range names {
+		switch generated.Kind {
+		case "trigger":
+			relation := historyTable
+			if generated.Operation == "insert" || generated.Operation == "update" || generated.Operation == "delete" {
+				relation = sourceTable
+			}
+			drift, err := checkTrigger(ctx, tx, relation, generated.Name)
+			if err != nil {
+				return nil, err
+			}
+			if drift != nil {
+				drift.Table = name
+				drifts = append(drifts, *drift)
+			}
+		case "function":
+			body, ok := bodies[generated.Operation]
+			if !ok {
+				continue
+			}
+			function := quoteQualified(generated.Namespace, generated.Name)
+			drift, err := checkFunction(ctx, tx, function, body)
+			if err != nil {
+				return nil, err
+			}
+			if drift != nil {
+				drift.Table = name
+				drifts = append(drifts, *drift)
+			}
+		}
+	}
+
+	return drifts, nil
+}
+
+const historyColumnsQuery = `
+SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+FROM pg_attribute a
+WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum`
+
+// checkColumns compares the columns of the installed history table with the
+// expected ones. The expected types are written as in the input, e.g. INT or
+// VARCHAR(50), so the server resolves them through a temporary table to the
+// names format_type reports.
+func checkColumns(ctx context.Context, tx pgx.Tx, table parser.Table, config parser.Config, historyTable string) ([]Drift, error) {
+	expected := parser.HistoryColumns(table, config)
+
+	definitions := make([]string, len(expected))
+	for i, col := range expected {
+		definitions[i] = parser.QuoteIdentifier(col.Name) + " " + col.DataType
+	}
+	if _, err := tx.Exec(ctx, "DROP TABLE IF EXISTS pg_temp.sql_history_check"); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE sql_history_check (%s)", strings.Join(definitions, ", "))); err != nil {
+		return nil, fmt.Errorf("resolving column types: %w", err)
+	}
+
+	expectedTypes, err := columnTypes(ctx, tx, "pg_temp.sql_history_check")
+	if err != nil {
+		return nil, err
+	}
+	installedTypes, err := columnTypes(ctx, tx, historyTable)
+	if err != nil {
+		return nil, err
+	}
+
+	var drifts []Drift
+	for _, col := range expected {
+		object := historyTable + "." + parser.QuoteIdentifier(col.Name)
+		installed, ok := installedTypes[col.Name]
+		switch {
+		case !ok:
+			drifts = append(drifts, Drift{Table: parser.GetOriginalTableName(table), Kind: "missing column", Object: object, Detail: expectedTypes[col.Name]})
+		case installed != expectedTypes[col.Name]:
+			detail := fmt.Sprintf("expected %s, found %s", expectedTypes[col.Name], installed)
+			drifts = append(drifts, Drift{Table: parser.GetOriginalTableName(table), Kind: "type mismatch", Object: object, Detail: detail})
+		}
+	}
+
+	return drifts, nil
+}
+
+func columnTypes(ctx context.Context, tx pgx.Tx, relation string) (map[string]string, error) {
+	rows, err := tx.Query(ctx, historyColumnsQuery, relation)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := map[string]string{}
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return nil, err
+		}
+		types[name] = dataType
+	}
+	return types, rows.Err()
+}
+
+func checkTrigger(ctx context.Context, tx pgx.Tx, relation, trigger string) (*Drift, error) {
+	var enabled string
+	err := tx.QueryRow(ctx, `
+		SELECT tgenabled::text FROM pg_trigger
+		WHERE tgrelid = to_regclass($1) AND tgname = $2 AND NOT tgisinternal`, relation, trigger).Scan(&enabled)
+	object := parser.QuoteIdentifier(trigger) + " on " + relation
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &Drift{Kind: "missing trigger", Object: object}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if enabled == "D" {
+		return &Drift{Kind: "disabled trigger", Object: object}, nil
+	}
+	return nil, nil
+}
+
+// checkFunction compares the source of an installed function with the
+// expected body, reporting the first line that differs.
+func checkFunction(ctx context.Context, tx pgx.Tx, function, body string) (*Drift, error) {
+	var source string
+	err := tx.QueryRow(ctx, "SELECT prosrc FROM pg_proc WHERE oid = to_regprocedure($1)", function+"()").Scan(&source)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return &Drift{Kind: "missing function", Object: function + "()"}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if source == body {
+		return nil, nil
+	}
+
+	expectedLines := strings.Split(body, "\n")
+	installedLines := strings.Split(source, "\n")
+	line := 0
+	for line < len(expectedLines) && line < len(installedLines) && expectedLines[line] == installedLines[line] {
+		line++
+	}
+	return &Drift{Kind: "function differs", Object: function + "()", Detail: fmt.Sprintf("from line %d", line+1)}, nil
+}
+
+// quoteQualified quotes a name and qualifies it with an optional schema.
+func quoteQualified(schema, name string) string {
+	if schema != "" {
+		return parser.QuoteIdentifier(schema) + "." + parser.QuoteIdentifier(name)
+	}
+	return parser.QuoteIdentifier(name)
+}
@@ -0,0 +1,20 @@
+// Package database runs sql-history operations against a live PostgreSQL
+// database.
+package database
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Connect opens a connection to the database described by dsn, which may be a
+// URL or a keyword/value connection string.
+func Connect(ctx context.Context, dsn string) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to database: %w", err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,283 @@
+package database
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// Filter selects the tables read from a database. Patterns use path.Match
+// syntax. Schema patterns match the schema name; table patterns match either
+// the table name or schema.table. Empty include lists select everything, and
+// excludes win over includes.
+type Filter struct {
+	Schemas        []string
+	ExcludeSchemas []string
+	Tables         []string
+	ExcludeTables  []string
+}
+
+// Match reports whether the filter selects the given table.
+func (f Filter) Match(schema, table string) bool {
+	qualified := schema + "." + table
+
+	if len(f.Schemas) > 0 && !matchAny(f.Schemas, schema) {
+		return false
+	}
+	if matchAny(f.ExcludeSchemas, schema) {
+		return false
+	}
+	if len(f.Tables) > 0 && !matchAny(f.Tables, table) && !matchAny(f.Tables, qualified) {
+		return false
+	}
+	return !matchAny(f.ExcludeTables, table) && !matchAny(f.ExcludeTables, qualified)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidatePatterns reports the first malformed pattern in the filter.
+func (f Filter) ValidatePatterns() error {
+	for _, patterns := range [][]string{f.Schemas, f.ExcludeSchemas, f.Tables, f.ExcludeTables} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// foreignKeyActions maps pg_constraint action codes to the clauses the parser
+// records. NO ACTION is the default and recorded as empty, like an omitted
+// clause.
+var foreignKeyActions = map[string]string{
+	"a": "",
+	"r": "RESTRICT",
+	"c": "CASCADE",
+	"n": "SET NULL",
+	"d": "SET DEFAULT",
+}
+
+const tablesQuery = `
+SELECT c.oid, n.nspname, c.relname, pg_table_is_visible(c.oid),
+       COALESCE(obj_description(c.oid, 'pg_class'), '')
+FROM pg_class c
+JOIN pg_namespace n ON n.oid = c.relnamespace
+WHERE c.relkind IN ('r', 'p')
+  AND NOT c.relispartition
+  AND n.nspname NOT IN ('pg_catalog', 'information_schema')
+  AND n.nspname NOT LIKE 'pg\_toast%'
+  AND n.nspname NOT LIKE 'pg\_temp\_%'
+ORDER BY n.nspname, c.relname`
+
+const columnsQuery = `
+SELECT a.attname, format_type(a.atttypid, a.atttypmod), a.attnotnull,
+       COALESCE(col_description(a.attrelid, a.attnum), '')
+FROM pg_attribute a
+WHERE a.attrelid = $1 AND a.attnum > 0 AND NOT a.attisdropped
+ORDER BY a.attnum`
+
+// constraintsQuery lists primary and foreign keys with their columns in key
+// order. Referenced tables are reported like the tables themselves: without
+// schema when visible on the search_path.
+const constraintsQuery = `
+SELECT con.contype::text,
+       ARRAY(SELECT a.attname
+             FROM unnest(con.conkey) WITH ORDINALITY AS k(attnum, ord)
+             JOIN pg_attribute a ON a.attrelid = con.conrelid AND a.attnum = k.attnum
+             ORDER BY k.ord)::text[],
+       COALESCE(rn.nspname, ''),
+       COALESCE(rc.relname, ''),
+       COALESCE(pg_table_is_visible(rc.oid), false),
+       ARRAY(SELECT a.attname
+             FROM unnest(con.confkey) WITH ORDINALITY AS k(attnum, ord)
+             JOIN pg_attribute a ON a.attrelid = con.confrelid AND a.attnum = k.attnum
+             ORDER BY k.ord)::text[],
+       con.confdeltype::text,
+       con.confupdtype::text
+FROM pg_constraint con
+LEFT JOIN pg_class rc ON rc.oid = con.confrelid
+LEFT JOIN pg_namespace rn ON rn.oid = rc.relnamespace
+WHERE con.conrelid = $1 AND con.contype IN ('p', 'f')
+ORDER BY con.contype DESC, con.conname`
+
+// ReadTables reads the tables selected by filter from the system catalogs
+// into the structures ParseCreateTables produces. Tables visible on the
+// search_path get no schema name, like unqualified names in a schema file;
+// tables in other schemas are qualified. @history annotations in table and
+// column comments are applied. Partitions, system schemas and
+// temporary tables are skipped.
+func ReadTables(ctx context.Context, conn *pgx.Conn, filter Filter) ([]parser.Table, error) {
+	if err := filter.ValidatePatterns(); err != nil {
+		return nil, err
+	}
+
+	type tableRef struct {
+		oid     uint32
+		schema  string
+		name    string
+		visible bool
+		comment string
+	}
+
+	rows, err := conn.Query(ctx, tablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("listing tables: %w", err)
+	}
+	var refs []tableRef
+	for rows.Next() {
+		var ref tableRef
+		if err := rows.Scan(&ref.oid, &ref.schema, &ref.name, &ref.visible, &ref.comment); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("listing tables: %w", err)
+		}
+		if filter.Match(ref.schema, ref.name) {
+			refs = append(refs, ref)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("listing tables: %w", err)
+	}
+
+	var tables []parser.Table
+	for _, ref := range refs {
+		table := parser.Table{
+			Name:   ref.name,
+			Quoted: parser.QuoteIdentifier(ref.name) != ref.name,
+		}
+		if !ref.visible {
+			table.SchemaName = ref.schema
+			table.SchemaQuoted = parser.QuoteIdentifier(ref.schema) != ref.schema
+		}
+		table.FullName = parser.GetOriginalTableName(table)
+
+		if err := parser.AnnotateTable(&table, ref.comment); err != nil {
+			return nil, fmt.Errorf("comment on %s: %w", table.FullName, err)
+		}
+
+		if err := readColumns(ctx, conn, ref.oid, &table); err != nil {
+			return nil, fmt.Errorf("reading columns of %s: %w", table.FullName, err)
+		}
+		if err := readConstraints(ctx, conn, ref.oid, &table); err != nil {
+			return nil, fmt.Errorf("reading constraints of %s: %w", table.FullName, err)
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, nil
+}
+
+func readColumns(ctx context.Context, conn *pgx.Conn, oid uint32, table *parser.Table) error {
+	rows, err := conn.Query(ctx, columnsQuery, oid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var col parser.Column
+		var notNull bool
+		var comment string
+		if err := rows.Scan(&col.Name, &col.DataType, &notNull, &comment); err != nil {
+			return err
+		}
+		if err := parser.AnnotateColumn(table, col.Name, comment); err != nil {
+			return fmt.Errorf("comment on column: %w", err)
+		}
+		if notNull {
+			col.Options = "NOT NULL"
+		}
+		col.Quoted = parser.QuoteIdentifier(col.Name) != col.Name
+		table.Columns = append(table.Columns, col)
+	}
+	return rows.Err()
+}
+
+func readConstraints(ctx context.Context, conn *pgx.Conn, oid uint32, table *parser.Table) error {
+	rows, err := conn.Query(ctx, constraintsQuery, oid)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var kind, refSchema, refName, onDelete, onUpdate string
+		var columns, refColumns []string
+		var refVisible bool
+		if err := rows.Scan(&kind, &columns, &refSchema, &refName, &refVisible, &refColumns, &onDelete, &onUpdate); err != nil {
+			return err
+		}
+
+		if kind == "p" {
+			table.PrimaryKey = columns
+			continue
+		}
+
+		referenced := parser.Table{Name: refName}
+		if !refVisible {
+			referenced.SchemaName = refSchema
+		}
+		fk := parser.ForeignKey{
+			ColumnName:       strings.Join(columns, ", "),
+			ReferencedTable:  parser.GetOriginalTableName(referenced),
+			ReferencedColumn: strings.Join(refColumns, ", "),
+			OnDelete:         foreignKeyActions[onDelete],
+			OnUpdate:         foreignKeyActions[onUpdate],
+		}
+		names := append([]string{refName}, columns...)
+		names = append(names, refColumns...)
+		if !refVisible {
+			names = append(names, refSchema)
+		}
+		for _, name := range names {
+			fk.Quoted = fk.Quoted || parser.QuoteIdentifier(name) != name
+		}
+		table.ForeignKeys = append(table.ForeignKeys, fk)
+	}
+	return rows.Err()
+}
+
+// ExcludeHistoryTables removes the history tables generated for the other
+// tables with the given configuration, so that reading a database that
+// already has history installed does not add history to history tables.
+func ExcludeHistoryTables(tables []parser.Table, config parser.Config) []parser.Table {
+	historyTables := map[string]bool{}
+	for _, table := range tables {
+		names, err := parser.GeneratedNames(table, config)
+		if err != nil {
+			continue
+		}
+		for _, name := range names {
+			if name.Kind == "history table" {
+				historyTables[qualify(name.Namespace, name.Name)] = true
+			}
+		}
+	}
+
+	var kept []parser.Table
+	for _, table := range tables {
+		if !historyTables[parser.GetOriginalTableName(table)] {
+			kept = append(kept, table)
+		}
+	}
+	return kept
+}
+
+func qualify(schema, name string) string {
+	if schema != "" {
+		return schema + "." + name
+	}
+	return name
+}
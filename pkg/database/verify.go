@@ -0,0 +1,49 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/leinonen/sql-history/pkg/parser"
+)
+
+// ChainResult is the outcome of verifying the hash chain of one history table.
+type ChainResult struct {
+	HistoryTable string
+	Intact       bool
+	// Key and Version identify the first broken link when Intact is false.
+	Key     string
+	Version int
+}
+
+// VerifyChain walks the hash chain of the history table generated for table
+// and reports its first broken link. config must match the configuration the
+// history table was generated with.
+func VerifyChain(ctx context.Context, conn *pgx.Conn, table parser.Table, config parser.Config) (ChainResult, error) {
+	result := ChainResult{HistoryTable: parser.GetHistoryTableName(table, config)}
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return result, err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, setting := range parser.HashSettings {
+		if _, err := tx.Exec(ctx, "SELECT set_config($1, $2, true)", setting.Name, setting.Value); err != nil {
+			return result, fmt.Errorf("setting %s: %w", setting.Name, err)
+		}
+	}
+
+	err = tx.QueryRow(ctx, parser.GenerateChainVerificationQuery(table, config)).Scan(&result.Key, &result.Version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		result.Intact = true
+		return result, nil
+	}
+	if err != nil {
+		return result, fmt.Errorf("verifying %s: %w", result.HistoryTable, err)
+	}
+
+	return result, nil
+}
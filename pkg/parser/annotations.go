@@ -0,0 +1,349 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// annotationPrefix starts comments that hold history settings, such as
+// "-- @history: skip" or COMMENT ON TABLE users IS '@history skip'.
+const annotationPrefix = "@history"
+
+// annotationSetting is one key or key=value pair of an annotation.
+type annotationSetting struct {
+	key   string
+	value string
+}
+
+// parseAnnotation splits an annotation into its settings. Settings are
+// separated by whitespace, and values containing spaces can be quoted with
+// single or double quotes. ok is false when text is not an annotation.
+func parseAnnotation(text string) (settings []annotationSetting, ok bool, err error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, annotationPrefix) {
+		return nil, false, nil
+	}
+	rest := strings.TrimPrefix(text, annotationPrefix)
+	if rest != "" && rest[0] != ':' && rest[0] != ' ' && rest[0] != '\t' {
+		return nil, false, nil
+	}
+	rest = strings.TrimPrefix(rest, ":")
+
+	for {
+		rest = strings.TrimLeft(rest, " \t")
+		if rest == "" {
+			break
+		}
+
+		end := strings.IndexAny(rest, " \t=")
+		if end == -1 {
+			end = len(rest)
+		}
+		setting := annotationSetting{key: rest[:end]}
+		rest = rest[end:]
+
+		if strings.HasPrefix(rest, "=") {
+			rest = rest[1:]
+			if rest != "" && (rest[0] == '\'' || rest[0] == '"') {
+				closing := strings.IndexByte(rest[1:], rest[0])
+				if closing == -1 {
+					return nil, true, fmt.Errorf("unterminated quote in %s", setting.key)
+				}
+				setting.value = rest[1 : closing+1]
+				rest = rest[closing+2:]
+			} else {
+				end := strings.IndexAny(rest, " \t")
+				if end == -1 {
+					end = len(rest)
+				}
+				setting.value = rest[:end]
+				rest = rest[end:]
+			}
+			if setting.value == "" {
+				return nil, true, fmt.Errorf("%s needs a value", setting.key)
+			}
+		}
+
+		settings = append(settings, setting)
+	}
+
+	if len(settings) == 0 {
+		return nil, true, fmt.Errorf("%s without settings", annotationPrefix)
+	}
+	return settings, true, nil
+}
+
+// tableSettings apply the settings of table annotations that take a value.
+var tableSettings = map[string]func(config *TableConfig, value string) error{
+	"ignore-columns": func(config *TableConfig, value string) error {
+		for _, column := range strings.Split(value, ",") {
+			if column = strings.TrimSpace(column); column != "" {
+				config.IgnoreColumns = append(config.IgnoreColumns, column)
+			}
+		}
+		return nil
+	},
+	"history-schema": func(config *TableConfig, value string) error {
+		config.HistorySchema = value
+		return nil
+	},
+	"retention": func(config *TableConfig, value string) error {
+		config.Retention = value
+		return nil
+	},
+	"partition": func(config *TableConfig, value string) error {
+		if value != "month" && value != "year" && value != "none" {
+			return fmt.Errorf("partition must be 'month', 'year' or 'none', got %q", value)
+		}
+		config.Partitioning = value
+		return nil
+	},
+	"backfill-from": func(config *TableConfig, value string) error {
+		config.BackfillFrom = value
+		return nil
+	},
+}
+
+// AnnotateTable applies a table annotation to table.Annotations. Comments
+// that are not annotations are ignored. The settings are skip,
+// ignore-columns=a,b, history-schema=name, retention=interval or forever,
+// partition=month, year or none, and backfill-from=column.
+func AnnotateTable(table *Table, comment string) error {
+	settings, ok, err := parseAnnotation(comment)
+	if err != nil || !ok {
+		return err
+	}
+
+	for _, setting := range settings {
+		switch setting.key {
+		case "skip":
+			if setting.value != "" {
+				return fmt.Errorf("skip takes no value")
+			}
+			table.Annotations.Exclude = true
+			continue
+		case "ignore":
+			return fmt.Errorf("ignore applies to columns; use ignore-columns= for a table")
+		}
+
+		apply, ok := tableSettings[setting.key]
+		if !ok {
+			return fmt.Errorf("unknown %s setting %q", annotationPrefix, setting.key)
+		}
+		if setting.value == "" {
+			return fmt.Errorf("%s needs a value", setting.key)
+		}
+		if err := apply(&table.Annotations, setting.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AnnotateColumn applies a column annotation. The only setting is ignore,
+// which adds the column to table.Annotations.IgnoreColumns. Comments that
+// are not annotations are ignored.
+func AnnotateColumn(table *Table, column, comment string) error {
+	settings, ok, err := parseAnnotation(comment)
+	if err != nil || !ok {
+		return err
+	}
+
+	for _, setting := range settings {
+		if setting.key != "ignore" || setting.value != "" {
+			return fmt.Errorf("unknown %s setting %q for column %s, only ignore applies to columns", annotationPrefix, setting.key, column)
+		}
+		table.Annotations.IgnoreColumns = append(table.Annotations.IgnoreColumns, QuoteIdentifier(column))
+	}
+	return nil
+}
+
+// sqlComment is a comment found by stripComments, at its byte offset in the
+// input.
+type sqlComment struct {
+	offset int
+	text   string
+}
+
+// stripComments blanks out -- and /* */ comments outside of string literals,
+// quoted identifiers and dollar-quoted bodies, keeping newlines so offsets and
+// line numbers stay the same. It returns the comments and the offsets of the
+// semicolons ending statements.
+func stripComments(sql string) (string, []sqlComment, []int) {
+	out := []byte(sql)
+	var comments []sqlComment
+	var statementEnds []int
+
+	blank := func(start, end int) {
+		for i := start; i < end; i++ {
+			if out[i] != '\n' {
+				out[i] = ' '
+			}
+		}
+	}
+
+	for i := 0; i < len(sql); i++ {
+		switch {
+		case strings.HasPrefix(sql[i:], "--"):
+			end := strings.IndexByte(sql[i:], '\n')
+			if end == -1 {
+				end = len(sql) - i
+			}
+			comments = append(comments, sqlComment{offset: i, text: sql[i+2 : i+end]})
+			blank(i, i+end)
+			i += end - 1
+		case strings.HasPrefix(sql[i:], "/*"):
+			// Block comments nest in PostgreSQL.
+			depth, j := 1, i+2
+			for j < len(sql) && depth > 0 {
+				if strings.HasPrefix(sql[j:], "/*") {
+					depth++
+					j += 2
+				} else if strings.HasPrefix(sql[j:], "*/") {
+					depth--
+					j += 2
+				} else {
+					j++
+				}
+			}
+			text := strings.TrimSuffix(sql[i+2:j], "*/")
+			comments = append(comments, sqlComment{offset: i, text: strings.TrimSpace(text)})
+			blank(i, j)
+			i = j - 1
+		case sql[i] == '\'' || sql[i] == '"':
+			// A doubled quote inside reads as closing and reopening.
+			end := strings.IndexByte(sql[i+1:], sql[i])
+			if end == -1 {
+				return string(out), comments, statementEnds
+			}
+			i += end + 1
+		case sql[i] == '$' && (i == 0 || !isIdentifierByte(sql[i-1])):
+			if tag := dollarTag.FindString(sql[i:]); tag != "" {
+				end := strings.Index(sql[i+len(tag):], tag)
+				if end == -1 {
+					return string(out), comments, statementEnds
+				}
+				i += len(tag) + end + len(tag) - 1
+			}
+		case sql[i] == ';':
+			statementEnds = append(statementEnds, i)
+		}
+	}
+
+	return string(out), comments, statementEnds
+}
+
+// dollarTag matches the opening of a dollar-quoted string, $$ or $tag$.
+var dollarTag = regexp.MustCompile(`^\$(?:[A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// isIdentifierByte reports whether b can be part of an unquoted identifier,
+// where $ does not start a dollar quote.
+func isIdentifierByte(b byte) bool {
+	return b == '_' || b == '$' || b >= '0' && b <= '9' || b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= 0x80
+}
+
+// annotateTable applies the annotations of a CREATE TABLE statement spanning
+// start to end: comments since the line after the previous statement ending at
+// previousEnd, or since the start of the input when there is none, inside
+// the column list, and after the closing semicolon on the same line. Comments
+// trailing a column definition apply to that column.
+func annotateTable(table *Table, content string, comments []sqlComment, previousEnd, start, end int) error {
+	from := previousEnd
+	if newline := strings.IndexByte(content[previousEnd:start], '\n'); newline != -1 && previousEnd > 0 {
+		from = previousEnd + newline
+	}
+	to := len(content)
+	if newline := strings.IndexByte(content[end:], '\n'); newline != -1 {
+		to = end + newline
+	}
+
+	for _, comment := range comments {
+		if comment.offset < from || comment.offset >= to {
+			continue
+		}
+
+		var err error
+		column := ""
+		if comment.offset >= start && comment.offset < end {
+			column = annotatedColumn(content, comment.offset)
+		}
+		if column != "" {
+			err = AnnotateColumn(table, column, comment.text)
+		} else {
+			err = AnnotateTable(table, comment.text)
+		}
+		if err != nil {
+			return fmt.Errorf("line %d: %w", lineNumber(content, comment.offset), err)
+		}
+	}
+	return nil
+}
+
+// createPrefix matches a line starting a CREATE statement.
+var createPrefix = regexp.MustCompile(`(?i)^CREATE\s`)
+
+// annotatedColumn returns the name of the column defined on the line of a
+// comment inside a column list, or "" when the line defines none.
+func annotatedColumn(content string, offset int) string {
+	lineStart := strings.LastIndexByte(content[:offset], '\n') + 1
+	line := strings.Trim(strings.TrimSpace(content[lineStart:offset]), ",")
+	if line == "" || createPrefix.MatchString(line) {
+		return ""
+	}
+
+	rawName, _ := splitIdentifier(line)
+	name, quoted := parseIdentifier(rawName)
+	if !quoted {
+		switch strings.ToUpper(name) {
+		case "PRIMARY", "CONSTRAINT", "FOREIGN", "UNIQUE", "CHECK", "INDEX", "KEY", "EXCLUDE":
+			return ""
+		}
+	}
+	return name
+}
+
+// commentOnRegex matches COMMENT ON TABLE and COMMENT ON COLUMN statements.
+var commentOnRegex = regexp.MustCompile(`(?is)COMMENT\s+ON\s+(TABLE|COLUMN)\s+((?:"(?:[^"]|"")*"|[^\s(".]+)(?:\.(?:"(?:[^"]|"")*"|[^\s(".]+)){0,2})\s+IS\s+'((?:[^']|'')*)'`)
+
+// annotateFromCommentOn applies annotations given with COMMENT ON TABLE and
+// COMMENT ON COLUMN to the parsed tables.
+func annotateFromCommentOn(tables []Table, content string) error {
+	for _, match := range commentOnRegex.FindAllStringSubmatchIndex(content, -1) {
+		kind := strings.ToUpper(content[match[2]:match[3]])
+		name := content[match[4]:match[5]]
+		comment := strings.ReplaceAll(content[match[6]:match[7]], "''", "'")
+
+		tableName, column := name, ""
+		if kind == "COLUMN" {
+			parts := splitQualifiedName(name)
+			if len(parts) < 2 {
+				continue
+			}
+			tableName = strings.Join(parts[:len(parts)-1], ".")
+			column, _ = parseIdentifier(parts[len(parts)-1])
+		}
+		qualified, _ := parseQualifiedName(tableName)
+
+		for i := range tables {
+			if GetOriginalTableName(tables[i]) != qualified {
+				continue
+			}
+			var err error
+			if column != "" {
+				err = AnnotateColumn(&tables[i], column, comment)
+			} else {
+				err = AnnotateTable(&tables[i], comment)
+			}
+			if err != nil {
+				return fmt.Errorf("line %d: %w", lineNumber(content, match[0]), err)
+			}
+		}
+	}
+	return nil
+}
+
+// lineNumber returns the 1-based line of a byte offset.
+func lineNumber(content string, offset int) int {
+	return strings.Count(content[:offset], "\n") + 1
+}
@@ -0,0 +1,224 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultBackfillBatchSize is the number of rows a backfill records per
+// transaction unless told otherwise.
+const DefaultBackfillBatchSize = 1000
+
+// Backfill holds the statements recording the existing rows of one table as
+// their first history version. Procedure also creates the progress table if
+// it is missing, and Drop removes both. Call commits after every batch, so it
+// must run on its own, outside a transaction block.
+type Backfill struct {
+	Table     string
+	Procedure string
+	Call      string
+	Drop      string
+}
+
+// GenerateBackfills creates a backfill for each table, which must have a
+// primary key. The procedure walks the table in primary key order, batchSize
+// rows per transaction. It locks the rows of a batch FOR SHARE, so that
+// concurrent changes to them wait for the batch, and then inserts an 'I'
+// version for every row whose key has no history yet, so it never touches
+// keys the triggers already recorded. Each batch stores its last key in a
+// progress table next to the history table; when run again after an
+// interruption, the procedure starts after that key instead of rescanning
+// the table. The progress table is dropped once the backfill completes.
+func GenerateBackfills(tables []Table, config Config, batchSize int) ([]Backfill, error) {
+	config.backfill = true
+	if err := ValidateNames(tables, config); err != nil {
+		return nil, err
+	}
+	if batchSize <= 0 {
+		return nil, fmt.Errorf("backfill batch size must be positive, got %d", batchSize)
+	}
+
+	var backfills []Backfill
+	for _, table := range tables {
+		backfill, err := GenerateBackfill(table, config, batchSize)
+		if err != nil {
+			return nil, err
+		}
+		backfills = append(backfills, backfill)
+	}
+	return backfills, nil
+}
+
+// GenerateBackfill creates the backfill of one table.
+func GenerateBackfill(table Table, config Config, batchSize int) (Backfill, error) {
+	config = config.ForTable(table)
+
+	// The fallback key of a table without one need not be unique, so
+	// batches could skip rows sharing it.
+	if !hasDeclaredPrimaryKey(table) {
+		return Backfill{}, fmt.Errorf("table %s has no primary key; backfilling walks the table by its key", GetOriginalTableName(table))
+	}
+
+	validFrom, err := backfillValidFrom(table, config)
+	if err != nil {
+		return Backfill{}, err
+	}
+
+	procedure := getFunctionName(table, config, "backfill")
+	tableName := quoteQualified(table.SchemaName, table.Name)
+	historyTableName := GetHistoryTableName(table, config)
+	progressTableName := getBackfillProgressName(table, config)
+	primaryKeys := quoteColumns(GetPrimaryKeyColumns(table))
+
+	columns := make([]string, 0, len(table.Columns)+4)
+	values := make([]string, 0, len(table.Columns)+4)
+	for _, col := range table.Columns {
+		columns = append(columns, QuoteIdentifier(col.Name))
+		values = append(values, "b."+QuoteIdentifier(col.Name))
+	}
+	columns = append(columns, "valid_from", "operation")
+	values = append(values, validFrom, "'I'")
+	if config.Versioning {
+		columns = append(columns, "version")
+		values = append(values, "1")
+	}
+	if config.TrackUser {
+		columns = append(columns, "changed_by")
+		values = append(values, getUserExpression(config))
+	}
+	for _, col := range contextColumns(config) {
+		columns = append(columns, QuoteIdentifier(col.Name))
+		values = append(values, col.Expression)
+	}
+
+	lastKeys := make([]string, len(primaryKeys))
+	endKeys := make([]string, len(primaryKeys))
+	scanKeys := make([]string, len(primaryKeys))
+	rowKeys := make([]string, len(primaryKeys))
+	keyMatches := make([]string, len(primaryKeys))
+	descending := make([]string, len(primaryKeys))
+	progressKeys := make([]string, len(primaryKeys))
+	for i, pk := range primaryKeys {
+		lastKeys[i] = fmt.Sprintf("last_key_%d", i+1)
+		endKeys[i] = fmt.Sprintf("end_key_%d", i+1)
+		scanKeys[i] = "s." + pk
+		rowKeys[i] = "b." + pk
+		keyMatches[i] = fmt.Sprintf("h.%s = b.%s", pk, pk)
+		descending[i] = "l." + pk + " DESC"
+		progressKeys[i] = "p." + pk
+	}
+	after := func(keys []string) string {
+		return fmt.Sprintf("(first_batch OR (%s) > (%s))", strings.Join(keys, ", "), strings.Join(lastKeys, ", "))
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("-- Backfill history for: %s\n", GetOriginalTableName(table)))
+	// Holds the last key recorded, so that an interrupted backfill resumes.
+	sb.WriteString(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s AS SELECT %s FROM %s WITH NO DATA;\n", progressTableName, strings.Join(primaryKeys, ", "), tableName))
+	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE PROCEDURE %s(batch_size INTEGER DEFAULT %d, INOUT recorded BIGINT DEFAULT NULL)\n", procedure, batchSize))
+	sb.WriteString("LANGUAGE plpgsql AS $$\n")
+	// Columns are always qualified, so bare names are the variables below.
+	sb.WriteString("#variable_conflict use_variable\n")
+	sb.WriteString("DECLARE\n")
+	sb.WriteString("    started TIMESTAMP := CURRENT_TIMESTAMP;\n")
+	sb.WriteString("    first_batch BOOLEAN;\n")
+	sb.WriteString("    scanned BIGINT;\n")
+	sb.WriteString("    inserted BIGINT;\n")
+	for i, pk := range primaryKeys {
+		sb.WriteString(fmt.Sprintf("    %s %s.%s%%TYPE;\n", lastKeys[i], tableName, pk))
+		sb.WriteString(fmt.Sprintf("    %s %s.%s%%TYPE;\n", endKeys[i], tableName, pk))
+	}
+	sb.WriteString("BEGIN\n")
+	sb.WriteString("    recorded := 0;\n")
+	sb.WriteString(fmt.Sprintf("    SELECT %s INTO %s FROM %s p;\n", strings.Join(progressKeys, ", "), strings.Join(lastKeys, ", "), progressTableName))
+	sb.WriteString("    first_batch := NOT FOUND;\n")
+	sb.WriteString("    LOOP\n")
+	// FOR SHARE, unlike FOR KEY SHARE, also blocks updates of other columns,
+	// so no trigger records a key of the batch until it is committed.
+	sb.WriteString("        SELECT count(*)")
+	for _, pk := range primaryKeys {
+		sb.WriteString(fmt.Sprintf(",\n               (array_agg(l.%s ORDER BY %s))[1]", pk, strings.Join(descending, ", ")))
+	}
+	sb.WriteString("\n")
+	sb.WriteString(fmt.Sprintf("        INTO scanned, %s\n", strings.Join(endKeys, ", ")))
+	sb.WriteString("        FROM (\n")
+	sb.WriteString(fmt.Sprintf("            SELECT %s FROM %s s\n", strings.Join(scanKeys, ", "), tableName))
+	sb.WriteString(fmt.Sprintf("            WHERE %s\n", after(scanKeys)))
+	sb.WriteString(fmt.Sprintf("            ORDER BY %s\n", strings.Join(scanKeys, ", ")))
+	sb.WriteString("            LIMIT batch_size\n")
+	sb.WriteString("            FOR SHARE\n")
+	sb.WriteString("        ) l;\n")
+	sb.WriteString("        EXIT WHEN scanned = 0;\n")
+	// A new statement sees the history of changes committed before the
+	// rows were locked, so keys recorded by the triggers are skipped.
+	sb.WriteString(fmt.Sprintf("        INSERT INTO %s (%s)\n", historyTableName, strings.Join(columns, ", ")))
+	sb.WriteString(fmt.Sprintf("        SELECT %s\n", strings.Join(values, ", ")))
+	sb.WriteString(fmt.Sprintf("        FROM %s b\n", tableName))
+	sb.WriteString(fmt.Sprintf("        WHERE %s AND (%s) <= (%s)\n", after(rowKeys), strings.Join(rowKeys, ", "), strings.Join(endKeys, ", ")))
+	sb.WriteString(fmt.Sprintf("            AND NOT EXISTS (SELECT 1 FROM %s h WHERE %s);\n", historyTableName, strings.Join(keyMatches, " AND ")))
+	sb.WriteString("        GET DIAGNOSTICS inserted = ROW_COUNT;\n")
+	sb.WriteString("        recorded := recorded + inserted;\n")
+	for i := range lastKeys {
+		sb.WriteString(fmt.Sprintf("        %s := %s;\n", lastKeys[i], endKeys[i]))
+	}
+	sb.WriteString(fmt.Sprintf("        DELETE FROM %s;\n", progressTableName))
+	sb.WriteString(fmt.Sprintf("        INSERT INTO %s VALUES (%s);\n", progressTableName, strings.Join(lastKeys, ", ")))
+	sb.WriteString("        COMMIT;\n")
+	sb.WriteString("        EXIT WHEN scanned < batch_size;\n")
+	sb.WriteString("        first_batch := false;\n")
+	sb.WriteString("    END LOOP;\n")
+	sb.WriteString("END;\n")
+	sb.WriteString("$$;\n")
+
+	return Backfill{
+		Table:     GetOriginalTableName(table),
+		Procedure: sb.String(),
+		Call:      fmt.Sprintf("CALL %s(%d);\n", procedure, batchSize),
+		Drop:      fmt.Sprintf("DROP PROCEDURE %s(INTEGER, BIGINT);\nDROP TABLE %s;\n", procedure, progressTableName),
+	}, nil
+}
+
+// backfillValidFrom returns the valid_from of backfilled versions: the
+// configured column where the table has it, otherwise the time the backfill
+// started. A column set for the table alone must exist.
+func backfillValidFrom(table Table, config Config) (string, error) {
+	if config.BackfillFrom == "" {
+		return "started", nil
+	}
+
+	column, _ := parseIdentifier(config.BackfillFrom)
+	if hasColumn(table, column) {
+		return fmt.Sprintf("COALESCE(b.%s::timestamp, started)", QuoteIdentifier(column)), nil
+	}
+
+	if config.tableConfig(table).BackfillFrom != "" {
+		return "", fmt.Errorf("backfill column %s not found in %s", config.BackfillFrom, GetOriginalTableName(table))
+	}
+	return "started", nil
+}
+
+// GenerateBackfillSQL writes the backfills of all tables as a script. It is
+// meant to run outside a transaction block, after the history SQL has been
+// applied.
+func GenerateBackfillSQL(tables []Table, config Config, batchSize int) (string, error) {
+	backfills, err := GenerateBackfills(tables, config, batchSize)
+	if err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("-- Backfill History Tables\n")
+	sb.WriteString("-- This file records existing rows as their first history version. It commits\n")
+	sb.WriteString("-- after every batch, so run it outside a transaction block; it resumes when run again.\n\n")
+
+	for _, backfill := range backfills {
+		sb.WriteString(backfill.Procedure)
+		sb.WriteString(backfill.Call)
+		sb.WriteString(backfill.Drop)
+		sb.WriteString("\n")
+	}
+
+	return sb.String(), nil
+}
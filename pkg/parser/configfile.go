@@ -0,0 +1,297 @@
+package parser
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ConfigFileName is the project config file read from the working directory
+// when no other file is given.
+const ConfigFileName = "sql-history.json"
+
+// LoadConfigFile reads a JSON project config file on top of base. See
+// ParseConfig for the format.
+func LoadConfigFile(path string, base Config) (Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Config{}, fmt.Errorf("reading config file: %w", err)
+	}
+
+	config, err := ParseConfig(data, base)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return config, nil
+}
+
+// ParseConfig decodes a JSON project config on top of base: keys present in
+// the file replace the settings of base, and the sections under "tables" are
+// merged into base.Tables. Keys are the long flag names with underscores,
+// e.g. "track_user" or "history_schema", plus "naming", "context_columns"
+// and "tables":
+//
+//	{
+//	  "retention": "7 years",
+//	  "context_columns": [{"name": "request_id"}],
+//	  "tables": {
+//	    "audit.events": {"exclude": true},
+//	    "users": {"ignore_columns": ["last_seen_at"], "partition": "month"}
+//	  }
+//	}
+//
+// Errors name the offending key, such as tables.users.partition.
+func ParseConfig(data []byte, base Config) (Config, error) {
+	config := base
+	config.Tables = map[string]TableConfig{}
+	for name, table := range base.Tables {
+		config.Tables[name] = table
+	}
+
+	var partitionStart string
+	var tables map[string]json.RawMessage
+	fields := map[string]any{
+		"track_user":      &config.TrackUser,
+		"user_source":     &config.UserSource,
+		"history_id":      &config.HistoryID,
+		"versioning":      &config.Versioning,
+		"index_strategy":  &config.IndexStrategy,
+		"partition":       &config.Partitioning,
+		"partition_start": &partitionStart,
+		"partitions":      &config.PartitionCount,
+		"retention":       &config.Retention,
+		"append_only":     &config.AppendOnly,
+		"history_owner":   &config.HistoryOwner,
+		"hash_chain":      &config.HashChain,
+		"history_schema":  &config.HistorySchema,
+		"idempotent":      &config.Idempotent,
+		"backfill_from":   &config.BackfillFrom,
+		"naming": map[string]any{
+			"history_table": &config.Naming.HistoryTable,
+			"function":      &config.Naming.Function,
+			"trigger":       &config.Naming.Trigger,
+			"index":         &config.Naming.Index,
+		},
+		"context_columns": &config.ContextColumns,
+		"tables":          &tables,
+	}
+
+	if err := decodeObject("", data, fields); err != nil {
+		return Config{}, err
+	}
+
+	if err := checkChoice("user_source", config.UserSource, "current_user", "session"); err != nil {
+		return Config{}, err
+	}
+	if err := checkChoice("index_strategy", config.IndexStrategy, "btree", "brin"); err != nil {
+		return Config{}, err
+	}
+	if config.Partitioning != "" {
+		if err := checkChoice("partition", config.Partitioning, "month", "year"); err != nil {
+			return Config{}, err
+		}
+	}
+	if partitionStart != "" {
+		start, err := time.Parse("2006-01-02", partitionStart)
+		if err != nil {
+			return Config{}, fmt.Errorf("partition_start: must be a date in YYYY-MM-DD format")
+		}
+		config.PartitionStart = start
+	}
+	if config.PartitionCount < 0 {
+		return Config{}, fmt.Errorf("partitions: must not be negative")
+	}
+
+	templates := map[string]string{
+		"history_table": config.Naming.HistoryTable,
+		"function":      config.Naming.Function,
+		"trigger":       config.Naming.Trigger,
+		"index":         config.Naming.Index,
+	}
+	for _, key := range sortedKeys(templates) {
+		if _, err := template.New("name").Parse(templates[key]); err != nil {
+			return Config{}, fmt.Errorf("naming.%s: invalid template: %v", key, err)
+		}
+	}
+
+	if err := checkContextColumns("context_columns", config.ContextColumns); err != nil {
+		return Config{}, err
+	}
+
+	for _, name := range sortedKeys(tables) {
+		path := "tables." + name
+		if strings.TrimSpace(name) == "" {
+			return Config{}, fmt.Errorf("%s: table name must not be empty", path)
+		}
+		if err := parseTableConfig(path, tables[name], &config, name); err != nil {
+			return Config{}, err
+		}
+	}
+
+	return config, nil
+}
+
+// parseTableConfig decodes the section of one table into config.Tables.
+func parseTableConfig(path string, data json.RawMessage, config *Config, name string) error {
+	table := config.Tables[name]
+	fields := map[string]any{
+		"exclude":         &table.Exclude,
+		"ignore_columns":  &table.IgnoreColumns,
+		"history_schema":  &table.HistorySchema,
+		"retention":       &table.Retention,
+		"partition":       &table.Partitioning,
+		"context_columns": &table.ContextColumns,
+		"backfill_from":   &table.BackfillFrom,
+	}
+
+	if err := decodeObject(path, data, fields); err != nil {
+		return err
+	}
+
+	if table.Partitioning != "" {
+		if err := checkChoice(path+".partition", table.Partitioning, "month", "year", "none"); err != nil {
+			return err
+		}
+	}
+	for i, column := range table.IgnoreColumns {
+		if strings.TrimSpace(column) == "" {
+			return fmt.Errorf("%s.ignore_columns[%d]: column name must not be empty", path, i)
+		}
+	}
+	if err := checkContextColumns(path+".context_columns", table.ContextColumns); err != nil {
+		return err
+	}
+
+	config.Tables[name] = table
+	return nil
+}
+
+// decodeObject decodes a JSON object key by key into fields, which maps each
+// allowed key to a pointer or to the fields of a nested object. Errors are
+// prefixed with the path of the key.
+func decodeObject(path string, data json.RawMessage, fields map[string]any) error {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(data, &object); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := strings.Count(string(data[:syntaxErr.Offset]), "\n") + 1
+			return fmt.Errorf("line %d: %v", line, syntaxErr)
+		}
+		if path == "" {
+			return fmt.Errorf("expected a JSON object")
+		}
+		return fmt.Errorf("%s: expected an object", path)
+	}
+
+	for _, key := range sortedKeys(object) {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown key", keyPath)
+		}
+
+		switch field := field.(type) {
+		case map[string]any:
+			if err := decodeObject(keyPath, object[key], field); err != nil {
+				return err
+			}
+			continue
+		case *[]ContextColumn:
+			if err := decodeContextColumns(keyPath, object[key], field); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := decodeValue(object[key], field); err != nil {
+			return fmt.Errorf("%s: %v", keyPath, err)
+		}
+	}
+	return nil
+}
+
+// decodeContextColumns decodes a list of context columns.
+func decodeContextColumns(path string, data json.RawMessage, columns *[]ContextColumn) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("%s: expected a list of objects", path)
+	}
+
+	*columns = make([]ContextColumn, len(items))
+	for i, item := range items {
+		col := &(*columns)[i]
+		fields := map[string]any{
+			"name":       &col.Name,
+			"type":       &col.DataType,
+			"expression": &col.Expression,
+		}
+		if err := decodeObject(fmt.Sprintf("%s[%d]", path, i), item, fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeValue decodes a single setting, describing the expected JSON type
+// when it does not match.
+func decodeValue(data json.RawMessage, target any) error {
+	if err := json.Unmarshal(data, target); err != nil {
+		switch target.(type) {
+		case *bool:
+			return fmt.Errorf("expected true or false")
+		case *int:
+			return fmt.Errorf("expected a whole number")
+		case *[]string:
+			return fmt.Errorf("expected a list of strings")
+		case *map[string]json.RawMessage:
+			return fmt.Errorf("expected an object")
+		default:
+			return fmt.Errorf("expected a string")
+		}
+	}
+	return nil
+}
+
+// checkContextColumns requires a unique name for every context column.
+func checkContextColumns(path string, columns []ContextColumn) error {
+	seen := map[string]bool{}
+	for i, col := range columns {
+		name, _ := parseIdentifier(col.Name)
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("%s[%d].name: must not be empty", path, i)
+		}
+		if seen[name] {
+			return fmt.Errorf("%s[%d].name: duplicate column %s", path, i, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// checkChoice requires value to be one of choices.
+func checkChoice(path, value string, choices ...string) error {
+	for _, choice := range choices {
+		if value == choice {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: must be one of '%s', got %q", path, strings.Join(choices, "', '"), value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,176 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SortTablesByDependency orders tables so that every table comes after the
+// tables it references through foreign keys. Tables keep their input order
+// where dependencies allow it; tables in a reference cycle are appended in
+// input order.
+func SortTablesByDependency(tables []Table) []Table {
+	index := tableIndex(tables)
+
+	dependencies := make([]map[int]bool, len(tables))
+	for i, table := range tables {
+		dependencies[i] = map[int]bool{}
+		for _, fk := range table.ForeignKeys {
+			if j, ok := index[fk.ReferencedTable]; ok && j != i {
+				dependencies[i][j] = true
+			}
+		}
+	}
+
+	sorted := make([]Table, 0, len(tables))
+	done := make([]bool, len(tables))
+	for len(sorted) < len(tables) {
+		progress := false
+		for i, table := range tables {
+			if done[i] || !allDone(dependencies[i], done) {
+				continue
+			}
+			sorted = append(sorted, table)
+			done[i] = true
+			progress = true
+		}
+		if !progress {
+			for i, table := range tables {
+				if !done[i] {
+					sorted = append(sorted, table)
+					done[i] = true
+				}
+			}
+		}
+	}
+
+	return sorted
+}
+
+// tableIndex maps the names a foreign key can reference a table by to its
+// position: the name as written in the input and, unless another table has
+// it, the bare table name.
+func tableIndex(tables []Table) map[string]int {
+	index := map[string]int{}
+	for i, table := range tables {
+		index[GetOriginalTableName(table)] = i
+	}
+	for i, table := range tables {
+		if _, ok := index[table.Name]; !ok {
+			index[table.Name] = i
+		}
+	}
+	return index
+}
+
+// UnresolvedReference is a foreign key referencing a table that is not in the
+// table set, e.g. one defined in an input that was not read.
+type UnresolvedReference struct {
+	Table      string
+	ForeignKey ForeignKey
+}
+
+func (r UnresolvedReference) String() string {
+	return fmt.Sprintf("%s (%s) references %s, which is not in the input", r.Table, r.ForeignKey.ColumnName, r.ForeignKey.ReferencedTable)
+}
+
+// UnresolvedReferences lists the foreign keys whose referenced table is not
+// among tables.
+func UnresolvedReferences(tables []Table) []UnresolvedReference {
+	index := tableIndex(tables)
+
+	var unresolved []UnresolvedReference
+	for _, table := range tables {
+		for _, fk := range table.ForeignKeys {
+			if _, ok := index[fk.ReferencedTable]; !ok {
+				unresolved = append(unresolved, UnresolvedReference{Table: GetOriginalTableName(table), ForeignKey: fk})
+			}
+		}
+	}
+	return unresolved
+}
+
+func allDone(dependencies map[int]bool, done []bool) bool {
+	for j := range dependencies {
+		if !done[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// GenerateDownSQL removes what GenerateHistorySQL installed with the same
+// configuration: the triggers and functions of every table, in reverse
+// dependency order and in one transaction. History tables hold the recorded
+// history, so they are only dropped when dropHistory is set; otherwise they
+// are left in place without their triggers.
+func GenerateDownSQL(tables []Table, config Config, dropHistory bool) (string, error) {
+	if err := ValidateNames(tables, config); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("-- Uninstall History Tables and Triggers\n")
+	if dropHistory {
+		sb.WriteString("-- This file removes history triggers, functions and history tables, including all recorded history\n\n")
+	} else {
+		sb.WriteString("-- This file removes history triggers and functions; history tables are kept\n\n")
+	}
+
+	sb.WriteString("BEGIN;\n\n")
+	sb.WriteString(generateDownTables(tables, config, dropHistory))
+	sb.WriteString("COMMIT;\n")
+
+	return sb.String(), nil
+}
+
+// generateDownTables removes the history objects of all tables, without
+// transaction control.
+func generateDownTables(tables []Table, config Config, dropHistory bool) string {
+	var sb strings.Builder
+
+	if purgeAll := getPurgeAllFunctionName(tables, config); purgeAll != "" {
+		sb.WriteString(fmt.Sprintf("DROP FUNCTION IF EXISTS %s(INTERVAL);\n\n", purgeAll))
+	}
+
+	sorted := SortTablesByDependency(tables)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sb.WriteString(GenerateDownTable(sorted[i], config, dropHistory))
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// GenerateDownTable removes the history objects of one table. Triggers, and
+// the history table when dropped, go first, since the functions they execute
+// cannot be dropped while in use.
+func GenerateDownTable(table Table, config Config, dropHistory bool) string {
+	config = config.ForTable(table)
+
+	var sb strings.Builder
+
+	tableName := quoteQualified(table.SchemaName, table.Name)
+	historyTableName := GetHistoryTableName(table, config)
+
+	sb.WriteString(fmt.Sprintf("-- Remove history for: %s\n", GetOriginalTableName(table)))
+	for _, operation := range []string{"insert", "update", "delete"} {
+		sb.WriteString(fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s;\n", getTriggerName(table, config, operation), tableName))
+	}
+	if dropHistory {
+		// Partitions and the triggers of the history table go with it.
+		sb.WriteString(fmt.Sprintf("DROP TABLE IF EXISTS %s;\n", historyTableName))
+	} else {
+		for _, operation := range []string{"hash", "protect", "protect_truncate"} {
+			if generatesObject(table, config, operation) {
+				sb.WriteString(fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s;\n", getTriggerName(table, config, operation), historyTableName))
+			}
+		}
+	}
+	for _, function := range historyFunctionSignatures(table, config) {
+		sb.WriteString(fmt.Sprintf("DROP FUNCTION IF EXISTS %s;\n", function))
+	}
+
+	return sb.String()
+}
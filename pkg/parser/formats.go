@@ -0,0 +1,202 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Migration tool formats of GenerateMigrationFiles.
+const (
+	FormatGolangMigrate = "golang-migrate"
+	FormatGoose         = "goose"
+	FormatFlyway        = "flyway"
+	FormatLiquibase     = "liquibase"
+)
+
+// MigrationFormats lists the supported migration tool formats.
+var MigrationFormats = []string{FormatGolangMigrate, FormatGoose, FormatFlyway, FormatLiquibase}
+
+// MigrationOptions name and version the files written for a migration tool.
+// Author is the changeset author for Liquibase. DropHistory makes the down
+// migration drop the history tables as well, as with GenerateDownSQL.
+type MigrationOptions struct {
+	Format      string
+	Version     string
+	Name        string
+	Author      string
+	DropHistory bool
+}
+
+var (
+	migrationNameRegex    = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	migrationVersionRegex = regexp.MustCompile(`^[0-9]+$`)
+	flywayVersionRegex    = regexp.MustCompile(`^[0-9]+([._][0-9]+)*$`)
+)
+
+// GenerateMigrationFiles writes what GenerateHistorySQL installs as a
+// migration for a migration tool, with the down migration removing it again
+// where the tool has one:
+//
+//   - golang-migrate: <version>_<name>.up.sql and <version>_<name>.down.sql
+//   - goose: <version>_<name>.sql with -- +goose Up and Down sections, and
+//     statements containing semicolons, such as PL/pgSQL functions, between
+//     StatementBegin and StatementEnd
+//   - flyway: V<version>__<name>.sql
+//   - liquibase: <version>_<name>.sql, a formatted SQL changelog with one
+//     changeset per table, rollbacks, and splitStatements:false on
+//     changesets holding functions
+//
+// The tools run each migration in a transaction, so the files hold no
+// transaction control even with Config.Idempotent.
+func GenerateMigrationFiles(tables []Table, config Config, options MigrationOptions) ([]OutputFile, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+
+	steps, err := GenerateHistorySteps(tables, config)
+	if err != nil {
+		return nil, err
+	}
+
+	var up strings.Builder
+	for _, step := range steps {
+		up.WriteString(fmt.Sprintf("-- %s\n", step.Name))
+		up.WriteString(strings.TrimRight(step.SQL, "\n") + "\n\n")
+	}
+	down := generateDownTables(tables, config, options.DropHistory)
+
+	base := options.Version + "_" + options.Name
+	switch options.Format {
+	case FormatGolangMigrate:
+		return []OutputFile{
+			{Name: base + ".up.sql", SQL: up.String()},
+			{Name: base + ".down.sql", SQL: down},
+		}, nil
+	case FormatGoose:
+		return []OutputFile{{Name: base + ".sql", SQL: gooseMigration(up.String(), down)}}, nil
+	case FormatFlyway:
+		return []OutputFile{{Name: "V" + options.Version + "__" + options.Name + ".sql", SQL: up.String()}}, nil
+	case FormatLiquibase:
+		return []OutputFile{{Name: base + ".sql", SQL: liquibaseChangelog(tables, config, steps, options)}}, nil
+	}
+	return nil, fmt.Errorf("format must be one of '%s', got %q", strings.Join(MigrationFormats, "', '"), options.Format)
+}
+
+// Validate checks the format, and that the name and version can be used in
+// the file names of the format. Versions are whole numbers; Flyway also
+// accepts dotted versions such as 1.2.
+func (o MigrationOptions) Validate() error {
+	if err := checkChoice("format", o.Format, MigrationFormats...); err != nil {
+		return err
+	}
+	if !migrationNameRegex.MatchString(o.Name) {
+		return fmt.Errorf("migration name must only contain letters, digits and underscores, got %q", o.Name)
+	}
+	versionRegex := migrationVersionRegex
+	if o.Format == FormatFlyway {
+		versionRegex = flywayVersionRegex
+	}
+	if !versionRegex.MatchString(o.Version) {
+		return fmt.Errorf("invalid %s migration version %q", o.Format, o.Version)
+	}
+	if o.Format == FormatLiquibase && strings.ContainsAny(o.Author, " \t:") {
+		return fmt.Errorf("changeset author must not contain spaces or colons, got %q", o.Author)
+	}
+	return nil
+}
+
+// gooseMigration writes the up and down SQL as a goose migration. goose
+// splits on semicolons unless a statement is marked.
+func gooseMigration(up, down string) string {
+	var sb strings.Builder
+
+	sections := []struct{ annotation, sql string }{{"Up", up}, {"Down", down}}
+	for i, section := range sections {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(fmt.Sprintf("-- +goose %s\n\n", section.annotation))
+		for _, statement := range SplitStatements(section.sql) {
+			if hasInnerSemicolon(statement) {
+				sb.WriteString("-- +goose StatementBegin\n")
+				sb.WriteString(statement + "\n")
+				sb.WriteString("-- +goose StatementEnd\n\n")
+			} else {
+				sb.WriteString(statement + "\n\n")
+			}
+		}
+	}
+
+	return strings.TrimRight(sb.String(), "\n") + "\n"
+}
+
+// liquibaseChangelog writes the steps as a formatted SQL changelog. Liquibase
+// splits changesets on semicolons by default, which breaks function bodies.
+func liquibaseChangelog(tables []Table, config Config, steps []Step, options MigrationOptions) string {
+	byName := map[string]Table{}
+	for _, table := range tables {
+		byName[GetOriginalTableName(table)] = table
+	}
+
+	var sb strings.Builder
+	sb.WriteString("--liquibase formatted sql\n")
+
+	for i, step := range steps {
+		sb.WriteString(fmt.Sprintf("\n--changeset %s:%s-%d", options.Author, options.Version, i+1))
+		for _, statement := range SplitStatements(step.SQL) {
+			if hasInnerSemicolon(statement) {
+				sb.WriteString(" splitStatements:false")
+				break
+			}
+		}
+		sb.WriteString(fmt.Sprintf("\n--comment: %s\n", step.Name))
+		sb.WriteString(strings.TrimRight(step.SQL, "\n") + "\n")
+
+		// The extension and history schemas may be shared, so they are
+		// not rolled back. purge_history() is the last step when generated.
+		rollback := ""
+		if table, ok := byName[step.Table]; ok {
+			rollback = GenerateDownTable(table, config, options.DropHistory)
+		} else if purgeAll := getPurgeAllFunctionName(tables, config); purgeAll != "" && i == len(steps)-1 {
+			rollback = fmt.Sprintf("DROP FUNCTION IF EXISTS %s(INTERVAL);\n", purgeAll)
+		}
+		for _, statement := range SplitStatements(rollback) {
+			for _, line := range strings.Split(statement, "\n") {
+				if !strings.HasPrefix(line, "--") {
+					sb.WriteString("--rollback " + line + "\n")
+				}
+			}
+		}
+	}
+
+	return sb.String()
+}
+
+// hasInnerSemicolon reports whether a statement contains semicolons before its
+// end, which tools splitting on semicolons would cut it at.
+func hasInnerSemicolon(statement string) bool {
+	return strings.Contains(strings.TrimSuffix(strings.TrimSpace(statement), ";"), ";")
+}
+
+// SplitStatements splits SQL into statements, each ending with its
+// semicolon. Semicolons in comments, string literals, quoted identifiers and
+// dollar-quoted bodies do not end a statement. Comments stay with the
+// statement that follows them; comments after the last statement are dropped.
+func SplitStatements(sql string) []string {
+	stripped, _, ends := stripComments(sql)
+
+	var statements []string
+	start := 0
+	for _, end := range ends {
+		if strings.TrimSpace(stripped[start:end]) != "" {
+			statements = append(statements, strings.TrimSpace(sql[start:end+1]))
+		}
+		start = end + 1
+	}
+	if strings.TrimSpace(stripped[start:]) != "" {
+		statements = append(statements, strings.TrimSpace(sql[start:]))
+	}
+
+	return statements
+}
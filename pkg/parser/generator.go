@@ -7,189 +7,383 @@ import (
 )
 
 func GenerateHistoryTable(table Table, config Config) string {
+	config = config.ForTable(table)
+
 	var sb strings.Builder
 
-	historyTableName := GetHistoryTableName(table)
+	sb.WriteString(generateHistoryTableDDL(table, config))
+	if isPartitioned(config) {
+		sb.WriteString("\n")
+		sb.WriteString(GeneratePartitionFunction(table, config))
+	}
+	if config.HashChain {
+		sb.WriteString("\n")
+		sb.WriteString(GenerateHashChain(table, config))
+	}
 
-	sb.WriteString(fmt.Sprintf("CREATE TABLE %s (\n", historyTableName))
+	return sb.String()
+}
 
-	for _, col := range table.Columns {
-		sb.WriteString(fmt.Sprintf("    %s %s", col.Name, col.DataType))
+// generateHistoryTableDDL creates the history table with its partitions and
+// indexes.
+func generateHistoryTableDDL(table Table, config Config) string {
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+
+	sb.WriteString(fmt.Sprintf("CREATE TABLE %s%s (\n", ifNotExists(config), historyTableName))
+
+	columns := HistoryColumns(table, config)
+	for i, col := range columns {
+		if i > 0 {
+			sb.WriteString(",\n")
+		}
+		sb.WriteString(fmt.Sprintf("    %s %s", QuoteIdentifier(col.Name), col.DataType))
 		if col.Options != "" {
-			// Remove constraints that don't make sense in history tables
-			cleanOptions := col.Options
-			cleanOptions = strings.ReplaceAll(cleanOptions, "PRIMARY KEY", "")
-			cleanOptions = strings.ReplaceAll(cleanOptions, "AUTO_INCREMENT", "")
-			cleanOptions = strings.ReplaceAll(cleanOptions, "UNIQUE", "")
-
-			// Remove REFERENCES clauses (foreign keys)
-			referencePattern := `(?i)\s+REFERENCES\s+[^\s(]+\s*\([^)]+\)(?:\s+ON\s+DELETE\s+[^,\s]+)?(?:\s+ON\s+UPDATE\s+[^,\s]+)?`
-			cleanOptions = regexp.MustCompile(referencePattern).ReplaceAllString(cleanOptions, "")
-
-			cleanOptions = strings.TrimSpace(cleanOptions)
-			if cleanOptions != "" {
-				sb.WriteString(" " + cleanOptions)
-			}
+			sb.WriteString(" " + col.Options)
 		}
-		sb.WriteString(",\n")
 	}
 
-	sb.WriteString("    valid_from TIMESTAMP DEFAULT CURRENT_TIMESTAMP,\n")
-	sb.WriteString("    valid_to TIMESTAMP NULL,\n")
-	sb.WriteString("    operation CHAR(1) NOT NULL CHECK (operation IN ('I', 'U', 'D'))")
-
-	if config.TrackUser {
-		sb.WriteString(",\n    changed_by VARCHAR(255)\n")
+	if isPartitioned(config) {
+		// Primary keys of partitioned tables must include the partition key.
+		if config.HistoryID {
+			sb.WriteString(",\n    PRIMARY KEY (history_id, valid_from)")
+		}
+		sb.WriteString("\n) PARTITION BY RANGE (valid_from);\n\n")
+		sb.WriteString(GeneratePartitions(table, config))
 	} else {
-		sb.WriteString("\n")
+		sb.WriteString("\n);\n\n")
 	}
-	sb.WriteString(");\n\n")
 
-	indexPrefix := getIndexPrefix(table)
-	sb.WriteString(fmt.Sprintf("CREATE INDEX idx_%s_history_valid_from ON %s (valid_from);\n", indexPrefix, historyTableName))
-	sb.WriteString(fmt.Sprintf("CREATE INDEX idx_%s_history_valid_to ON %s (valid_to);\n", indexPrefix, historyTableName))
+	sb.WriteString(GenerateHistoryIndexes(table, config))
 
 	return sb.String()
 }
 
-func GenerateTriggers(table Table, config Config) string {
-	var sb strings.Builder
+// HistoryColumns lists the columns of the table's history table in order: the
+// source columns without key, uniqueness and reference constraints, then the
+// columns maintained by the triggers.
+func HistoryColumns(table Table, config Config) []Column {
+	config = config.ForTable(table)
 
-	historyTableName := GetHistoryTableName(table)
-	originalTableName := GetOriginalTableName(table)
-
-	columnNames := make([]string, len(table.Columns))
-	newValues := make([]string, len(table.Columns))
+	var columns []Column
 
-	for i, col := range table.Columns {
-		columnNames[i] = col.Name
-		newValues[i] = "NEW." + col.Name
+	if config.HistoryID && isPartitioned(config) {
+		columns = append(columns, Column{Name: "history_id", DataType: "BIGINT", Options: "GENERATED ALWAYS AS IDENTITY"})
+	} else if config.HistoryID {
+		columns = append(columns, Column{Name: "history_id", DataType: "BIGINT", Options: "GENERATED ALWAYS AS IDENTITY PRIMARY KEY"})
 	}
 
-	columnsStr := strings.Join(columnNames, ", ")
-	newValuesStr := strings.Join(newValues, ", ")
+	for _, col := range table.Columns {
+		// Remove constraints that don't make sense in history tables
+		cleanOptions := col.Options
+		cleanOptions = strings.ReplaceAll(cleanOptions, "PRIMARY KEY", "")
+		cleanOptions = strings.ReplaceAll(cleanOptions, "AUTO_INCREMENT", "")
+		cleanOptions = strings.ReplaceAll(cleanOptions, "UNIQUE", "")
+
+		// Remove REFERENCES clauses (foreign keys)
+		referencePattern := `(?i)\s+REFERENCES\s+[^\s(]+\s*\([^)]+\)(?:\s+ON\s+DELETE\s+[^,\s]+)?(?:\s+ON\s+UPDATE\s+[^,\s]+)?`
+		cleanOptions = regexp.MustCompile(referencePattern).ReplaceAllString(cleanOptions, "")
+
+		col.Options = strings.TrimSpace(cleanOptions)
+		columns = append(columns, col)
+	}
 
-	userExpression := getUserExpression(config)
+	columns = append(columns,
+		Column{Name: "valid_from", DataType: "TIMESTAMP", Options: "DEFAULT CURRENT_TIMESTAMP"},
+		Column{Name: "valid_to", DataType: "TIMESTAMP", Options: "NULL"},
+		Column{Name: "operation", DataType: "CHAR(1)", Options: "NOT NULL CHECK (operation IN ('I', 'U', 'D'))"},
+	)
 
-	sb.WriteString(fmt.Sprintf("-- Insert trigger for %s\n", originalTableName))
-	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s_insert_history() RETURNS TRIGGER AS $$\n", GetFunctionPrefix(table)))
-	sb.WriteString("BEGIN\n")
+	if config.Versioning {
+		columns = append(columns, Column{Name: "version", DataType: "INTEGER", Options: "NOT NULL"})
+	}
 
 	if config.TrackUser {
-		sb.WriteString(fmt.Sprintf("    INSERT INTO %s (%s, valid_from, operation, changed_by)\n", historyTableName, columnsStr))
-		sb.WriteString(fmt.Sprintf("    VALUES (%s, CURRENT_TIMESTAMP, 'I', %s);\n", newValuesStr, userExpression))
-	} else {
-		sb.WriteString(fmt.Sprintf("    INSERT INTO %s (%s, valid_from, operation)\n", historyTableName, columnsStr))
-		sb.WriteString(fmt.Sprintf("    VALUES (%s, CURRENT_TIMESTAMP, 'I');\n", newValuesStr))
+		columns = append(columns, Column{Name: "changed_by", DataType: "VARCHAR(255)"})
 	}
-	sb.WriteString("    RETURN NEW;\n")
-	sb.WriteString("END;\n")
-	sb.WriteString("$$ LANGUAGE plpgsql;\n\n")
 
-	sb.WriteString(fmt.Sprintf("CREATE TRIGGER %s_insert_trigger\n", GetFunctionPrefix(table)))
-	sb.WriteString(fmt.Sprintf("    AFTER INSERT ON %s\n", originalTableName))
-	sb.WriteString("    FOR EACH ROW\n")
-	sb.WriteString(fmt.Sprintf("    EXECUTE FUNCTION %s_insert_history();\n\n", GetFunctionPrefix(table)))
+	for _, col := range contextColumns(config) {
+		columns = append(columns, Column{Name: col.Name, DataType: col.DataType})
+	}
 
-	sb.WriteString(fmt.Sprintf("-- Update trigger for %s\n", originalTableName))
-	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s_update_history() RETURNS TRIGGER AS $$\n", GetFunctionPrefix(table)))
-	sb.WriteString("BEGIN\n")
-	sb.WriteString(fmt.Sprintf("    UPDATE %s SET valid_to = CURRENT_TIMESTAMP\n", historyTableName))
-	sb.WriteString("    WHERE valid_to IS NULL")
+	if config.HashChain {
+		columns = append(columns, Column{Name: "row_hash", DataType: "BYTEA", Options: "NOT NULL"})
+	}
 
+	return columns
+}
+
+// GenerateHistoryIndexes creates the indexes used by point-in-time queries and
+// by the trigger close-out, which always looks up the open row by primary key.
+func GenerateHistoryIndexes(table Table, config Config) string {
+	config = config.ForTable(table)
+
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
 	primaryKeys := GetPrimaryKeyColumns(table)
+	timeMethod := ""
+	if config.IndexStrategy == "brin" {
+		timeMethod = "USING brin "
+	}
+
+	sb.WriteString(fmt.Sprintf("CREATE INDEX %s%s ON %s %s(valid_from);\n", ifNotExists(config), getIndexName(table, config, "valid_from"), historyTableName, timeMethod))
+	sb.WriteString(fmt.Sprintf("CREATE INDEX %s%s ON %s %s(valid_to);\n", ifNotExists(config), getIndexName(table, config, "valid_to"), historyTableName, timeMethod))
+
 	if len(primaryKeys) > 0 {
-		sb.WriteString(" AND ")
-		conditions := make([]string, len(primaryKeys))
-		for i, pk := range primaryKeys {
-			conditions[i] = fmt.Sprintf("%s = OLD.%s", pk, pk)
+		// Without a declared key the fallback column may hold duplicates, so
+		// the open-row index can only be unique for a real primary key.
+		// Partitioned tables cannot have unique indexes without valid_from.
+		unique := ""
+		if hasDeclaredPrimaryKey(table) && !isPartitioned(config) {
+			unique = "UNIQUE "
 		}
-		sb.WriteString(strings.Join(conditions, " AND "))
+		pkColumns := strings.Join(quoteColumns(primaryKeys), ", ")
+		sb.WriteString(fmt.Sprintf("CREATE %sINDEX %s%s ON %s (%s) WHERE valid_to IS NULL;\n", unique, ifNotExists(config), getIndexName(table, config, "current"), historyTableName, pkColumns))
+		sb.WriteString(fmt.Sprintf("CREATE INDEX %s%s ON %s (%s, valid_from);\n", ifNotExists(config), getIndexName(table, config, "pk_valid_from"), historyTableName, pkColumns))
 	}
-	sb.WriteString(";\n")
 
-	if config.TrackUser {
-		sb.WriteString(fmt.Sprintf("    INSERT INTO %s (%s, valid_from, operation, changed_by)\n", historyTableName, columnsStr))
-		sb.WriteString(fmt.Sprintf("    VALUES (%s, CURRENT_TIMESTAMP, 'U', %s);\n", newValuesStr, userExpression))
-	} else {
-		sb.WriteString(fmt.Sprintf("    INSERT INTO %s (%s, valid_from, operation)\n", historyTableName, columnsStr))
-		sb.WriteString(fmt.Sprintf("    VALUES (%s, CURRENT_TIMESTAMP, 'U');\n", newValuesStr))
+	if config.Versioning {
+		// Versions are only unique per key for a declared primary key; rows
+		// sharing the fallback column are numbered concurrently.
+		unique := ""
+		if hasDeclaredPrimaryKey(table) && !isPartitioned(config) {
+			unique = "UNIQUE "
+		}
+		versionColumns := append(quoteColumns(primaryKeys), "version")
+		sb.WriteString(fmt.Sprintf("CREATE %sINDEX %s%s ON %s (%s);\n", unique, ifNotExists(config), getIndexName(table, config, "version"), historyTableName, strings.Join(versionColumns, ", ")))
 	}
-	sb.WriteString("    RETURN NEW;\n")
-	sb.WriteString("END;\n")
-	sb.WriteString("$$ LANGUAGE plpgsql;\n\n")
 
-	sb.WriteString(fmt.Sprintf("CREATE TRIGGER %s_update_trigger\n", GetFunctionPrefix(table)))
-	sb.WriteString(fmt.Sprintf("    AFTER UPDATE ON %s\n", originalTableName))
+	return sb.String()
+}
+
+func GenerateTriggers(table Table, config Config) string {
+	config = config.ForTable(table)
+
+	var sb strings.Builder
+
+	originalTableName := GetOriginalTableName(table)
+
+	for _, operation := range []string{"insert", "update", "delete"} {
+		sb.WriteString(fmt.Sprintf("-- %s trigger for %s\n", strings.ToUpper(operation[:1])+operation[1:], originalTableName))
+		sb.WriteString(GenerateTriggerFunction(table, config, operation))
+		sb.WriteString(generateTrigger(table, config, operation))
+	}
+
+	return sb.String()
+}
+
+// triggerTimings are the events the history triggers fire on. Deletes are
+// recorded before the row is gone.
+var triggerTimings = map[string]string{
+	"insert": "AFTER INSERT",
+	"update": "AFTER UPDATE",
+	"delete": "BEFORE DELETE",
+}
+
+// generateTrigger creates the "insert", "update" or "delete" trigger of the
+// table, which calls the trigger function of the same operation.
+func generateTrigger(table Table, config Config, operation string) string {
+	var sb strings.Builder
+
+	tableName := quoteQualified(table.SchemaName, table.Name)
+
+	sb.WriteString(createTrigger(config, getTriggerName(table, config, operation), tableName))
+	sb.WriteString(fmt.Sprintf("    %s ON %s\n", triggerTimings[operation], tableName))
 	sb.WriteString("    FOR EACH ROW\n")
-	sb.WriteString(fmt.Sprintf("    EXECUTE FUNCTION %s_update_history();\n\n", GetFunctionPrefix(table)))
+	if operation == "update" && len(table.IgnoredColumns) > 0 {
+		// Changes to ignored columns alone record no new version.
+		sb.WriteString(fmt.Sprintf("    WHEN (%s IS DISTINCT FROM %s)\n", rowOf(table, "OLD"), rowOf(table, "NEW")))
+	}
+	sb.WriteString(fmt.Sprintf("    EXECUTE FUNCTION %s();\n\n", getFunctionName(table, config, operation)))
 
-	sb.WriteString(fmt.Sprintf("-- Delete trigger for %s\n", originalTableName))
-	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s_delete_history() RETURNS TRIGGER AS $$\n", GetFunctionPrefix(table)))
-	sb.WriteString("BEGIN\n")
+	return sb.String()
+}
 
-	if config.TrackUser {
-		sb.WriteString(fmt.Sprintf("    UPDATE %s SET valid_to = CURRENT_TIMESTAMP\n", historyTableName))
-		sb.WriteString("    WHERE valid_to IS NULL")
-
-		if len(primaryKeys) > 0 {
-			sb.WriteString(" AND ")
-			conditions := make([]string, len(primaryKeys))
-			for i, pk := range primaryKeys {
-				conditions[i] = fmt.Sprintf("%s = OLD.%s", pk, pk)
-			}
-			sb.WriteString(strings.Join(conditions, " AND "))
-		}
-		sb.WriteString(";\n")
-
-		sb.WriteString(fmt.Sprintf("    INSERT INTO %s (", historyTableName))
-		sb.WriteString(columnsStr)
-		sb.WriteString(", valid_from, operation, changed_by)\n")
-		sb.WriteString("    VALUES (")
-		oldValues := make([]string, len(table.Columns))
-		for i, col := range table.Columns {
-			oldValues[i] = "OLD." + col.Name
-		}
-		sb.WriteString(strings.Join(oldValues, ", "))
-		sb.WriteString(fmt.Sprintf(", CURRENT_TIMESTAMP, 'D', %s);\n", userExpression))
-	} else {
-		sb.WriteString(fmt.Sprintf("    UPDATE %s SET valid_to = CURRENT_TIMESTAMP\n", historyTableName))
-		sb.WriteString("    WHERE valid_to IS NULL")
-
-		if len(primaryKeys) > 0 {
-			sb.WriteString(" AND ")
-			conditions := make([]string, len(primaryKeys))
-			for i, pk := range primaryKeys {
-				conditions[i] = fmt.Sprintf("%s = OLD.%s", pk, pk)
-			}
-			sb.WriteString(strings.Join(conditions, " AND "))
+// GenerateTriggerFunction creates or replaces the function recording history
+// for the "insert", "update" or "delete" trigger of the table.
+func GenerateTriggerFunction(table Table, config Config, operation string) string {
+	config = config.ForTable(table)
+
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s() RETURNS TRIGGER AS $$", getFunctionName(table, config, operation)))
+	sb.WriteString(TriggerFunctionBody(table, config, operation))
+	sb.WriteString(fmt.Sprintf("$$ LANGUAGE plpgsql%s;\n\n", functionAttributes(config)))
+
+	return sb.String()
+}
+
+// TriggerFunctionBody returns the PL/pgSQL source between the $$ quotes of a
+// trigger function, as stored in pg_proc.prosrc.
+func TriggerFunctionBody(table Table, config Config, operation string) string {
+	config = config.ForTable(table)
+
+	var sb strings.Builder
+
+	sb.WriteString("\nBEGIN\n")
+	switch operation {
+	case "insert":
+		// A key that was deleted and inserted again still has its 'D' row
+		// open. Without a declared key the fallback column is not unique,
+		// so the open rows found by it may belong to other live rows.
+		if hasDeclaredPrimaryKey(table) {
+			sb.WriteString(closeHistoryRow(table, config, "NEW"))
 		}
-		sb.WriteString(";\n")
-
-		sb.WriteString(fmt.Sprintf("    INSERT INTO %s (", historyTableName))
-		sb.WriteString(columnsStr)
-		sb.WriteString(", valid_from, operation)\n")
-		sb.WriteString("    VALUES (")
-		oldValues := make([]string, len(table.Columns))
-		for i, col := range table.Columns {
-			oldValues[i] = "OLD." + col.Name
+		sb.WriteString(insertHistoryRow(table, config, "NEW", "I"))
+		sb.WriteString("    RETURN NEW;\n")
+	case "update":
+		sb.WriteString(closeHistoryRow(table, config, "OLD"))
+		// An update changing the key to one that was deleted before finds
+		// that key's 'D' row still open.
+		if hasDeclaredPrimaryKey(table) {
+			sb.WriteString(closeHistoryRow(table, config, "NEW"))
 		}
-		sb.WriteString(strings.Join(oldValues, ", "))
-		sb.WriteString(", CURRENT_TIMESTAMP, 'D');\n")
+		sb.WriteString(insertHistoryRow(table, config, "NEW", "U"))
+		sb.WriteString("    RETURN NEW;\n")
+	case "delete":
+		sb.WriteString(closeHistoryRow(table, config, "OLD"))
+		sb.WriteString(insertHistoryRow(table, config, "OLD", "D"))
+		sb.WriteString("    RETURN OLD;\n")
 	}
-	sb.WriteString("    RETURN OLD;\n")
 	sb.WriteString("END;\n")
-	sb.WriteString("$$ LANGUAGE plpgsql;\n\n")
 
-	sb.WriteString(fmt.Sprintf("CREATE TRIGGER %s_delete_trigger\n", GetFunctionPrefix(table)))
-	sb.WriteString(fmt.Sprintf("    BEFORE DELETE ON %s\n", originalTableName))
-	sb.WriteString("    FOR EACH ROW\n")
-	sb.WriteString(fmt.Sprintf("    EXECUTE FUNCTION %s_delete_history();\n\n", GetFunctionPrefix(table)))
+	return sb.String()
+}
+
+// TriggerFunctionBodies returns the source of every trigger function generated
+// for the table, keyed by operation: insert, update and delete, plus hash and
+// protect when enabled.
+func TriggerFunctionBodies(table Table, config Config) map[string]string {
+	config = config.ForTable(table)
+
+	bodies := map[string]string{}
+	for _, operation := range []string{"insert", "update", "delete"} {
+		bodies[operation] = TriggerFunctionBody(table, config, operation)
+	}
+	if config.HashChain {
+		bodies["hash"] = hashFunctionBody(table, config)
+	}
+	if config.AppendOnly {
+		bodies["protect"] = protectFunctionBody(table, config)
+	}
+
+	return bodies
+}
+
+// closeHistoryRow ends the currently open history version for the key of the
+// given trigger row (NEW or OLD).
+func closeHistoryRow(table Table, config Config, row string) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("    UPDATE %s SET valid_to = CURRENT_TIMESTAMP\n", GetHistoryTableName(table, config)))
+	sb.WriteString("    WHERE valid_to IS NULL")
+	if condition := primaryKeyCondition(table, row); condition != "" {
+		sb.WriteString(" AND " + condition)
+	}
+	sb.WriteString(";\n")
+
+	return sb.String()
+}
+
+// insertHistoryRow records the given trigger row (NEW or OLD) as a new history
+// version with the given operation code.
+func insertHistoryRow(table Table, config Config, row, operation string) string {
+	historyTableName := GetHistoryTableName(table, config)
+
+	columns := make([]string, 0, len(table.Columns)+4)
+	values := make([]string, 0, len(table.Columns)+4)
+	for _, col := range table.Columns {
+		columns = append(columns, QuoteIdentifier(col.Name))
+		values = append(values, row+"."+QuoteIdentifier(col.Name))
+	}
 
+	columns = append(columns, "valid_from", "operation")
+	values = append(values, "CURRENT_TIMESTAMP", "'"+operation+"'")
+
+	if config.Versioning {
+		columns = append(columns, "version")
+		values = append(values, nextVersionExpression(table, config, row))
+	}
+
+	if config.TrackUser {
+		columns = append(columns, "changed_by")
+		values = append(values, getUserExpression(config))
+	}
+
+	for _, col := range contextColumns(config) {
+		columns = append(columns, QuoteIdentifier(col.Name))
+		values = append(values, col.Expression)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("    INSERT INTO %s (%s)\n", historyTableName, strings.Join(columns, ", ")))
+	sb.WriteString(fmt.Sprintf("    VALUES (%s);\n", strings.Join(values, ", ")))
 	return sb.String()
 }
 
+// historyDataColumns lists the history columns that never change once a
+// version is written, i.e. all of them except valid_to.
+func historyDataColumns(table Table, config Config) []string {
+	var columns []string
+	if config.HistoryID {
+		columns = append(columns, "history_id")
+	}
+	for _, col := range table.Columns {
+		columns = append(columns, col.Name)
+	}
+	columns = append(columns, "valid_from", "operation")
+	if config.Versioning {
+		columns = append(columns, "version")
+	}
+	if config.TrackUser {
+		columns = append(columns, "changed_by")
+	}
+	for _, col := range contextColumns(config) {
+		columns = append(columns, col.Name)
+	}
+	if config.HashChain {
+		columns = append(columns, "row_hash")
+	}
+	return columns
+}
+
+// nextVersionExpression numbers history versions per primary key, starting at 1.
+func nextVersionExpression(table Table, config Config, row string) string {
+	expression := fmt.Sprintf("(SELECT COALESCE(MAX(version), 0) + 1 FROM %s", GetHistoryTableName(table, config))
+	if condition := primaryKeyCondition(table, row); condition != "" {
+		expression += " WHERE " + condition
+	}
+	return expression + ")"
+}
+
+// rowOf lists the tracked columns of the given trigger row (NEW or OLD) as a
+// row value.
+func rowOf(table Table, row string) string {
+	values := make([]string, len(table.Columns))
+	for i, col := range table.Columns {
+		values[i] = row + "." + QuoteIdentifier(col.Name)
+	}
+	return "ROW(" + strings.Join(values, ", ") + ")"
+}
+
+// primaryKeyCondition matches history rows having the same primary key as the
+// given trigger row.
+func primaryKeyCondition(table Table, row string) string {
+	primaryKeys := GetPrimaryKeyColumns(table)
+	conditions := make([]string, len(primaryKeys))
+	for i, pk := range primaryKeys {
+		conditions[i] = fmt.Sprintf("%s = %s.%s", QuoteIdentifier(pk), row, QuoteIdentifier(pk))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
 func GetPrimaryKeyColumns(table Table) []string {
+	if len(table.PrimaryKey) > 0 {
+		return table.PrimaryKey
+	}
+
 	var primaryKeys []string
 	for _, col := range table.Columns {
 		if strings.Contains(strings.ToUpper(col.Options), "PRIMARY KEY") {
@@ -204,15 +398,70 @@ func GetPrimaryKeyColumns(table Table) []string {
 	return primaryKeys
 }
 
-func GeneratePointInTimeQuery(table Table) string {
-	return ""
+func hasDeclaredPrimaryKey(table Table) bool {
+	if len(table.PrimaryKey) > 0 {
+		return true
+	}
+	for _, col := range table.Columns {
+		if strings.Contains(strings.ToUpper(col.Options), "PRIMARY KEY") {
+			return true
+		}
+	}
+	return false
 }
 
-func GetHistoryTableName(table Table) string {
-	if table.SchemaName != "" {
-		return fmt.Sprintf("%s.%s_history", table.SchemaName, table.Name)
+// GeneratePointInTimeQuery selects the rows of the table as they were at the
+// given time from its history table. at is a timestamp literal such as
+// "2024-01-01 12:00:00"; when empty the current rows are selected.
+func GeneratePointInTimeQuery(table Table, config Config, at string) string {
+	config = config.ForTable(table)
+
+	columns := make([]string, len(table.Columns))
+	for i, col := range table.Columns {
+		columns[i] = QuoteIdentifier(col.Name)
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("SELECT %s\n", strings.Join(columns, ", ")))
+	sb.WriteString(fmt.Sprintf("FROM %s\n", GetHistoryTableName(table, config)))
+	if at == "" {
+		sb.WriteString("WHERE valid_to IS NULL\n")
+	} else {
+		timestamp := quoteLiteral(at) + "::timestamp"
+		sb.WriteString(fmt.Sprintf("WHERE valid_from <= %s\n", timestamp))
+		sb.WriteString(fmt.Sprintf("  AND (valid_to IS NULL OR valid_to > %s)\n", timestamp))
+	}
+	// A deleted key's last version is its open 'D' row.
+	sb.WriteString("  AND operation <> 'D'")
+	if primaryKeys := GetPrimaryKeyColumns(table); len(primaryKeys) > 0 {
+		sb.WriteString(fmt.Sprintf("\nORDER BY %s", strings.Join(quoteColumns(primaryKeys), ", ")))
+	}
+	sb.WriteString(";\n")
+
+	return sb.String()
+}
+
+func GetHistoryTableName(table Table, config Config) string {
+	name := mustRenderName(config.Naming.HistoryTable, DefaultHistoryTableTemplate, table, "")
+	return quoteQualified(getHistorySchema(table, config), name)
+}
+
+// getHistorySchema returns the schema holding the table's history objects:
+// the configured history schema, or else the schema of the table itself.
+func getHistorySchema(table Table, config Config) string {
+	if schema := config.ForTable(table).HistorySchema; schema != "" {
+		return schema
 	}
-	return fmt.Sprintf("%s_history", table.Name)
+	return table.SchemaName
+}
+
+// getFunctionName returns the name of the generated function of the table for
+// the given operation, such as "insert", qualified with the history schema when
+// one is configured. Without one, functions are created on the search_path.
+func getFunctionName(table Table, config Config, operation string) string {
+	functionName := mustRenderName(config.Naming.Function, DefaultFunctionTemplate, table, operation)
+	return quoteQualified(config.ForTable(table).HistorySchema, functionName)
 }
 
 func GetOriginalTableName(table Table) string {
@@ -229,41 +478,155 @@ func GetFunctionPrefix(table Table) string {
 	return table.Name
 }
 
-func getIndexPrefix(table Table) string {
-	if table.SchemaName != "" {
-		return fmt.Sprintf("%s_%s", table.SchemaName, table.Name)
+// contextColumns returns the context columns in effect with their defaults
+// filled in.
+func contextColumns(config Config) []ContextColumn {
+	columns := make([]ContextColumn, len(config.ContextColumns))
+	for i, col := range config.ContextColumns {
+		col.Name, _ = parseIdentifier(col.Name)
+		if col.DataType == "" {
+			col.DataType = "TEXT"
+		}
+		if col.Expression == "" {
+			col.Expression = fmt.Sprintf("current_setting(%s, true)", quoteLiteral("app."+col.Name))
+		}
+		columns[i] = col
 	}
-	return table.Name
+	return columns
 }
 
 func getUserExpression(config Config) string {
+	// Inside SECURITY DEFINER functions current_user is the function owner.
+	currentUser := "current_user"
+	if config.AppendOnly {
+		currentUser = "session_user"
+	}
 	if config.UserSource == "session" {
-		return "COALESCE(current_setting('app.current_user', true), current_user)"
+		return fmt.Sprintf("COALESCE(current_setting('app.current_user', true), %s)", currentUser)
+	}
+	return currentUser
+}
+
+// GenerateHistorySchemas creates the configured history schemas used by the
+// given tables. Schemas of the source tables are expected to exist already.
+func GenerateHistorySchemas(tables []Table, config Config) string {
+	var sb strings.Builder
+
+	seen := map[string]bool{}
+	for _, table := range tables {
+		schema := config.ForTable(table).HistorySchema
+		if schema == "" || seen[schema] {
+			continue
+		}
+		seen[schema] = true
+
+		if config.HistoryOwner != "" {
+			sb.WriteString(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s AUTHORIZATION %s;\n", QuoteIdentifier(schema), QuoteIdentifier(config.HistoryOwner)))
+		} else {
+			sb.WriteString(fmt.Sprintf("CREATE SCHEMA IF NOT EXISTS %s;\n", QuoteIdentifier(schema)))
+		}
 	}
-	return "current_user"
+
+	return sb.String()
+}
+
+// generateTableHistory creates all history objects of one table.
+func generateTableHistory(table Table, config Config) string {
+	var sb strings.Builder
+
+	historyTable := GenerateHistoryTable(table, config)
+	sb.WriteString(historyTable)
+	sb.WriteString("\n")
+
+	triggers := GenerateTriggers(table, config)
+	sb.WriteString(triggers)
+
+	sb.WriteString(GeneratePurgeFunction(table, config))
+	sb.WriteString(GenerateProtection(table, config))
+
+	return sb.String()
 }
 
 func GenerateHistorySQL(tables []Table, config Config) (string, error) {
+	if err := ValidateNames(tables, config); err != nil {
+		return "", err
+	}
+
 	var sb strings.Builder
 
 	sb.WriteString("-- Generated History Tables and Triggers\n")
 	sb.WriteString("-- This file contains history tables and triggers for temporal data tracking\n\n")
 
+	if config.HashChain {
+		sb.WriteString("CREATE EXTENSION IF NOT EXISTS pgcrypto;\n\n")
+	}
+
+	if schemas := GenerateHistorySchemas(tables, config); schemas != "" {
+		sb.WriteString(schemas + "\n")
+	}
+
 	for i, table := range tables {
 		if i > 0 {
 			sb.WriteString("\n" + strings.Repeat("-", 80) + "\n\n")
 		}
 
 		sb.WriteString(fmt.Sprintf("-- History table and triggers for: %s\n\n", GetOriginalTableName(table)))
+		if config.Idempotent {
+			sb.WriteString("BEGIN;\n\n")
+		}
 
-		historyTable := GenerateHistoryTable(table, config)
-		sb.WriteString(historyTable)
-		sb.WriteString("\n")
+		sb.WriteString(generateTableHistory(table, config))
 
-		triggers := GenerateTriggers(table, config)
-		sb.WriteString(triggers)
+		if config.Idempotent {
+			sb.WriteString("COMMIT;\n")
+		}
+	}
 
+	if purgeAll := GeneratePurgeAllFunction(tables, config); purgeAll != "" {
+		sb.WriteString("\n" + strings.Repeat("-", 80) + "\n\n")
+		sb.WriteString(purgeAll)
 	}
 
 	return sb.String(), nil
 }
+
+// Step is a part of the generated SQL that can be executed on its own. Table
+// is the table whose history objects it installs, or empty for the shared
+// objects.
+type Step struct {
+	Name  string
+	Table string
+	SQL   string
+}
+
+// GenerateHistorySteps splits what GenerateHistorySQL installs into steps:
+// the pgcrypto extension and history schemas, the objects of each table, and
+// purge_history(). Steps hold no transaction control, so a caller can run them
+// all in one transaction.
+func GenerateHistorySteps(tables []Table, config Config) ([]Step, error) {
+	if err := ValidateNames(tables, config); err != nil {
+		return nil, err
+	}
+
+	var steps []Step
+
+	var setup strings.Builder
+	if config.HashChain {
+		setup.WriteString("CREATE EXTENSION IF NOT EXISTS pgcrypto;\n")
+	}
+	setup.WriteString(GenerateHistorySchemas(tables, config))
+	if setup.Len() > 0 {
+		steps = append(steps, Step{Name: "extensions and schemas", SQL: setup.String()})
+	}
+
+	for _, table := range tables {
+		name := GetOriginalTableName(table)
+		steps = append(steps, Step{Name: name, Table: name, SQL: generateTableHistory(table, config)})
+	}
+
+	if purgeAll := GeneratePurgeAllFunction(tables, config); purgeAll != "" {
+		steps = append(steps, Step{Name: "purge_history()", SQL: purgeAll})
+	}
+
+	return steps, nil
+}
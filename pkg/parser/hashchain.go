@@ -0,0 +1,140 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// HashSettings pins the settings that affect the text form of values, so that
+// hashes computed by the trigger and by verification agree regardless of the
+// session's DateStyle or TimeZone.
+var HashSettings = []struct{ Name, Value string }{
+	{"DateStyle", "ISO, YMD"},
+	{"IntervalStyle", "postgres"},
+	{"TimeZone", "UTC"},
+	{"extra_float_digits", "1"},
+}
+
+// GenerateHashChain creates the BEFORE INSERT trigger that computes row_hash
+// for every new history row. The hash covers the stored values of the row
+// except history_id, valid_to and row_hash itself, so the close-out of a
+// version does not change it, and chains to the hash of the previous version
+// of the same key.
+func GenerateHashChain(table Table, config Config) string {
+	config = config.ForTable(table)
+
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+
+	sb.WriteString(fmt.Sprintf("-- Hash chain for %s\n", historyTableName))
+	sb.WriteString(generateHashFunction(table, config))
+	sb.WriteString(generateHashTrigger(table, config))
+
+	return sb.String()
+}
+
+// generateHashTrigger creates the trigger calling the hash function.
+func generateHashTrigger(table Table, config Config) string {
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+
+	sb.WriteString(createTrigger(config, getTriggerName(table, config, "hash"), historyTableName))
+	sb.WriteString(fmt.Sprintf("    BEFORE INSERT ON %s\n", historyTableName))
+	sb.WriteString("    FOR EACH ROW\n")
+	sb.WriteString(fmt.Sprintf("    EXECUTE FUNCTION %s();\n", getFunctionName(table, config, "hash")))
+
+	return sb.String()
+}
+
+// generateHashFunction creates or replaces the function behind the hash
+// trigger. It runs with HashSettings so that values render the same way as
+// during verification.
+func generateHashFunction(table Table, config Config) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s() RETURNS TRIGGER AS $$", getFunctionName(table, config, "hash")))
+	sb.WriteString(hashFunctionBody(table, config))
+	sb.WriteString(fmt.Sprintf("$$ LANGUAGE plpgsql%s", functionAttributes(config)))
+	for _, setting := range HashSettings {
+		sb.WriteString(fmt.Sprintf("\n    SET %s TO %s", setting.Name, quoteLiteral(setting.Value)))
+	}
+	sb.WriteString(";\n\n")
+
+	return sb.String()
+}
+
+func hashFunctionBody(table Table, config Config) string {
+	var sb strings.Builder
+
+	sb.WriteString("\nDECLARE\n")
+	sb.WriteString("    previous_hash BYTEA;\n")
+	sb.WriteString("BEGIN\n")
+	sb.WriteString(fmt.Sprintf("    SELECT row_hash INTO previous_hash FROM %s\n", GetHistoryTableName(table, config)))
+	sb.WriteString("    WHERE ")
+	if condition := primaryKeyCondition(table, "NEW"); condition != "" {
+		sb.WriteString(condition + " AND ")
+	}
+	sb.WriteString("version < NEW.version\n")
+	sb.WriteString("    ORDER BY version DESC LIMIT 1;\n")
+	sb.WriteString(fmt.Sprintf("    NEW.row_hash := %s;\n", HashExpression(table, config, "NEW", "previous_hash")))
+	sb.WriteString("    RETURN NEW;\n")
+	sb.WriteString("END;\n")
+
+	return sb.String()
+}
+
+// HashExpression returns the SQL expression computing row_hash for the history
+// row referenced by row (NEW in the trigger, a table alias when verifying),
+// given an expression for the previous version's hash. Values are rendered
+// with quote_nullable so that NULLs and separators cannot collide.
+func HashExpression(table Table, config Config, row, previousHash string) string {
+	config = config.ForTable(table)
+
+	var values []string
+	for _, col := range historyDataColumns(table, config) {
+		if col == "history_id" || col == "row_hash" {
+			continue
+		}
+		values = append(values, fmt.Sprintf("quote_nullable(%s.%s)", row, QuoteIdentifier(col)))
+	}
+
+	return fmt.Sprintf("digest(COALESCE(encode(%s, 'hex'), '') || '|' || concat_ws(',', %s), 'sha256')",
+		previousHash, strings.Join(values, ", "))
+}
+
+// GenerateChainVerificationQuery returns a query yielding the first broken
+// link of the hash chain in a history table as (key, version), or no rows when
+// the chain is intact. A link is broken when a row's hash does not match its
+// values and predecessor, or when a version is missing.
+func GenerateChainVerificationQuery(table Table, config Config) string {
+	config = config.ForTable(table)
+
+	primaryKeys := GetPrimaryKeyColumns(table)
+	keyColumns := make([]string, len(primaryKeys))
+	keyValues := make([]string, len(primaryKeys))
+	for i, pk := range primaryKeys {
+		keyColumns[i] = "h." + QuoteIdentifier(pk)
+		keyValues[i] = fmt.Sprintf("%s || '=' || quote_nullable(h.%s)", quoteLiteral(pk), QuoteIdentifier(pk))
+	}
+	partition := ""
+	if len(keyColumns) > 0 {
+		partition = "PARTITION BY " + strings.Join(keyColumns, ", ") + " "
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("SELECT chain_key, version FROM (\n")
+	sb.WriteString(fmt.Sprintf("    SELECT concat_ws(', ', %s) AS chain_key, h.version, h.valid_from, h.row_hash,\n", strings.Join(keyValues, ", ")))
+	sb.WriteString(fmt.Sprintf("        %s AS expected_hash,\n", HashExpression(table, config, "h", "lag(h.row_hash) OVER chain")))
+	sb.WriteString("        lag(h.version) OVER chain AS previous_version\n")
+	sb.WriteString(fmt.Sprintf("    FROM %s h\n", GetHistoryTableName(table, config)))
+	sb.WriteString(fmt.Sprintf("    WINDOW chain AS (%sORDER BY h.version)\n", partition))
+	sb.WriteString(") links\n")
+	sb.WriteString("WHERE row_hash IS DISTINCT FROM expected_hash OR version <> COALESCE(previous_version, 0) + 1\n")
+	sb.WriteString("ORDER BY valid_from, version\n")
+	sb.WriteString("LIMIT 1")
+
+	return sb.String()
+}
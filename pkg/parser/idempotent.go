@@ -0,0 +1,22 @@
+package parser
+
+import "fmt"
+
+// ifNotExists returns the IF NOT EXISTS clause for CREATE TABLE and CREATE
+// INDEX statements in idempotent mode.
+func ifNotExists(config Config) string {
+	if config.Idempotent {
+		return "IF NOT EXISTS "
+	}
+	return ""
+}
+
+// createTrigger starts a CREATE TRIGGER statement. In idempotent mode an
+// existing trigger of the same name is dropped first; CREATE OR REPLACE
+// TRIGGER would need PostgreSQL 14.
+func createTrigger(config Config, trigger, tableName string) string {
+	if config.Idempotent {
+		return fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s;\nCREATE TRIGGER %s\n", trigger, tableName, trigger)
+	}
+	return fmt.Sprintf("CREATE TRIGGER %s\n", trigger)
+}
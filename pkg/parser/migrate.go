@@ -0,0 +1,286 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ColumnChange is one difference between two versions of a table's columns.
+// Kind is "rename", "type", "drop not null", "drop" or "add". Name is the
+// column's name in the new version, or in the old one for dropped columns.
+type ColumnChange struct {
+	Kind     string
+	Name     string
+	OldName  string
+	DataType string
+}
+
+// ColumnRenames maps tables, by their original name, to the columns renamed
+// in them, from the old column name to the new one.
+type ColumnRenames map[string]map[string]string
+
+// DiffColumns compares the columns of two versions of a table. renames maps
+// old column names to new ones for the columns that were renamed; any other
+// column missing from one version was dropped or added, even when the types
+// match.
+func DiffColumns(oldTable, newTable Table, renames map[string]string) []ColumnChange {
+	oldColumns := map[string]Column{}
+	for _, col := range oldTable.Columns {
+		oldColumns[col.Name] = col
+	}
+	newColumns := map[string]Column{}
+	for _, col := range newTable.Columns {
+		newColumns[col.Name] = col
+	}
+	renamedFrom := map[string]string{}
+	for oldName, newName := range renames {
+		renamedFrom[newName] = oldName
+	}
+
+	var renamed, others, drops, adds []ColumnChange
+	for _, col := range newTable.Columns {
+		oldName := col.Name
+		if from, ok := renamedFrom[col.Name]; ok {
+			oldName = from
+		}
+		old, ok := oldColumns[oldName]
+		if !ok {
+			adds = append(adds, ColumnChange{Kind: "add", Name: col.Name, DataType: col.DataType})
+			continue
+		}
+
+		if oldName != col.Name {
+			renamed = append(renamed, ColumnChange{Kind: "rename", Name: col.Name, OldName: oldName, DataType: col.DataType})
+		}
+		if !sameDataType(old.DataType, col.DataType) {
+			others = append(others, ColumnChange{Kind: "type", Name: col.Name, OldName: col.Name, DataType: col.DataType})
+		}
+		if isNotNull(old) && !isNotNull(col) {
+			others = append(others, ColumnChange{Kind: "drop not null", Name: col.Name, OldName: col.Name, DataType: col.DataType})
+		}
+	}
+
+	for _, col := range oldTable.Columns {
+		_, kept := newColumns[col.Name]
+		_, isRenamed := renames[col.Name]
+		if !kept && !isRenamed {
+			drops = append(drops, ColumnChange{Kind: "drop", Name: col.Name, OldName: col.Name, DataType: col.DataType})
+		}
+	}
+
+	changes := append(renamed, others...)
+	changes = append(changes, drops...)
+	return append(changes, adds...)
+}
+
+// checkRenames reports renames that do not match the two versions of the
+// tables: the table must be in both, the old column only in the old version
+// and the new column only in the new one.
+func checkRenames(oldByName, newByName map[string]Table, renames ColumnRenames) error {
+	tableNames := make([]string, 0, len(renames))
+	for name := range renames {
+		tableNames = append(tableNames, name)
+	}
+	sort.Strings(tableNames)
+
+	for _, tableName := range tableNames {
+		oldTable, inOld := oldByName[tableName]
+		newTable, inNew := newByName[tableName]
+		if !inOld || !inNew {
+			return fmt.Errorf("rename in %s: the table must be in both the old and the new schema", tableName)
+		}
+
+		columns := renames[tableName]
+		oldNames := make([]string, 0, len(columns))
+		for oldName := range columns {
+			oldNames = append(oldNames, oldName)
+		}
+		sort.Strings(oldNames)
+
+		targets := map[string]string{}
+		for _, oldName := range oldNames {
+			newName := columns[oldName]
+			rename := fmt.Sprintf("rename of %s.%s to %s", tableName, oldName, newName)
+			switch {
+			case !hasColumn(oldTable, oldName):
+				return fmt.Errorf("%s: %s is not a column of the old table", rename, oldName)
+			case hasColumn(newTable, oldName):
+				return fmt.Errorf("%s: %s is still a column of the new table", rename, oldName)
+			case !hasColumn(newTable, newName):
+				return fmt.Errorf("%s: %s is not a column of the new table", rename, newName)
+			case hasColumn(oldTable, newName):
+				return fmt.Errorf("%s: %s is already a column of the old table", rename, newName)
+			}
+			if other, ok := targets[newName]; ok {
+				return fmt.Errorf("%s: %s is renamed to %s as well", rename, other, newName)
+			}
+			targets[newName] = oldName
+		}
+	}
+	return nil
+}
+
+func sameDataType(a, b string) bool {
+	normalize := func(dataType string) string {
+		return strings.Join(strings.Fields(strings.ToUpper(dataType)), " ")
+	}
+	return normalize(a) == normalize(b)
+}
+
+func isNotNull(col Column) bool {
+	return strings.Contains(strings.ToUpper(col.Options), "NOT NULL")
+}
+
+// GenerateMigrationSQL updates the history objects generated for oldTables to
+// match newTables, in one transaction. History tables of changed tables are
+// altered and their trigger functions replaced; columns dropped from a source
+// table stay in its history table as nullable columns, so past versions keep
+// their data. New tables get their full set of history objects, and the
+// triggers and trigger functions of removed tables are dropped while their
+// history tables are kept. Columns are only renamed in history tables when
+// named in renames. Changing the columns of a hash-chained table is an error.
+func GenerateMigrationSQL(oldTables, newTables []Table, config Config, renames ColumnRenames) (string, error) {
+	if err := ValidateNames(newTables, config); err != nil {
+		return "", err
+	}
+
+	oldByName := map[string]Table{}
+	for _, table := range oldTables {
+		oldByName[GetOriginalTableName(table)] = table
+	}
+	newByName := map[string]Table{}
+	for _, table := range newTables {
+		newByName[GetOriginalTableName(table)] = table
+	}
+	if err := checkRenames(oldByName, newByName, renames); err != nil {
+		return "", err
+	}
+
+	var added, removed []Table
+	var blocks []string
+	for _, table := range newTables {
+		old, ok := oldByName[GetOriginalTableName(table)]
+		if !ok {
+			added = append(added, table)
+			continue
+		}
+		// The hashes of recorded versions cover the old columns, so
+		// verify-chain would report every one of them as tampered.
+		if config.ForTable(table).HashChain && len(DiffColumns(old, table, renames[GetOriginalTableName(table)])) > 0 {
+			return "", fmt.Errorf("table %s: the columns of a hash-chained table cannot be migrated, since the versions recorded before would no longer verify", GetOriginalTableName(table))
+		}
+		if block := GenerateTableMigration(old, table, config, renames[GetOriginalTableName(table)]); block != "" {
+			blocks = append(blocks, block)
+		}
+	}
+	for _, table := range oldTables {
+		if _, ok := newByName[GetOriginalTableName(table)]; !ok {
+			removed = append(removed, table)
+		}
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("-- History Table Migration\n")
+	sb.WriteString("-- This file updates history tables and triggers to a new schema version\n\n")
+
+	if len(blocks) == 0 && len(added) == 0 && len(removed) == 0 {
+		sb.WriteString("-- No schema changes\n")
+		return sb.String(), nil
+	}
+
+	sb.WriteString("BEGIN;\n\n")
+
+	if config.HashChain && len(added) > 0 {
+		sb.WriteString("CREATE EXTENSION IF NOT EXISTS pgcrypto;\n\n")
+	}
+	if schemas := GenerateHistorySchemas(added, config); schemas != "" {
+		sb.WriteString(schemas + "\n")
+	}
+
+	for _, block := range blocks {
+		sb.WriteString(block)
+	}
+
+	for _, table := range SortTablesByDependency(added) {
+		sb.WriteString(fmt.Sprintf("-- History table and triggers for new table: %s\n\n", GetOriginalTableName(table)))
+		sb.WriteString(generateTableHistory(table, config))
+	}
+
+	for _, table := range removed {
+		tableConfig := config.ForTable(table)
+		sb.WriteString(fmt.Sprintf("-- %s was removed; %s is kept\n", GetOriginalTableName(table), GetHistoryTableName(table, tableConfig)))
+		// The table may still exist, e.g. when it is skipped now, and its
+		// triggers depend on the functions.
+		tableName := quoteQualified(table.SchemaName, table.Name)
+		for _, operation := range []string{"insert", "update", "delete"} {
+			sb.WriteString(fmt.Sprintf("DROP TRIGGER IF EXISTS %s ON %s;\n", getTriggerName(table, tableConfig, operation), tableName))
+		}
+		for _, operation := range []string{"insert", "update", "delete"} {
+			sb.WriteString(fmt.Sprintf("DROP FUNCTION IF EXISTS %s();\n", getFunctionName(table, tableConfig, operation)))
+		}
+		sb.WriteString("\n")
+	}
+
+	if len(added) > 0 || len(removed) > 0 {
+		// purge_history() calls the purge function of every table.
+		if purgeAll := GeneratePurgeAllFunction(newTables, config); purgeAll != "" {
+			sb.WriteString(purgeAll + "\n")
+		}
+	}
+
+	sb.WriteString("COMMIT;\n")
+
+	return sb.String(), nil
+}
+
+// GenerateTableMigration alters the history table of a table whose columns
+// changed and replaces the functions that depend on its columns. renames is
+// passed to DiffColumns. It returns an empty string when the columns did not
+// change. Hash-chained tables are refused by GenerateMigrationSQL.
+func GenerateTableMigration(oldTable, newTable Table, config Config, renames map[string]string) string {
+	config = config.ForTable(newTable)
+
+	changes := DiffColumns(oldTable, newTable, renames)
+	if len(changes) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(newTable, config)
+
+	sb.WriteString(fmt.Sprintf("-- Migrate history for: %s\n", GetOriginalTableName(newTable)))
+	for _, change := range changes {
+		name := QuoteIdentifier(change.Name)
+		switch change.Kind {
+		case "rename":
+			sb.WriteString(fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s;\n", historyTableName, QuoteIdentifier(change.OldName), name))
+		case "type":
+			sb.WriteString(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s TYPE %s USING %s::%s;\n", historyTableName, name, change.DataType, name, change.DataType))
+		case "drop not null", "drop":
+			sb.WriteString(fmt.Sprintf("ALTER TABLE %s ALTER COLUMN %s DROP NOT NULL;\n", historyTableName, name))
+		case "add":
+			// Versions recorded before the column existed have no value for
+			// it. A column dropped earlier is still in the history table.
+			sb.WriteString(fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s;\n", historyTableName, name, change.DataType))
+		}
+	}
+
+	oldKey := strings.Join(GetPrimaryKeyColumns(oldTable), ", ")
+	newKey := strings.Join(GetPrimaryKeyColumns(newTable), ", ")
+	if oldKey != newKey {
+		sb.WriteString(fmt.Sprintf("-- NOTE: the primary key changed from (%s) to (%s); history indexes are not updated\n", oldKey, newKey))
+	}
+	sb.WriteString("\n")
+
+	for _, operation := range []string{"insert", "update", "delete"} {
+		sb.WriteString(GenerateTriggerFunction(newTable, config, operation))
+	}
+	if config.AppendOnly {
+		sb.WriteString(generateProtectFunction(newTable, config))
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,291 @@
+package parser
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+)
+
+// maxIdentifierLength is NAMEDATALEN-1, the longest identifier PostgreSQL
+// keeps. Longer identifiers are silently truncated by the server.
+const maxIdentifierLength = 63
+
+// Default naming templates. They produce names such as users_history,
+// app_users_insert_history, app_users_insert_trigger and
+// idx_app_users_history_valid_from.
+const (
+	DefaultHistoryTableTemplate = "{{.Table}}_history"
+	DefaultFunctionTemplate     = "{{if .Schema}}{{.Schema}}_{{end}}{{.Table}}_{{.Operation}}_history"
+	DefaultTriggerTemplate      = "{{if .Schema}}{{.Schema}}_{{end}}{{.Table}}_{{.Operation}}_trigger"
+	DefaultIndexTemplate        = "idx_{{if .Schema}}{{.Schema}}_{{end}}{{.Table}}_history_{{.Operation}}"
+)
+
+// Naming holds text/template patterns for the names of generated objects.
+// Templates see a NameData; empty patterns use the defaults above. History
+// tables and functions are qualified with the history schema separately, so
+// patterns only produce the bare name.
+type Naming struct {
+	HistoryTable string
+	Function     string
+	Trigger      string
+	Index        string
+}
+
+// NameData is passed to naming templates. Operation tells the objects of a
+// table apart: insert, update, delete, protect, hash, purge, partition or
+// backfill for functions; insert, update, delete, protect, protect_truncate
+// or hash for triggers; valid_from, valid_to, current, pk_valid_from or
+// version for indexes. It is empty for history tables.
+type NameData struct {
+	Schema    string
+	Table     string
+	Operation string
+}
+
+func renderName(pattern, fallback string, table Table, operation string) (string, error) {
+	if pattern == "" {
+		pattern = fallback
+	}
+
+	tmpl, err := template.New("name").Parse(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid naming template %q: %w", pattern, err)
+	}
+
+	var sb strings.Builder
+	data := NameData{Schema: table.SchemaName, Table: table.Name, Operation: operation}
+	if err := tmpl.Execute(&sb, data); err != nil {
+		return "", fmt.Errorf("invalid naming template %q: %w", pattern, err)
+	}
+
+	name := strings.TrimSpace(sb.String())
+	if name == "" {
+		return "", fmt.Errorf("naming template %q produces an empty name for %s", pattern, GetOriginalTableName(table))
+	}
+	return name, nil
+}
+
+// mustRenderName renders a naming template and shortens the result to a
+// valid identifier, falling back to the default for broken templates.
+// GenerateHistorySQL reports those through ValidateNames before anything is
+// generated.
+func mustRenderName(pattern, fallback string, table Table, operation string) string {
+	name, err := renderName(pattern, fallback, table, operation)
+	if err != nil {
+		name, _ = renderName(fallback, fallback, table, operation)
+	}
+	return shortenIdentifier(name)
+}
+
+// shortenIdentifier keeps a name within maxIdentifierLength bytes. Longer
+// names are cut and get the first 8 hex digits of their MD5 as a suffix, so
+// the result is the same on every run and names sharing a long prefix stay
+// distinct. The partition function repeats this in PL/pgSQL.
+func shortenIdentifier(name string) string {
+	if len(name) <= maxIdentifierLength {
+		return name
+	}
+	sum := md5.Sum([]byte(name))
+	suffix := "_" + hex.EncodeToString(sum[:])[:8]
+	prefix := name[:maxIdentifierLength-len(suffix)]
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix + suffix
+}
+
+// getPartitionName names a partition of the table's history table, e.g. with
+// the suffix "p2024_01" or "default".
+func getPartitionName(table Table, config Config, suffix string) string {
+	historyName := mustRenderName(config.Naming.HistoryTable, DefaultHistoryTableTemplate, table, "")
+	return quoteQualified(getHistorySchema(table, config), shortenIdentifier(historyName+"_"+suffix))
+}
+
+// getBackfillProgressName names the table in which a backfill of the table
+// keeps the last key it recorded, next to the history table.
+func getBackfillProgressName(table Table, config Config) string {
+	historyName := mustRenderName(config.Naming.HistoryTable, DefaultHistoryTableTemplate, table, "")
+	return quoteQualified(getHistorySchema(table, config), shortenIdentifier(historyName+"_backfill"))
+}
+
+func getTriggerName(table Table, config Config, operation string) string {
+	return QuoteIdentifier(mustRenderName(config.Naming.Trigger, DefaultTriggerTemplate, table, operation))
+}
+
+func getIndexName(table Table, config Config, operation string) string {
+	return QuoteIdentifier(mustRenderName(config.Naming.Index, DefaultIndexTemplate, table, operation))
+}
+
+// Operations of the generated objects per table.
+var (
+	functionOperations = []string{"insert", "update", "delete", "protect", "hash", "purge", "partition", "backfill"}
+	triggerOperations  = []string{"insert", "update", "delete", "protect", "protect_truncate", "hash"}
+	indexOperations    = []string{"valid_from", "valid_to", "current", "pk_valid_from", "version"}
+)
+
+// GeneratedName is the name of an object generated for a table. Full is what
+// the naming template produced and Name the identifier used in the SQL; they
+// differ when Full exceeds the identifier length limit. Namespace is the scope
+// in which the name must be unique.
+type GeneratedName struct {
+	Kind      string
+	Operation string
+	Namespace string
+	Full      string
+	Name      string
+}
+
+// Shortened reports whether the name had to be shortened.
+func (n GeneratedName) Shortened() bool {
+	return n.Full != n.Name
+}
+
+// GeneratedNames lists the names of the objects generated for the table with
+// the given configuration.
+func GeneratedNames(table Table, config Config) ([]GeneratedName, error) {
+	config = config.ForTable(table)
+	historySchema := getHistorySchema(table, config)
+
+	var names []GeneratedName
+	add := func(kind, pattern, fallback, operation, namespace string) error {
+		if !generatesObject(table, config, operation) {
+			return nil
+		}
+		full, err := renderName(pattern, fallback, table, operation)
+		if err != nil {
+			return err
+		}
+		names = append(names, GeneratedName{
+			Kind:      kind,
+			Operation: operation,
+			Namespace: namespace,
+			Full:      full,
+			Name:      shortenIdentifier(full),
+		})
+		return nil
+	}
+
+	if err := add("history table", config.Naming.HistoryTable, DefaultHistoryTableTemplate, "", historySchema); err != nil {
+		return nil, err
+	}
+
+	if period, ok := partitionPeriods[config.Partitioning]; ok {
+		historyName := names[0].Full
+		suffixes := []string{"default"}
+		start := truncateToPeriod(config.PartitionStart, period)
+		for i := 0; i < config.PartitionCount; i++ {
+			suffixes = append(suffixes, "p"+start.Format(period.goFormat))
+			start = addPeriod(start, period)
+		}
+		for _, suffix := range suffixes {
+			full := historyName + "_" + suffix
+			names = append(names, GeneratedName{Kind: "partition", Operation: suffix, Namespace: historySchema, Full: full, Name: shortenIdentifier(full)})
+		}
+	}
+
+	if generatesObject(table, config, "backfill") {
+		full := names[0].Full + "_backfill"
+		names = append(names, GeneratedName{Kind: "progress table", Operation: "backfill", Namespace: historySchema, Full: full, Name: shortenIdentifier(full)})
+	}
+
+	for _, operation := range indexOperations {
+		if err := add("index", config.Naming.Index, DefaultIndexTemplate, operation, historySchema); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, operation := range functionOperations {
+		if err := add("function", config.Naming.Function, DefaultFunctionTemplate, operation, config.HistorySchema); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, operation := range triggerOperations {
+		if err := add("trigger", config.Naming.Trigger, DefaultTriggerTemplate, operation, GetOriginalTableName(table)); err != nil {
+			return nil, err
+		}
+	}
+
+	return names, nil
+}
+
+// generatesObject reports whether the configuration generates the objects of
+// the given operation for the table.
+func generatesObject(table Table, config Config, operation string) bool {
+	switch operation {
+	case "protect", "protect_truncate":
+		return config.AppendOnly
+	case "hash":
+		return config.HashChain
+	case "purge":
+		return config.Retention != ""
+	case "partition":
+		return isPartitioned(config)
+	case "backfill":
+		return config.backfill
+	case "current", "pk_valid_from":
+		return len(GetPrimaryKeyColumns(table)) > 0
+	case "version":
+		return config.Versioning
+	}
+	return true
+}
+
+// ValidateNames checks the naming templates and makes sure the names they
+// produce do not collide across the given tables. Tables, history tables,
+// partitions and indexes share a namespace per schema, functions have their
+// own, and trigger names only need to be unique per table.
+func ValidateNames(tables []Table, config Config) error {
+	claimed := map[string]string{}
+
+	claim := func(key, owner string) error {
+		if other, ok := claimed[key]; ok && other != owner {
+			return fmt.Errorf("generated name %s of %s collides with %s", key[strings.Index(key, ":")+1:], owner, other)
+		}
+		claimed[key] = owner
+		return nil
+	}
+
+	for _, table := range tables {
+		name := GetOriginalTableName(table)
+		if err := claim("relation:"+name, "table "+name); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		names, err := GeneratedNames(table, config)
+		if err != nil {
+			return err
+		}
+
+		originalName := GetOriginalTableName(table)
+		for _, name := range names {
+			space := "relation"
+			if name.Kind == "function" || name.Kind == "trigger" {
+				space = name.Kind
+			}
+
+			owner := name.Kind + " of " + originalName
+			if name.Operation != "" {
+				owner = name.Operation + " " + owner
+			}
+
+			if err := claim(space+":"+qualifyName(name.Namespace, name.Name), owner); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func qualifyName(schema, name string) string {
+	if schema != "" {
+		return schema + "." + name
+	}
+	return name
+}
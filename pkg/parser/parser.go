@@ -1,46 +1,304 @@
 package parser
 
 import (
+	"fmt"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type Config struct {
 	TrackUser  bool
 	UserSource string
+	HistoryID  bool
+	Versioning bool
+	// IndexStrategy selects the index method for the valid_from and valid_to
+	// indexes: "btree" (default) or "brin" for very large, append-mostly tables.
+	IndexStrategy string
+	// Partitioning makes history tables range partitioned on valid_from by
+	// "month" or "year"; PartitionCount partitions are created from
+	// PartitionStart, plus a default partition for anything outside them.
+	// PartitionStart is required, so that the output does not change with
+	// the date it is generated on.
+	Partitioning   string
+	PartitionStart time.Time
+	PartitionCount int
+	// Retention is how long closed history versions are kept, as a PostgreSQL
+	// interval such as "7 years". Empty keeps history forever.
+	Retention string
+	// AppendOnly guards history tables against UPDATE, DELETE and TRUNCATE
+	// other than the close-out done by the generated triggers and purges, and
+	// makes the generated functions SECURITY DEFINER.
+	AppendOnly bool
+	// HistoryOwner is the role that owns history tables and functions.
+	HistoryOwner string
+	// HashChain stores a pgcrypto SHA-256 row_hash in every history row,
+	// chained to the previous version of the same key. It implies Versioning.
+	HashChain bool
+	// HistorySchema places history tables and generated functions in a
+	// dedicated schema instead of next to each source table.
+	HistorySchema string
+	// Idempotent makes the output safe to apply repeatedly: tables and
+	// indexes are created IF NOT EXISTS, triggers are dropped and recreated,
+	// and the objects of each table are applied in one transaction.
+	Idempotent bool
+	// Naming overrides the names of generated tables, functions, triggers
+	// and indexes.
+	Naming Naming
+	// BackfillFrom names the column whose value becomes valid_from of the
+	// versions recorded by a backfill, e.g. "created_at". Tables without it,
+	// and rows where it is NULL, start at the time the backfill runs.
+	BackfillFrom string
+	// ContextColumns are extra history columns recording session context,
+	// such as a request or tenant id set by the application.
+	ContextColumns []ContextColumn
+	// Tables holds per-table overrides keyed by table name as written in the
+	// input, e.g. "users" or "sales.orders".
+	Tables map[string]TableConfig
+
+	// backfill is set while generating backfills, so that the names of the
+	// backfill objects are validated with the others.
+	backfill bool
 }
 
+// ContextColumn is a history column filled from an expression evaluated when
+// a version is written. DataType defaults to TEXT and Expression to the
+// session setting app.<name>, which the application sets with set_config.
+type ContextColumn struct {
+	Name       string
+	DataType   string
+	Expression string
+}
+
+// TableConfig overrides Config for a single table. Empty fields inherit the
+// global setting.
+type TableConfig struct {
+	// Retention overrides Config.Retention; "forever" keeps all history even
+	// when a global retention is set.
+	Retention string
+	// HistorySchema overrides Config.HistorySchema.
+	HistorySchema string
+	// BackfillFrom overrides Config.BackfillFrom; the column must exist.
+	BackfillFrom string
+	// Partitioning overrides Config.Partitioning; "none" keeps the history
+	// table unpartitioned even when partitioning is set globally.
+	Partitioning string
+	// ContextColumns replace Config.ContextColumns.
+	ContextColumns []ContextColumn
+	// Exclude leaves the table without history.
+	Exclude bool
+	// IgnoreColumns are left out of the history table. Updates that only
+	// change them record no new version.
+	IgnoreColumns []string
+}
+
+// ForTable returns the configuration in effect for the given table.
+func (c Config) ForTable(table Table) Config {
+	// Hash chains are ordered by version.
+	if c.HashChain {
+		c.Versioning = true
+	}
+
+	override := c.tableConfig(table)
+
+	if override.HistorySchema != "" {
+		c.HistorySchema = override.HistorySchema
+	}
+
+	if override.BackfillFrom != "" {
+		c.BackfillFrom = override.BackfillFrom
+	}
+
+	if override.Retention == "forever" {
+		c.Retention = ""
+	} else if override.Retention != "" {
+		c.Retention = override.Retention
+	}
+
+	if override.Partitioning == "none" {
+		c.Partitioning = ""
+	} else if override.Partitioning != "" {
+		c.Partitioning = override.Partitioning
+	}
+
+	if override.ContextColumns != nil {
+		c.ContextColumns = override.ContextColumns
+	}
+
+	return c
+}
+
+// tableConfig returns the per-table overrides of the table: its entry in
+// Tables, overridden by its annotations.
+func (c Config) tableConfig(table Table) TableConfig {
+	override, ok := c.Tables[GetOriginalTableName(table)]
+	if !ok {
+		override = c.Tables[table.Name]
+	}
+
+	annotations := table.Annotations
+	if annotations.Retention != "" {
+		override.Retention = annotations.Retention
+	}
+	if annotations.HistorySchema != "" {
+		override.HistorySchema = annotations.HistorySchema
+	}
+	if annotations.BackfillFrom != "" {
+		override.BackfillFrom = annotations.BackfillFrom
+	}
+	if annotations.Partitioning != "" {
+		override.Partitioning = annotations.Partitioning
+	}
+	if annotations.ContextColumns != nil {
+		override.ContextColumns = annotations.ContextColumns
+	}
+	if annotations.IgnoreColumns != nil {
+		override.IgnoreColumns = annotations.IgnoreColumns
+	}
+	override.Exclude = override.Exclude || annotations.Exclude
+
+	return override
+}
+
+// CheckTableConfig reports sections of Config.Tables that match none of the
+// tables, which are usually misspelled names. tables must be every table
+// read, including those the sections exclude.
+func CheckTableConfig(tables []Table, config Config) error {
+	matched := map[string]bool{}
+	for _, table := range tables {
+		matched[GetOriginalTableName(table)] = true
+		matched[table.Name] = true
+	}
+	for _, name := range sortedKeys(config.Tables) {
+		if !matched[name] {
+			return fmt.Errorf("tables.%s: no such table", name)
+		}
+	}
+	return nil
+}
+
+// ApplyTableConfig drops the tables excluded in config and removes the
+// ignored columns of the others, recording them in IgnoredColumns. Ignored
+// columns must exist and cannot be part of the primary key, and context
+// columns must not clash with the columns of a table. Partitioned tables need
+// Config.PartitionStart, so that the output does not depend on the date, and
+// hash-chained tables cannot have a retention.
+func ApplyTableConfig(tables []Table, config Config) ([]Table, error) {
+	var result []Table
+	for _, table := range tables {
+		override := config.tableConfig(table)
+		if override.Exclude {
+			continue
+		}
+
+		// Partitions named after the current date would change the output
+		// every month.
+		if isPartitioned(config.ForTable(table)) && config.PartitionStart.IsZero() {
+			return nil, fmt.Errorf("table %s: partitioning needs partition_start (--partition-start), the date of the first partition", GetOriginalTableName(table))
+		}
+
+		// Purging removes the start of a chain, after which it no longer
+		// verifies.
+		if tableConfig := config.ForTable(table); tableConfig.HashChain && tableConfig.Retention != "" {
+			return nil, fmt.Errorf("table %s: hash_chain (--hash-chain) cannot be combined with retention, since purged versions break the chain", GetOriginalTableName(table))
+		}
+
+		for _, col := range contextColumns(config.ForTable(table)) {
+			if hasColumn(table, col.Name) {
+				return nil, fmt.Errorf("table %s: context column %s conflicts with a column of the table", GetOriginalTableName(table), col.Name)
+			}
+		}
+
+		if len(override.IgnoreColumns) > 0 {
+			primaryKeys := GetPrimaryKeyColumns(table)
+			ignored := map[string]bool{}
+			for _, raw := range override.IgnoreColumns {
+				name, _ := parseIdentifier(raw)
+				if !hasColumn(table, name) {
+					return nil, fmt.Errorf("table %s: ignored column %s does not exist", GetOriginalTableName(table), name)
+				}
+				for _, pk := range primaryKeys {
+					if pk == name {
+						return nil, fmt.Errorf("table %s: primary key column %s cannot be ignored", GetOriginalTableName(table), name)
+					}
+				}
+				ignored[name] = true
+			}
+
+			columns := make([]Column, 0, len(table.Columns))
+			for _, col := range table.Columns {
+				if ignored[col.Name] {
+					table.IgnoredColumns = append(table.IgnoredColumns, col.Name)
+				} else {
+					columns = append(columns, col)
+				}
+			}
+			table.Columns = columns
+		}
+
+		result = append(result, table)
+	}
+	return result, nil
+}
+
+// hasColumn reports whether the table has a column with the given name.
+func hasColumn(table Table, name string) bool {
+	for _, col := range table.Columns {
+		if col.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Identifiers in Table, Column and ForeignKey hold the names PostgreSQL
+// uses: quoted identifiers as written, unquoted ones folded to lower case. The
+// Quoted fields record how they appeared in the input.
 type Table struct {
-	Name        string
-	SchemaName  string
-	FullName    string
-	Schema      string
-	Columns     []Column
-	ForeignKeys []ForeignKey
+	Name         string
+	SchemaName   string
+	FullName     string
+	Schema       string
+	Columns      []Column
+	ForeignKeys  []ForeignKey
+	PrimaryKey   []string
+	Quoted       bool
+	SchemaQuoted bool
+	// IgnoredColumns are source columns left out of history by
+	// ApplyTableConfig.
+	IgnoredColumns []string
+	// Annotations holds the settings of @history annotations in the input,
+	// which override Config.Tables for the table.
+	Annotations TableConfig
 }
 
 type Column struct {
 	Name     string
 	DataType string
 	Options  string
+	Quoted   bool
 }
 
+// ForeignKey describes a reference to another table. Multi-column keys list
+// their columns separated by ", ". Quoted is set when any of its identifiers
+// was quoted.
 type ForeignKey struct {
 	ColumnName       string
 	ReferencedTable  string
 	ReferencedColumn string
 	OnDelete         string
 	OnUpdate         string
+	Quoted           bool
 }
 
 func ParseCreateTables(sqlContent string) ([]Table, error) {
 	var tables []Table
 
-	tableRegex := regexp.MustCompile(`(?i)CREATE\s+TABLE\s+([^\s(]+)\s*\((.*?)\);`)
+	tableRegex := regexp.MustCompile(`(?i)CREATE\s+TABLE\s+((?:"(?:[^"]|"")*"|[^\s(".]+)(?:\.(?:"(?:[^"]|"")*"|[^\s(".]+))?)\s*\((.*?)\);`)
 
-	content := strings.ReplaceAll(sqlContent, "\n", " ")
-	content = strings.ReplaceAll(content, "\t", " ")
-	content = regexp.MustCompile(`\s+`).ReplaceAllString(content, " ")
+	// Comments are blanked out in place, so offsets still point into the
+	// input when annotations are matched to tables.
+	content, comments, statementEnds := stripComments(sqlContent)
 
 	createStart := regexp.MustCompile(`(?i)CREATE\s+TABLE\s+`)
 	starts := createStart.FindAllStringIndex(content, -1)
@@ -48,19 +306,21 @@ func ParseCreateTables(sqlContent string) ([]Table, error) {
 	for _, start := range starts {
 		tableEnd := findTableEnd(content, start[0])
 		if tableEnd > start[0] {
-			tableSQL := content[start[0]:tableEnd]
+			tableSQL := collapseWhitespace(content[start[0]:tableEnd])
 			match := tableRegex.FindStringSubmatch(tableSQL)
 			if len(match) >= 3 {
 				fullTableName := strings.Trim(match[1], "`\"[]")
 				columnsStr := match[2]
 
-				schemaName, tableName := parseTableName(fullTableName)
+				schemaName, tableName, schemaQuoted, quoted := parseTableName(match[1])
 
 				table := Table{
-					Name:       tableName,
-					SchemaName: schemaName,
-					FullName:   fullTableName,
-					Schema:     tableSQL,
+					Name:         tableName,
+					SchemaName:   schemaName,
+					FullName:     fullTableName,
+					Schema:       tableSQL,
+					Quoted:       quoted,
+					SchemaQuoted: schemaQuoted,
 				}
 
 				columns, foreignKeys, err := ParseColumns(columnsStr)
@@ -69,15 +329,36 @@ func ParseCreateTables(sqlContent string) ([]Table, error) {
 				}
 				table.Columns = columns
 				table.ForeignKeys = foreignKeys
+				table.PrimaryKey = parsePrimaryKeyConstraint(columnsStr)
+
+				previousEnd := 0
+				for _, end := range statementEnds {
+					if end < start[0] {
+						previousEnd = end + 1
+					}
+				}
+				if err := annotateTable(&table, content, comments, previousEnd, start[0], tableEnd); err != nil {
+					return nil, err
+				}
 
 				tables = append(tables, table)
 			}
 		}
 	}
 
+	if err := annotateFromCommentOn(tables, content); err != nil {
+		return nil, err
+	}
+
 	return tables, nil
 }
 
+// collapseWhitespace joins the lines of a statement and collapses runs of
+// whitespace to single spaces.
+func collapseWhitespace(sql string) string {
+	return regexp.MustCompile(`\s+`).ReplaceAllString(sql, " ")
+}
+
 func findTableEnd(content string, start int) int {
 	parenCount := 0
 	inQuotes := false
@@ -112,12 +393,27 @@ func findTableEnd(content string, start int) int {
 	return len(content)
 }
 
-func parseTableName(fullTableName string) (string, string) {
-	parts := strings.Split(fullTableName, ".")
+// parseTableName splits a possibly schema-qualified table name into schema and
+// table, reporting for each whether it was quoted.
+func parseTableName(fullTableName string) (string, string, bool, bool) {
+	parts := splitQualifiedName(fullTableName)
 	if len(parts) == 2 {
-		return strings.Trim(parts[0], "`\"[]"), strings.Trim(parts[1], "`\"[]")
+		schemaName, schemaQuoted := parseIdentifier(parts[0])
+		tableName, quoted := parseIdentifier(parts[1])
+		return schemaName, tableName, schemaQuoted, quoted
+	}
+	tableName, quoted := parseIdentifier(fullTableName)
+	return "", tableName, false, quoted
+}
+
+// parseQualifiedName normalizes a possibly schema-qualified name to the form
+// returned by GetOriginalTableName.
+func parseQualifiedName(name string) (string, bool) {
+	schemaName, tableName, schemaQuoted, quoted := parseTableName(name)
+	if schemaName != "" {
+		return schemaName + "." + tableName, schemaQuoted || quoted
 	}
-	return "", strings.Trim(fullTableName, "`\"[]")
+	return tableName, quoted
 }
 
 func ParseColumns(columnsStr string) ([]Column, []ForeignKey, error) {
@@ -148,16 +444,18 @@ func ParseColumns(columnsStr string) ([]Column, []ForeignKey, error) {
 			continue
 		}
 
-		colName, dataType, options := parseColumnDefinition(line)
+		colName, dataType, options, quoted := parseColumnDefinition(line)
 		if colName != "" && dataType != "" {
 			columns = append(columns, Column{
 				Name:     colName,
 				DataType: dataType,
 				Options:  options,
+				Quoted:   quoted,
 			})
 
 			fk := extractInlineForeignKey(colName, options)
 			if fk.ColumnName != "" {
+				fk.Quoted = fk.Quoted || quoted
 				foreignKeys = append(foreignKeys, fk)
 			}
 		}
@@ -212,20 +510,17 @@ func splitColumns(columnsStr string) []string {
 	return result
 }
 
-func parseColumnDefinition(line string) (string, string, string) {
-	line = strings.TrimSpace(line)
-
-	spaceIdx := strings.Index(line, " ")
-	if spaceIdx == -1 {
-		return "", "", ""
+func parseColumnDefinition(line string) (string, string, string, bool) {
+	rawName, rest := splitIdentifier(line)
+	if rest == "" {
+		return "", "", "", false
 	}
 
-	colName := strings.Trim(line[:spaceIdx], "`\"[]")
-	rest := strings.TrimSpace(line[spaceIdx+1:])
+	colName, quoted := parseIdentifier(rawName)
 
 	dataType, options := extractDataType(rest)
 
-	return colName, dataType, options
+	return colName, dataType, options, quoted
 }
 
 func extractDataType(rest string) (string, string) {
@@ -269,14 +564,30 @@ func extractDataType(rest string) (string, string) {
 	return dataType, options
 }
 
+func parsePrimaryKeyConstraint(columnsStr string) []string {
+	pkRegex := regexp.MustCompile(`(?i)^(?:CONSTRAINT\s+\S+\s+)?PRIMARY\s+KEY\s*\(([^)]+)\)`)
+
+	for _, line := range splitColumns(columnsStr) {
+		match := pkRegex.FindStringSubmatch(strings.TrimSpace(line))
+		if len(match) < 2 {
+			continue
+		}
+
+		columns, _ := parseIdentifierList(match[1])
+		return columns
+	}
+
+	return nil
+}
+
 func parseForeignKeyConstraint(line string) ForeignKey {
 	fkRegex := regexp.MustCompile(`(?i)FOREIGN\s+KEY\s*\(\s*([^)]+)\s*\)\s+REFERENCES\s+([^\s(]+)\s*\(\s*([^)]+)\s*\)(?:\s+ON\s+DELETE\s+((?:SET\s+NULL|SET\s+DEFAULT|RESTRICT|CASCADE|NO\s+ACTION|\w+)))?(?:\s+ON\s+UPDATE\s+((?:SET\s+NULL|SET\s+DEFAULT|RESTRICT|CASCADE|NO\s+ACTION|\w+)))?`)
 
 	match := fkRegex.FindStringSubmatch(line)
 	if len(match) >= 4 {
-		columnName := strings.TrimSpace(strings.Trim(match[1], "`\"[]"))
-		referencedTable := strings.TrimSpace(strings.Trim(match[2], "`\"[]"))
-		referencedColumn := strings.TrimSpace(strings.Trim(match[3], "`\"[]"))
+		columnNames, columnQuoted := parseIdentifierList(match[1])
+		referencedTable, tableQuoted := parseQualifiedName(match[2])
+		referencedColumns, referencedQuoted := parseIdentifierList(match[3])
 
 		onDelete := ""
 		if len(match) > 4 && match[4] != "" {
@@ -289,11 +600,12 @@ func parseForeignKeyConstraint(line string) ForeignKey {
 		}
 
 		return ForeignKey{
-			ColumnName:       columnName,
+			ColumnName:       strings.Join(columnNames, ", "),
 			ReferencedTable:  referencedTable,
-			ReferencedColumn: referencedColumn,
+			ReferencedColumn: strings.Join(referencedColumns, ", "),
 			OnDelete:         onDelete,
 			OnUpdate:         onUpdate,
+			Quoted:           columnQuoted || tableQuoted || referencedQuoted,
 		}
 	}
 
@@ -305,8 +617,8 @@ func extractInlineForeignKey(columnName, options string) ForeignKey {
 
 	match := referencesRegex.FindStringSubmatch(options)
 	if len(match) >= 3 {
-		referencedTable := strings.TrimSpace(strings.Trim(match[1], "`\"[]"))
-		referencedColumn := strings.TrimSpace(strings.Trim(match[2], "`\"[]"))
+		referencedTable, tableQuoted := parseQualifiedName(match[1])
+		referencedColumns, referencedQuoted := parseIdentifierList(match[2])
 
 		onDelete := ""
 		if len(match) > 3 && match[3] != "" {
@@ -321,9 +633,10 @@ func extractInlineForeignKey(columnName, options string) ForeignKey {
 		return ForeignKey{
 			ColumnName:       columnName,
 			ReferencedTable:  referencedTable,
-			ReferencedColumn: referencedColumn,
+			ReferencedColumn: strings.Join(referencedColumns, ", "),
 			OnDelete:         onDelete,
 			OnUpdate:         onUpdate,
+			Quoted:           tableQuoted || referencedQuoted,
 		}
 	}
 
@@ -1,10 +1,13 @@
 package parser
 
 import (
+	"fmt"
 	"io"
 	"os"
 	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 )
 
 func TestParseCreateTables(t *testing.T) {
@@ -178,6 +181,1362 @@ func TestGenerateTriggers(t *testing.T) {
 	}
 }
 
+func TestGenerateHistoryIDAndVersioning(t *testing.T) {
+	table := Table{
+		Name: "orders",
+		Columns: []Column{
+			{Name: "order_id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+			{Name: "total", DataType: "DECIMAL(10,2)", Options: "NOT NULL"},
+		},
+	}
+
+	config := Config{UserSource: "current_user", HistoryID: true, Versioning: true}
+	result := GenerateHistoryTable(table, config) + GenerateTriggers(table, config)
+
+	expectedContains := []string{
+		"history_id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY",
+		"version INTEGER NOT NULL",
+		"CREATE UNIQUE INDEX idx_orders_history_version ON orders_history (order_id, version)",
+		"INSERT INTO orders_history (order_id, total, valid_from, operation, version)",
+		"(SELECT COALESCE(MAX(version), 0) + 1 FROM orders_history WHERE order_id = NEW.order_id)",
+		"(SELECT COALESCE(MAX(version), 0) + 1 FROM orders_history WHERE order_id = OLD.order_id)",
+	}
+
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	plain := GenerateHistoryTable(table, Config{UserSource: "current_user"})
+	if strings.Contains(plain, "history_id") || strings.Contains(plain, "version") {
+		t.Errorf("Expected no history_id or version columns without options, got:\n%s", plain)
+	}
+}
+
+func TestGenerateHistoryIndexes(t *testing.T) {
+	tables, err := ParseCreateTables(`
+		CREATE TABLE order_items (
+			order_id INTEGER NOT NULL,
+			line_no INTEGER NOT NULL,
+			quantity INTEGER NOT NULL,
+			CONSTRAINT order_items_pkey PRIMARY KEY (order_id, line_no)
+		);
+	`)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	result := GenerateHistoryIndexes(tables[0], Config{IndexStrategy: "brin"})
+
+	expectedContains := []string{
+		"CREATE INDEX idx_order_items_history_valid_from ON order_items_history USING brin (valid_from);",
+		"CREATE INDEX idx_order_items_history_valid_to ON order_items_history USING brin (valid_to);",
+		"CREATE UNIQUE INDEX idx_order_items_history_current ON order_items_history (order_id, line_no) WHERE valid_to IS NULL;",
+		"CREATE INDEX idx_order_items_history_pk_valid_from ON order_items_history (order_id, line_no, valid_from);",
+	}
+
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	// With a unique open row per key, an update moving a row to the key of a
+	// deleted one must close that key's open 'D' row first.
+	update := TriggerFunctionBody(tables[0], Config{}, "update")
+	if !strings.Contains(update, "WHERE valid_to IS NULL AND order_id = NEW.order_id AND line_no = NEW.line_no;") {
+		t.Errorf("Expected update to close the open row of the new key, got:\n%s", update)
+	}
+
+	noKey := Table{Name: "events", Columns: []Column{{Name: "payload", DataType: "TEXT"}}}
+	result = GenerateHistoryIndexes(noKey, Config{})
+	if !strings.Contains(result, "CREATE INDEX idx_events_history_current ON events_history (payload) WHERE valid_to IS NULL;") {
+		t.Errorf("Expected non-unique current index for table without primary key, got:\n%s", result)
+	}
+
+	result = GenerateHistoryIndexes(noKey, Config{Versioning: true})
+	if !strings.Contains(result, "CREATE INDEX idx_events_history_version ON events_history (payload, version);") {
+		t.Errorf("Expected non-unique version index for table without primary key, got:\n%s", result)
+	}
+
+	// The fallback key of a table without a primary key is shared by other
+	// live rows, so inserting must not close their open versions.
+	events := Table{Name: "events", Columns: []Column{
+		{Name: "account_id", DataType: "INTEGER", Options: "NOT NULL"},
+		{Name: "payload", DataType: "TEXT"},
+	}}
+	if insert := TriggerFunctionBody(events, Config{}, "insert"); strings.Contains(insert, "UPDATE events_history") {
+		t.Errorf("Expected insert on a table without primary key to close no rows, got:\n%s", insert)
+	}
+	if update := TriggerFunctionBody(events, Config{}, "update"); strings.Contains(update, "NEW.account_id;") {
+		t.Errorf("Expected update on a table without primary key to close only the old row, got:\n%s", update)
+	}
+	if insert := TriggerFunctionBody(tables[0], Config{}, "insert"); !strings.Contains(insert, "WHERE valid_to IS NULL AND order_id = NEW.order_id AND line_no = NEW.line_no;") {
+		t.Errorf("Expected insert to close the open 'D' row of a reused key, got:\n%s", insert)
+	}
+}
+
+func TestGeneratePartitionedHistoryTable(t *testing.T) {
+	table := Table{
+		Name:       "users",
+		SchemaName: "app",
+		Columns: []Column{
+			{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+			{Name: "username", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+		},
+	}
+
+	config := Config{
+		HistoryID:      true,
+		Partitioning:   "year",
+		PartitionStart: time.Date(2024, time.June, 15, 0, 0, 0, 0, time.UTC),
+		PartitionCount: 2,
+	}
+	result := GenerateHistoryTable(table, config)
+
+	expectedContains := []string{
+		"history_id BIGINT GENERATED ALWAYS AS IDENTITY,",
+		"PRIMARY KEY (history_id, valid_from)\n) PARTITION BY RANGE (valid_from);",
+		"CREATE TABLE app.users_history_p2024 PARTITION OF app.users_history\n    FOR VALUES FROM ('2024-01-01') TO ('2025-01-01');",
+		"CREATE TABLE app.users_history_p2025 PARTITION OF app.users_history\n    FOR VALUES FROM ('2025-01-01') TO ('2026-01-01');",
+		"CREATE TABLE app.users_history_default PARTITION OF app.users_history DEFAULT;",
+		"CREATE INDEX idx_app_users_history_current ON app.users_history (id) WHERE valid_to IS NULL;",
+		"CREATE OR REPLACE FUNCTION app_users_partition_history(start_date DATE, partition_count INTEGER DEFAULT 1)",
+		"partition_name := 'users_history_p' || to_char(partition_start, 'YYYY');",
+		"'app.' || quote_ident(partition_name), 'app.users_history', partition_start, partition_end);",
+	}
+
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	if strings.Contains(result, "UNIQUE") {
+		t.Errorf("Expected no unique indexes on a partitioned history table, got:\n%s", result)
+	}
+}
+
+func TestGeneratePurgeFunctions(t *testing.T) {
+	tables := []Table{
+		{Name: "users", Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+		{Name: "orders", SchemaName: "sales", Columns: []Column{{Name: "order_id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+		{Name: "audit_log", Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+	}
+
+	config := Config{
+		Retention: "7 years",
+		Tables: map[string]TableConfig{
+			"sales.orders": {Retention: "10 years"},
+			"audit_log":    {Retention: "forever"},
+		},
+	}
+
+	users := GeneratePurgeFunction(tables[0], config)
+	expectedContains := []string{
+		"CREATE OR REPLACE FUNCTION users_purge_history(older_than INTERVAL DEFAULT '7 years') RETURNS BIGINT",
+		"DELETE FROM users_history\n    WHERE valid_to IS NOT NULL AND valid_to < cutoff;",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(users, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	if orders := GeneratePurgeFunction(tables[1], config); !strings.Contains(orders, "sales_orders_purge_history(older_than INTERVAL DEFAULT '10 years')") {
+		t.Errorf("Expected per-table retention for sales.orders, got:\n%s", orders)
+	}
+
+	if auditLog := GeneratePurgeFunction(tables[2], config); auditLog != "" {
+		t.Errorf("Expected no purge function for a table kept forever, got:\n%s", auditLog)
+	}
+
+	all := GeneratePurgeAllFunction(tables, config)
+	if !strings.Contains(all, "purge_history(older_than INTERVAL DEFAULT NULL)") ||
+		!strings.Contains(all, "sales_orders_purge_history(COALESCE(older_than, '10 years'))") ||
+		strings.Contains(all, "audit_log") {
+		t.Errorf("Unexpected purge_history function:\n%s", all)
+	}
+
+	partitioned := GeneratePurgeFunction(tables[0], Config{Retention: "1 year", Partitioning: "month"})
+	if !strings.Contains(partitioned, "EXECUTE format('DROP TABLE %s', part.name);") {
+		t.Errorf("Expected partition drop logic for partitioned history, got:\n%s", partitioned)
+	}
+}
+
+func TestGenerateProtection(t *testing.T) {
+	table := Table{
+		Name: "users",
+		Columns: []Column{
+			{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+			{Name: "username", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+		},
+	}
+
+	config := Config{TrackUser: true, UserSource: "current_user", AppendOnly: true, HistoryOwner: "history_owner", Retention: "1 year"}
+	result := GenerateProtection(table, config)
+
+	expectedContains := []string{
+		"CREATE OR REPLACE FUNCTION users_protect_history() RETURNS TRIGGER",
+		"IF TG_OP = 'UPDATE' AND pg_trigger_depth() > 1",
+		"AND ROW(NEW.id, NEW.username, NEW.valid_from, NEW.operation, NEW.changed_by) IS NOT DISTINCT FROM ROW(OLD.id, OLD.username, OLD.valid_from, OLD.operation, OLD.changed_by) THEN",
+		"IF TG_OP = 'DELETE' AND current_setting('sql_history.purge', true) = 'on'\n        AND current_user = (SELECT pg_get_userbyid(relowner) FROM pg_class WHERE oid = 'users_history'::regclass) THEN",
+		"BEFORE UPDATE OR DELETE ON users_history",
+		"BEFORE TRUNCATE ON users_history",
+		"REVOKE INSERT, UPDATE, DELETE, TRUNCATE ON users_history FROM PUBLIC;",
+		"REVOKE EXECUTE ON FUNCTION users_purge_history(INTERVAL) FROM PUBLIC;",
+		"ALTER TABLE users_history OWNER TO history_owner;",
+		"ALTER FUNCTION users_insert_history() OWNER TO history_owner;",
+		"ALTER FUNCTION users_purge_history(INTERVAL) OWNER TO history_owner;",
+	}
+
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	triggers := GenerateTriggers(table, config)
+	if !strings.Contains(triggers, "$$ LANGUAGE plpgsql SECURITY DEFINER SET search_path FROM CURRENT;") {
+		t.Errorf("Expected SECURITY DEFINER trigger functions, got:\n%s", triggers)
+	}
+	if !strings.Contains(triggers, "'I', session_user)") {
+		t.Errorf("Expected session_user for changed_by inside SECURITY DEFINER functions, got:\n%s", triggers)
+	}
+
+	if result := GenerateProtection(table, Config{}); result != "" {
+		t.Errorf("Expected no protection by default, got:\n%s", result)
+	}
+}
+
+func TestGenerateHashChain(t *testing.T) {
+	table := Table{
+		Name: "accounts",
+		Columns: []Column{
+			{Name: "id", DataType: "INTEGER", Options: "PRIMARY KEY"},
+			{Name: "balance", DataType: "NUMERIC(12,2)", Options: "NOT NULL"},
+		},
+	}
+
+	config := Config{HashChain: true, HistoryID: true}
+	result := GenerateHistoryTable(table, config)
+
+	hash := "digest(COALESCE(encode(previous_hash, 'hex'), '') || '|' || concat_ws(',', quote_nullable(NEW.id), quote_nullable(NEW.balance), " +
+		"quote_nullable(NEW.valid_from), quote_nullable(NEW.operation), quote_nullable(NEW.version)), 'sha256')"
+	expectedContains := []string{
+		"version INTEGER NOT NULL",
+		"row_hash BYTEA NOT NULL",
+		"CREATE OR REPLACE FUNCTION accounts_hash_history() RETURNS TRIGGER",
+		"WHERE id = NEW.id AND version < NEW.version",
+		"NEW.row_hash := " + hash + ";",
+		"SET TimeZone TO 'UTC'",
+		"BEFORE INSERT ON accounts_history",
+	}
+
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	query := GenerateChainVerificationQuery(table, config)
+	expectedQuery := []string{
+		"concat_ws(', ', 'id' || '=' || quote_nullable(h.id)) AS chain_key",
+		"digest(COALESCE(encode(lag(h.row_hash) OVER chain, 'hex'), '') || '|' || concat_ws(',', quote_nullable(h.id),",
+		"FROM accounts_history h",
+		"WINDOW chain AS (PARTITION BY h.id ORDER BY h.version)",
+		"WHERE row_hash IS DISTINCT FROM expected_hash OR version <> COALESCE(previous_version, 0) + 1",
+	}
+	for _, expected := range expectedQuery {
+		if !strings.Contains(query, expected) {
+			t.Errorf("Expected verification query to contain '%s', got:\n%s", expected, query)
+		}
+	}
+
+	sql, err := GenerateHistorySQL([]Table{table}, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !strings.Contains(sql, "CREATE EXTENSION IF NOT EXISTS pgcrypto;") {
+		t.Errorf("Expected pgcrypto extension in generated SQL")
+	}
+}
+
+func TestGenerateWithHistorySchema(t *testing.T) {
+	tables := []Table{
+		{
+			Name:       "users",
+			SchemaName: "public",
+			Columns: []Column{
+				{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+				{Name: "username", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+			},
+		},
+		{
+			Name:       "orders",
+			SchemaName: "sales",
+			Columns:    []Column{{Name: "order_id", DataType: "SERIAL", Options: "PRIMARY KEY"}},
+		},
+	}
+
+	config := Config{
+		UserSource:    "current_user",
+		HistorySchema: "audit",
+		Tables:        map[string]TableConfig{"sales.orders": {HistorySchema: "sales_audit"}},
+	}
+
+	if got := GetHistoryTableName(tables[0], config); got != "audit.users_history" {
+		t.Errorf("GetHistoryTableName() = %v, want audit.users_history", got)
+	}
+	if got := GetHistoryTableName(tables[1], config); got != "sales_audit.orders_history" {
+		t.Errorf("GetHistoryTableName() = %v, want sales_audit.orders_history", got)
+	}
+
+	result, err := GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedContains := []string{
+		"CREATE SCHEMA IF NOT EXISTS audit;",
+		"CREATE SCHEMA IF NOT EXISTS sales_audit;",
+		"CREATE TABLE audit.users_history (",
+		"CREATE INDEX idx_public_users_history_valid_from ON audit.users_history (valid_from);",
+		"CREATE OR REPLACE FUNCTION audit.public_users_insert_history() RETURNS TRIGGER",
+		"UPDATE audit.users_history SET valid_to = CURRENT_TIMESTAMP",
+		"AFTER INSERT ON public.users",
+		"EXECUTE FUNCTION audit.public_users_insert_history();",
+		"CREATE TABLE sales_audit.orders_history (",
+		"EXECUTE FUNCTION sales_audit.sales_orders_delete_history();",
+	}
+
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+}
+
+func TestGenerateWithNamingTemplates(t *testing.T) {
+	tables := []Table{
+		{
+			Name:       "users",
+			SchemaName: "app",
+			Columns: []Column{
+				{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+				{Name: "username", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+			},
+		},
+	}
+
+	config := Config{
+		UserSource: "current_user",
+		Naming: Naming{
+			HistoryTable: "hist_{{.Table}}",
+			Function:     "{{.Table}}_{{.Operation}}_fn",
+			Trigger:      "trg_{{.Table}}_{{.Operation}}",
+			Index:        "{{.Table}}_{{.Operation}}_idx",
+		},
+	}
+
+	result, err := GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedContains := []string{
+		"CREATE TABLE app.hist_users (",
+		"CREATE INDEX users_valid_from_idx ON app.hist_users (valid_from);",
+		"CREATE UNIQUE INDEX users_current_idx ON app.hist_users (id) WHERE valid_to IS NULL;",
+		"CREATE OR REPLACE FUNCTION users_insert_fn() RETURNS TRIGGER",
+		"CREATE TRIGGER trg_users_update",
+		"EXECUTE FUNCTION users_delete_fn();",
+	}
+
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+}
+
+func TestValidateNames(t *testing.T) {
+	tables := []Table{
+		{Name: "users", SchemaName: "app", Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+		{Name: "users", SchemaName: "billing", Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+	}
+
+	tests := []struct {
+		name    string
+		naming  Naming
+		wantErr bool
+	}{
+		{"defaults", Naming{}, false},
+		{"schema-qualified functions", Naming{Function: "{{.Schema}}_{{.Table}}_{{.Operation}}"}, false},
+		{"functions missing schema", Naming{Function: "{{.Table}}_{{.Operation}}"}, true},
+		{"triggers missing operation", Naming{Trigger: "{{.Table}}_trigger"}, true},
+		{"indexes missing operation", Naming{Index: "idx_{{.Schema}}_{{.Table}}"}, true},
+		{"history table named like source", Naming{HistoryTable: "{{.Table}}"}, true},
+		{"unparsable template", Naming{HistoryTable: "{{.Table"}, true},
+		{"unknown field", Naming{Index: "{{.Column}}"}, true},
+		{"empty name", Naming{Trigger: "{{if false}}x{{end}}"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateNames(tables, Config{Naming: tt.naming})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateNames() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLongIdentifiersAreShortened(t *testing.T) {
+	schema := "very_long_schema_name_for_reporting"
+	tables := []Table{
+		{Name: "customer_subscription_events_a", SchemaName: schema, Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+		{Name: "customer_subscription_events_b", SchemaName: schema, Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+	}
+	config := Config{
+		Partitioning:   "month",
+		PartitionStart: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		PartitionCount: 1,
+	}
+
+	if err := ValidateNames(tables, config); err != nil {
+		t.Fatalf("Expected shortened names not to collide, got: %v", err)
+	}
+
+	first := getFunctionName(tables[0], config, "update")
+	second := getFunctionName(tables[1], config, "update")
+	if len(first) > 63 || len(second) > 63 {
+		t.Errorf("Expected names of at most 63 bytes, got %q and %q", first, second)
+	}
+	if first == second {
+		t.Errorf("Expected distinct names for distinct tables, both are %q", first)
+	}
+	if again := getFunctionName(tables[0], config, "update"); again != first {
+		t.Errorf("Expected a deterministic name, got %q and %q", first, again)
+	}
+	if !strings.HasPrefix(first, schema+"_customer_") {
+		t.Errorf("Expected the shortened name to keep its prefix, got %q", first)
+	}
+
+	names, err := GeneratedNames(tables[0], config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	shortened := 0
+	for _, name := range names {
+		if name.Shortened() {
+			shortened++
+			if len(name.Name) != 63 || len(name.Full) <= 63 {
+				t.Errorf("Unexpected shortening of %q to %q", name.Full, name.Name)
+			}
+		}
+	}
+	if shortened == 0 {
+		t.Error("Expected GeneratedNames to report shortened names")
+	}
+
+	if got := GetHistoryTableName(tables[0], config); got != schema+".customer_subscription_events_a_history" {
+		t.Errorf("Expected short names to be kept, got %q", got)
+	}
+
+	if got := shortenIdentifier(strings.Repeat("ä", 40)); len(got) > 63 || !utf8.ValidString(got) {
+		t.Errorf("Expected a valid UTF-8 name within 63 bytes, got %q", got)
+	}
+}
+
+func TestGenerateIdempotent(t *testing.T) {
+	tables := []Table{
+		{Name: "users", Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+		{Name: "orders", SchemaName: "sales", Columns: []Column{{Name: "order_id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+	}
+
+	config := Config{UserSource: "current_user", AppendOnly: true, Idempotent: true}
+	result, err := GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedContains := []string{
+		"BEGIN;\n\nCREATE TABLE IF NOT EXISTS users_history (",
+		"CREATE INDEX IF NOT EXISTS idx_users_history_valid_from ON users_history (valid_from);",
+		"CREATE UNIQUE INDEX IF NOT EXISTS idx_users_history_current ON users_history (id) WHERE valid_to IS NULL;",
+		"DROP TRIGGER IF EXISTS users_insert_trigger ON users;\nCREATE TRIGGER users_insert_trigger\n",
+		"DROP TRIGGER IF EXISTS users_protect_trigger ON users_history;\nCREATE TRIGGER users_protect_trigger\n",
+		"DROP TRIGGER IF EXISTS sales_orders_delete_trigger ON sales.orders;\nCREATE TRIGGER sales_orders_delete_trigger\n",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	if got := strings.Count(result, "CREATE TRIGGER"); got != strings.Count(result, "DROP TRIGGER IF EXISTS") {
+		t.Errorf("Expected every trigger to be dropped first, got %d CREATE TRIGGER statements", got)
+	}
+	if strings.Count(result, "BEGIN;\n") != 2 || strings.Count(result, "COMMIT;\n") != 2 {
+		t.Errorf("Expected one transaction per table, got:\n%s", result)
+	}
+
+	plain, err := GenerateHistorySQL(tables, Config{UserSource: "current_user"})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if strings.Contains(plain, "IF NOT EXISTS") || strings.Contains(plain, "BEGIN;") {
+		t.Errorf("Expected no idempotent clauses by default")
+	}
+}
+
+func TestSortTablesByDependency(t *testing.T) {
+	tables := []Table{
+		{Name: "order_items", ForeignKeys: []ForeignKey{{ColumnName: "order_id", ReferencedTable: "sales.orders"}, {ColumnName: "product_id", ReferencedTable: "products"}}},
+		{Name: "orders", SchemaName: "sales", ForeignKeys: []ForeignKey{{ColumnName: "user_id", ReferencedTable: "users"}}},
+		{Name: "users"},
+		{Name: "products"},
+		{Name: "audit_log", ForeignKeys: []ForeignKey{{ColumnName: "external_id", ReferencedTable: "elsewhere"}}},
+	}
+
+	var names []string
+	for _, table := range SortTablesByDependency(tables) {
+		names = append(names, GetOriginalTableName(table))
+	}
+
+	expected := "users,products,audit_log,sales.orders,order_items"
+	if got := strings.Join(names, ","); got != expected {
+		t.Errorf("SortTablesByDependency() = %v, want %v", got, expected)
+	}
+
+	cyclic := []Table{
+		{Name: "a", ForeignKeys: []ForeignKey{{ColumnName: "b_id", ReferencedTable: "b"}}},
+		{Name: "b", ForeignKeys: []ForeignKey{{ColumnName: "a_id", ReferencedTable: "a"}}},
+	}
+	if got := SortTablesByDependency(cyclic); len(got) != 2 || got[0].Name != "a" || got[1].Name != "b" {
+		t.Errorf("Expected tables in a cycle to keep their order, got %v", got)
+	}
+
+	unresolved := UnresolvedReferences(tables)
+	if len(unresolved) != 1 || unresolved[0].Table != "audit_log" || unresolved[0].ForeignKey.ReferencedTable != "elsewhere" {
+		t.Fatalf("Expected only audit_log.external_id to be unresolved, got %v", unresolved)
+	}
+	if got := unresolved[0].String(); got != "audit_log (external_id) references elsewhere, which is not in the input" {
+		t.Errorf("Unexpected message: %s", got)
+	}
+	if got := UnresolvedReferences(cyclic); len(got) != 0 {
+		t.Errorf("Expected references within the table set to resolve, got %v", got)
+	}
+}
+
+func TestGenerateDownSQL(t *testing.T) {
+	tables := []Table{
+		{Name: "users", Columns: []Column{{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"}}},
+		{
+			Name:        "orders",
+			Columns:     []Column{{Name: "order_id", DataType: "SERIAL", Options: "PRIMARY KEY"}},
+			ForeignKeys: []ForeignKey{{ColumnName: "user_id", ReferencedTable: "users", ReferencedColumn: "id"}},
+		},
+	}
+	config := Config{UserSource: "current_user", AppendOnly: true, Retention: "1 year"}
+
+	result, err := GenerateDownSQL(tables, config, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedContains := []string{
+		"BEGIN;",
+		"DROP FUNCTION IF EXISTS purge_history(INTERVAL);",
+		"DROP TRIGGER IF EXISTS users_insert_trigger ON users;",
+		"DROP TRIGGER IF EXISTS users_protect_trigger ON users_history;",
+		"DROP FUNCTION IF EXISTS users_protect_history();",
+		"DROP FUNCTION IF EXISTS orders_purge_history(INTERVAL);",
+		"COMMIT;",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	if strings.Contains(result, "DROP TABLE") {
+		t.Errorf("Expected history tables to be kept without dropHistory")
+	}
+	if strings.Index(result, "Remove history for: orders") > strings.Index(result, "Remove history for: users") {
+		t.Errorf("Expected referencing tables to be removed first")
+	}
+
+	result, err = GenerateDownSQL(tables, config, true)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	dropTable := strings.Index(result, "DROP TABLE IF EXISTS users_history;")
+	if dropTable == -1 {
+		t.Fatalf("Expected history table to be dropped with dropHistory")
+	}
+	if dropTable > strings.Index(result, "DROP FUNCTION IF EXISTS users_protect_history();") {
+		t.Errorf("Expected the history table to be dropped before the functions its triggers use")
+	}
+}
+
+func TestDiffColumns(t *testing.T) {
+	oldTable := Table{Name: "users", Columns: []Column{
+		{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+		{Name: "name", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+		{Name: "age", DataType: "INTEGER"},
+		{Name: "legacy", DataType: "TEXT", Options: "NOT NULL"},
+		{Name: "nickname", DataType: "TEXT", Options: "NOT NULL"},
+	}}
+	newTable := Table{Name: "users", Columns: []Column{
+		{Name: "id", DataType: "serial", Options: "PRIMARY KEY"},
+		{Name: "full_name", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+		{Name: "age", DataType: "BIGINT"},
+		{Name: "nickname", DataType: "TEXT"},
+		{Name: "email", DataType: "VARCHAR(100)", Options: "NOT NULL"},
+	}}
+
+	expected := []ColumnChange{
+		{Kind: "rename", Name: "full_name", OldName: "name", DataType: "VARCHAR(50)"},
+		{Kind: "type", Name: "age", OldName: "age", DataType: "BIGINT"},
+		{Kind: "drop not null", Name: "nickname", OldName: "nickname", DataType: "TEXT"},
+		{Kind: "drop", Name: "legacy", OldName: "legacy", DataType: "TEXT"},
+		{Kind: "add", Name: "email", DataType: "VARCHAR(100)"},
+	}
+
+	changes := DiffColumns(oldTable, newTable, map[string]string{"name": "full_name"})
+	if len(changes) != len(expected) {
+		t.Fatalf("Expected %d changes, got %d: %+v", len(expected), len(changes), changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Errorf("Change %d: expected %+v, got %+v", i, expected[i], changes[i])
+		}
+	}
+
+	// Without a rename, a column replaced at the same position with the same
+	// type is dropped and added
+	changes = DiffColumns(oldTable, newTable, nil)
+	for _, change := range changes {
+		if change.Kind == "rename" {
+			t.Errorf("Expected no rename without being asked, got %+v", change)
+		}
+	}
+	if !containsChange(changes, ColumnChange{Kind: "drop", Name: "name", OldName: "name", DataType: "VARCHAR(50)"}) ||
+		!containsChange(changes, ColumnChange{Kind: "add", Name: "full_name", DataType: "VARCHAR(50)"}) {
+		t.Errorf("Expected name to be dropped and full_name added, got %+v", changes)
+	}
+
+	if changes := DiffColumns(oldTable, oldTable, nil); len(changes) != 0 {
+		t.Errorf("Expected no changes for identical tables, got %+v", changes)
+	}
+}
+
+func containsChange(changes []ColumnChange, change ColumnChange) bool {
+	for _, c := range changes {
+		if c == change {
+			return true
+		}
+	}
+	return false
+}
+
+func TestGenerateMigrationSQL(t *testing.T) {
+	oldTables := []Table{
+		{Name: "users", Columns: []Column{
+			{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+			{Name: "name", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+		}},
+		{Name: "gone", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}},
+		{Name: "same", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}},
+	}
+	newTables := []Table{
+		{Name: "users", Columns: []Column{
+			{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+			{Name: "name", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+			{Name: "email", DataType: "VARCHAR(100)", Options: "NOT NULL"},
+		}},
+		{Name: "fresh", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}},
+		{Name: "same", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}},
+	}
+
+	config := Config{UserSource: "current_user", AppendOnly: true}
+	result, err := GenerateMigrationSQL(oldTables, newTables, config, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedContains := []string{
+		"BEGIN;",
+		"ALTER TABLE users_history ADD COLUMN IF NOT EXISTS email VARCHAR(100);",
+		"CREATE OR REPLACE FUNCTION users_insert_history() RETURNS TRIGGER",
+		"INSERT INTO users_history (id, name, email, valid_from, operation)",
+		"CREATE OR REPLACE FUNCTION users_protect_history() RETURNS TRIGGER",
+		"CREATE TABLE fresh_history (",
+		"CREATE TRIGGER fresh_insert_trigger",
+		"-- gone was removed; gone_history is kept\nDROP TRIGGER IF EXISTS gone_insert_trigger ON gone;\nDROP TRIGGER IF EXISTS gone_update_trigger ON gone;\nDROP TRIGGER IF EXISTS gone_delete_trigger ON gone;\nDROP FUNCTION IF EXISTS gone_insert_history();",
+		"COMMIT;",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+
+	unexpected := []string{"same_history", "CREATE TRIGGER users_", "DROP TABLE"}
+	for _, text := range unexpected {
+		if strings.Contains(result, text) {
+			t.Errorf("Expected result not to contain '%s'", text)
+		}
+	}
+
+	result, err = GenerateMigrationSQL(oldTables, oldTables, config, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !strings.Contains(result, "-- No schema changes") || strings.Contains(result, "BEGIN;") {
+		t.Errorf("Expected an empty migration for unchanged tables, got:\n%s", result)
+	}
+
+	renamedTables := []Table{
+		{Name: "users", Columns: []Column{
+			{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+			{Name: "full_name", DataType: "VARCHAR(50)", Options: "NOT NULL"},
+		}},
+	}
+	result, err = GenerateMigrationSQL(oldTables[:1], renamedTables, config, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if strings.Contains(result, "RENAME COLUMN") ||
+		!strings.Contains(result, "ALTER TABLE users_history ALTER COLUMN name DROP NOT NULL;") ||
+		!strings.Contains(result, "ALTER TABLE users_history ADD COLUMN IF NOT EXISTS full_name VARCHAR(50);") {
+		t.Errorf("Expected name to be kept and full_name added without --rename, got:\n%s", result)
+	}
+
+	result, err = GenerateMigrationSQL(oldTables[:1], renamedTables, config, ColumnRenames{"users": {"name": "full_name"}})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !strings.Contains(result, "ALTER TABLE users_history RENAME COLUMN name TO full_name;") || strings.Contains(result, "ADD COLUMN") {
+		t.Errorf("Expected name to be renamed to full_name, got:\n%s", result)
+	}
+
+	hashConfig := Config{UserSource: "current_user", HashChain: true}
+	if _, err := GenerateMigrationSQL(oldTables[:1], renamedTables, hashConfig, nil); err == nil || !strings.Contains(err.Error(), "table users: the columns of a hash-chained table cannot be migrated") {
+		t.Errorf("Expected column changes of a hash-chained table to be refused, got %v", err)
+	}
+	if _, err := GenerateMigrationSQL(oldTables, newTables[1:], hashConfig, nil); err != nil {
+		t.Errorf("Expected hash-chained tables to be added and removed, got %v", err)
+	}
+
+	invalid := []ColumnRenames{
+		{"nobody": {"name": "full_name"}},
+		{"users": {"missing": "full_name"}},
+		{"users": {"name": "missing"}},
+		{"users": {"id": "full_name"}},
+	}
+	for _, renames := range invalid {
+		if _, err := GenerateMigrationSQL(oldTables[:1], renamedTables, config, renames); err == nil {
+			t.Errorf("Expected an error for renames %v", renames)
+		}
+	}
+}
+
+func TestHistoryColumns(t *testing.T) {
+	table := Table{Name: "users", Columns: []Column{
+		{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+		{Name: "org_id", DataType: "INT", Options: "NOT NULL REFERENCES orgs(id) ON DELETE CASCADE"},
+	}}
+
+	config := Config{HistoryID: true, TrackUser: true, HashChain: true}
+	var names []string
+	for _, col := range HistoryColumns(table, config) {
+		names = append(names, col.Name+" "+col.DataType+" "+col.Options)
+	}
+
+	expected := []string{
+		"history_id BIGINT GENERATED ALWAYS AS IDENTITY PRIMARY KEY",
+		"id SERIAL ",
+		"org_id INT NOT NULL",
+		"valid_from TIMESTAMP DEFAULT CURRENT_TIMESTAMP",
+		"valid_to TIMESTAMP NULL",
+		"operation CHAR(1) NOT NULL CHECK (operation IN ('I', 'U', 'D'))",
+		"version INTEGER NOT NULL",
+		"changed_by VARCHAR(255) ",
+		"row_hash BYTEA NOT NULL",
+	}
+	if strings.Join(names, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected columns:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(names, "\n"))
+	}
+}
+
+func TestGenerateHistorySteps(t *testing.T) {
+	tables := []Table{
+		{Name: "users", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}},
+		{Name: "orders", SchemaName: "sales", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}},
+	}
+
+	config := Config{UserSource: "current_user", HistorySchema: "audit", HashChain: true, Retention: "1 year", Idempotent: true}
+	steps, err := GenerateHistorySteps(tables, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedNames := []string{"extensions and schemas", "users", "sales.orders", "purge_history()"}
+	if len(steps) != len(expectedNames) {
+		t.Fatalf("Expected %d steps, got %d", len(expectedNames), len(steps))
+	}
+	for i, name := range expectedNames {
+		if steps[i].Name != name {
+			t.Errorf("Step %d: expected %s, got %s", i, name, steps[i].Name)
+		}
+		if strings.Contains(steps[i].SQL, "BEGIN;") || strings.Contains(steps[i].SQL, "COMMIT;") {
+			t.Errorf("Step %s should not contain transaction control", name)
+		}
+	}
+
+	if !strings.Contains(steps[0].SQL, "CREATE EXTENSION IF NOT EXISTS pgcrypto;") || !strings.Contains(steps[0].SQL, "CREATE SCHEMA IF NOT EXISTS audit;") {
+		t.Errorf("Expected extension and schema in first step, got:\n%s", steps[0].SQL)
+	}
+	if steps[2].Table != "sales.orders" || !strings.Contains(steps[2].SQL, "CREATE TABLE IF NOT EXISTS audit.orders_history") {
+		t.Errorf("Expected history of sales.orders in its step, got:\n%s", steps[2].SQL)
+	}
+	if steps[3].Table != "" {
+		t.Errorf("Expected purge_history() step without a table, got %s", steps[3].Table)
+	}
+
+	if steps, _ := GenerateHistorySteps(tables[:1], Config{UserSource: "current_user"}); len(steps) != 1 {
+		t.Errorf("Expected a single table step without shared objects, got %d steps", len(steps))
+	}
+}
+
+func TestGenerateBackfill(t *testing.T) {
+	tables := []Table{
+		{Name: "users", Columns: []Column{
+			{Name: "id", DataType: "SERIAL", Options: "PRIMARY KEY"},
+			{Name: "created_at", DataType: "TIMESTAMPTZ"},
+		}},
+		{Name: "lines", SchemaName: "sales", PrimaryKey: []string{"order_id", "line"}, Columns: []Column{
+			{Name: "order_id", DataType: "INT"},
+			{Name: "line", DataType: "INT"},
+		}},
+	}
+
+	config := Config{UserSource: "current_user", Versioning: true, BackfillFrom: "created_at"}
+	result, err := GenerateBackfillSQL(tables, config, 500)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expectedContains := []string{
+		"CREATE TABLE IF NOT EXISTS users_history_backfill AS SELECT id FROM users WITH NO DATA;",
+		"CREATE OR REPLACE PROCEDURE users_backfill_history(batch_size INTEGER DEFAULT 500, INOUT recorded BIGINT DEFAULT NULL)",
+		"last_key_1 users.id%TYPE;",
+		"SELECT p.id INTO last_key_1 FROM users_history_backfill p;\n    first_batch := NOT FOUND;",
+		"WHERE (first_batch OR (s.id) > (last_key_1))\n            ORDER BY s.id\n            LIMIT batch_size\n            FOR SHARE\n",
+		"WHERE (first_batch OR (b.id) > (last_key_1)) AND (b.id) <= (end_key_1)\n            AND NOT EXISTS (SELECT 1 FROM users_history h WHERE h.id = b.id);\n        GET DIAGNOSTICS inserted = ROW_COUNT;",
+		"INSERT INTO users_history (id, created_at, valid_from, operation, version)",
+		"SELECT b.id, b.created_at, COALESCE(b.created_at::timestamp, started), 'I', 1",
+		"last_key_1 := end_key_1;\n        DELETE FROM users_history_backfill;\n        INSERT INTO users_history_backfill VALUES (last_key_1);\n        COMMIT;",
+		"CALL users_backfill_history(500);",
+		"DROP PROCEDURE users_backfill_history(INTEGER, BIGINT);\nDROP TABLE users_history_backfill;",
+		"CREATE TABLE IF NOT EXISTS sales.lines_history_backfill AS SELECT order_id, line FROM sales.lines WITH NO DATA;",
+		"WHERE (first_batch OR (s.order_id, s.line) > (last_key_1, last_key_2))",
+		"SELECT b.order_id, b.line, started, 'I', 1",
+		"(array_agg(l.line ORDER BY l.order_id DESC, l.line DESC))[1]",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+	if strings.Contains(result, "BEGIN;") {
+		t.Error("Expected backfill to run outside a transaction block")
+	}
+
+	config.Tables = map[string]TableConfig{"sales.lines": {BackfillFrom: "created_at"}}
+	if _, err := GenerateBackfillSQL(tables, config, 500); err == nil || !strings.Contains(err.Error(), "not found in sales.lines") {
+		t.Errorf("Expected missing per-table column to fail, got %v", err)
+	}
+
+	// The backfill procedure name is only checked when backfilling.
+	collides := Config{Naming: Naming{Function: `{{.Schema}}{{.Table}}_{{if eq .Operation "backfill"}}insert{{else}}{{.Operation}}{{end}}`}}
+	if err := ValidateNames(tables, collides); err != nil {
+		t.Fatalf("Expected no collision without a backfill, got: %v", err)
+	}
+	if _, err := GenerateBackfillSQL(tables, collides, 500); err == nil || !strings.Contains(err.Error(), "backfill function of users") {
+		t.Errorf("Expected the backfill procedure name to collide, got %v", err)
+	}
+
+	clash := append([]Table{{Name: "users_history_backfill", Columns: []Column{{Name: "id", DataType: "INT"}}}}, tables...)
+	if _, err := GenerateBackfillSQL(clash, Config{}, 500); err == nil || !strings.Contains(err.Error(), "backfill progress table of users") {
+		t.Errorf("Expected the progress table name to collide, got %v", err)
+	}
+
+	// Without a primary key, batches could skip rows sharing the fallback key.
+	noKey := []Table{{Name: "events", Columns: []Column{{Name: "account_id", DataType: "INTEGER"}}}}
+	if _, err := GenerateBackfillSQL(noKey, Config{}, 500); err == nil || !strings.Contains(err.Error(), "events has no primary key") {
+		t.Errorf("Expected a table without primary key to be rejected, got %v", err)
+	}
+
+	if _, err := GenerateBackfillSQL(tables, Config{}, 0); err == nil {
+		t.Error("Expected a zero batch size to fail")
+	}
+}
+
+func TestGenerateHistoryFiles(t *testing.T) {
+	tables := []Table{
+		{Name: "orders", SchemaName: "sales", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}, {Name: "user_id", DataType: "INT"}},
+			ForeignKeys: []ForeignKey{{ColumnName: "user_id", ReferencedTable: "users"}}},
+		{Name: "users", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}},
+	}
+	config := Config{UserSource: "current_user", HashChain: true, AppendOnly: true, Retention: "1 year"}
+
+	combined, err := GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	for _, split := range []string{SplitByTable, SplitByType} {
+		files, err := GenerateHistoryFiles(tables, config, split)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %v", split, err)
+		}
+
+		var names []string
+		var all strings.Builder
+		for _, file := range files {
+			names = append(names, file.Name)
+			all.WriteString(file.SQL)
+		}
+
+		expected := map[string]string{
+			SplitByTable: "setup.sql,tables/users.sql,tables/sales.orders.sql,purge_history.sql,index.sql",
+			SplitByType:  "schemas.sql,tables.sql,functions.sql,triggers.sql,privileges.sql,index.sql",
+		}[split]
+		if got := strings.Join(names, ","); got != expected {
+			t.Errorf("%s: expected files %s, got %s", split, expected, got)
+		}
+
+		index := files[len(files)-1].SQL
+		for _, name := range names[:len(names)-1] {
+			if !strings.Contains(index, "\\ir "+name+"\n") {
+				t.Errorf("%s: expected index to include %s, got:\n%s", split, name, index)
+			}
+		}
+
+		// Every statement of the combined output is in exactly one file.
+		for _, statement := range []string{"CREATE TABLE", "CREATE OR REPLACE FUNCTION", "CREATE TRIGGER", "REVOKE", "CREATE INDEX", "CREATE EXTENSION"} {
+			if got, want := strings.Count(all.String(), statement), strings.Count(combined, statement); got != want {
+				t.Errorf("%s: expected %d %q statements, got %d", split, want, statement, got)
+			}
+		}
+	}
+
+	clash := []Table{{Name: "Users"}, {Name: "users"}}
+	if _, err := GenerateHistoryFiles(clash, Config{}, SplitByTable); err == nil || !strings.Contains(err.Error(), "tables/users.sql") {
+		t.Errorf("Expected tables differing in case to clash, got %v", err)
+	}
+	if _, err := GenerateHistoryFiles(tables, config, "schema"); err == nil {
+		t.Error("Expected an unknown split mode to fail")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	sql := `-- users
+CREATE TABLE users (id INT, note TEXT DEFAULT 'a;b');
+CREATE FUNCTION f() RETURNS TRIGGER AS $body$
+BEGIN
+    RAISE NOTICE 'x;y'; -- not the end;
+    RETURN NEW;
+END;
+$body$ LANGUAGE plpgsql;;
+/* done; */ SELECT ";" FROM t
+-- trailing;
+`
+	expected := []string{
+		"-- users\nCREATE TABLE users (id INT, note TEXT DEFAULT 'a;b');",
+		"CREATE FUNCTION f() RETURNS TRIGGER AS $body$\nBEGIN\n    RAISE NOTICE 'x;y'; -- not the end;\n    RETURN NEW;\nEND;\n$body$ LANGUAGE plpgsql;",
+		"/* done; */ SELECT \";\" FROM t\n-- trailing;",
+	}
+
+	statements := SplitStatements(sql)
+	if len(statements) != len(expected) {
+		t.Fatalf("Expected %d statements, got %d: %q", len(expected), len(statements), statements)
+	}
+	for i := range expected {
+		if statements[i] != expected[i] {
+			t.Errorf("Statement %d: expected %q, got %q", i, expected[i], statements[i])
+		}
+	}
+
+	if got := SplitStatements("SELECT 1;\n-- only a comment\n"); len(got) != 1 {
+		t.Errorf("Expected trailing comments to be dropped, got %q", got)
+	}
+}
+
+func TestGenerateMigrationFiles(t *testing.T) {
+	tables := []Table{{Name: "users", Columns: []Column{{Name: "id", DataType: "INT", Options: "PRIMARY KEY"}}}}
+	config := Config{UserSource: "current_user", Retention: "1 year", Idempotent: true}
+	options := MigrationOptions{Version: "20240101120000", Name: "add_history", Author: "dev"}
+
+	names := map[string]string{
+		FormatGolangMigrate: "20240101120000_add_history.up.sql,20240101120000_add_history.down.sql",
+		FormatGoose:         "20240101120000_add_history.sql",
+		FormatFlyway:        "V20240101120000__add_history.sql",
+		FormatLiquibase:     "20240101120000_add_history.sql",
+	}
+	// Each file starts with the header its tool expects.
+	headers := map[string][]string{
+		FormatGolangMigrate: {"-- users\nCREATE TABLE IF NOT EXISTS users_history (", "DROP FUNCTION IF EXISTS purge_history(INTERVAL);\n\n-- Remove history for: users\n"},
+		FormatGoose:         {"-- +goose Up\n\n-- users\nCREATE TABLE IF NOT EXISTS users_history ("},
+		FormatFlyway:        {"-- users\nCREATE TABLE IF NOT EXISTS users_history ("},
+		FormatLiquibase:     {"--liquibase formatted sql\n\n--changeset dev:20240101120000-1 splitStatements:false\n--comment: users\nCREATE TABLE IF NOT EXISTS users_history ("},
+	}
+	contents := map[string][]string{}
+	for _, format := range MigrationFormats {
+		options.Format = format
+		files, err := GenerateMigrationFiles(tables, config, options)
+		if err != nil {
+			t.Fatalf("%s: expected no error, got: %v", format, err)
+		}
+
+		var fileNames []string
+		for i, file := range files {
+			fileNames = append(fileNames, file.Name)
+			contents[format] = append(contents[format], file.SQL)
+			if i < len(headers[format]) && !strings.HasPrefix(file.SQL, headers[format][i]) {
+				t.Errorf("%s: expected %s to start with %q, got:\n%s", format, file.Name, headers[format][i], file.SQL)
+			}
+			// The migration tools manage transactions themselves.
+			if strings.Contains(file.SQL, "BEGIN;") || strings.Contains(file.SQL, "COMMIT;") {
+				t.Errorf("%s: expected no transaction control in %s", format, file.Name)
+			}
+		}
+		if got := strings.Join(fileNames, ","); got != names[format] {
+			t.Errorf("%s: expected files %s, got %s", format, names[format], got)
+		}
+	}
+
+	if down := contents[FormatGolangMigrate][1]; !strings.Contains(down, "DROP TRIGGER IF EXISTS users_insert_trigger ON users;") || strings.Contains(down, "DROP TABLE") {
+		t.Errorf("Expected the down migration to drop triggers and keep the history table, got:\n%s", down)
+	}
+
+	goose := contents[FormatGoose][0]
+	expectedContains := []string{
+		"-- +goose Up\n",
+		"-- +goose StatementBegin\n-- Insert trigger for users\nCREATE OR REPLACE FUNCTION users_insert_history()",
+		"$$ LANGUAGE plpgsql;\n-- +goose StatementEnd\n",
+		"-- +goose Down\n",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(goose, expected) {
+			t.Errorf("Expected goose migration to contain %q, got:\n%s", expected, goose)
+		}
+	}
+	if strings.Count(goose, "StatementBegin") != 5 {
+		t.Errorf("Expected the three trigger functions and two purge functions to be marked, got:\n%s", goose)
+	}
+
+	liquibase := contents[FormatLiquibase][0]
+	expectedContains = []string{
+		"--liquibase formatted sql\n",
+		"--changeset dev:20240101120000-1 splitStatements:false\n--comment: users\n",
+		"--rollback DROP FUNCTION IF EXISTS users_insert_history();\n",
+		"--changeset dev:20240101120000-2 splitStatements:false\n--comment: purge_history()\n",
+		"--rollback DROP FUNCTION IF EXISTS purge_history(INTERVAL);\n",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(liquibase, expected) {
+			t.Errorf("Expected Liquibase changelog to contain %q, got:\n%s", expected, liquibase)
+		}
+	}
+
+	invalid := []MigrationOptions{
+		{Format: "sqitch", Version: "1", Name: "add_history"},
+		{Format: FormatGoose, Version: "1.2", Name: "add_history"},
+		{Format: FormatFlyway, Version: "1.2", Name: "add history"},
+		{Format: FormatLiquibase, Version: "1", Name: "add_history", Author: "a:b"},
+	}
+	for _, options := range invalid {
+		if _, err := GenerateMigrationFiles(tables, config, options); err == nil {
+			t.Errorf("Expected %+v to be rejected", options)
+		}
+	}
+	if err := (MigrationOptions{Format: FormatFlyway, Version: "1.2", Name: "add_history"}).Validate(); err != nil {
+		t.Errorf("Expected a dotted Flyway version to be accepted, got %v", err)
+	}
+}
+
+func TestGeneratePointInTimeQuery(t *testing.T) {
+	table := Table{Name: "orders", SchemaName: "sales", Columns: []Column{
+		{Name: "id", DataType: "INT", Options: "PRIMARY KEY"},
+		{Name: "Total", DataType: "NUMERIC"},
+	}}
+	config := Config{UserSource: "current_user"}
+
+	current := GeneratePointInTimeQuery(table, config, "")
+	expected := "SELECT id, \"Total\"\nFROM sales.orders_history\nWHERE valid_to IS NULL\n  AND operation <> 'D'\nORDER BY id;\n"
+	if current != expected {
+		t.Errorf("Expected current query:\n%s\ngot:\n%s", expected, current)
+	}
+
+	at := GeneratePointInTimeQuery(table, config, "2024-01-01 12:00:00")
+	expectedContains := []string{
+		"WHERE valid_from <= '2024-01-01 12:00:00'::timestamp",
+		"AND (valid_to IS NULL OR valid_to > '2024-01-01 12:00:00'::timestamp)",
+		"AND operation <> 'D'",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(at, expected) {
+			t.Errorf("Expected query to contain '%s', got:\n%s", expected, at)
+		}
+	}
+
+	if quoted := GeneratePointInTimeQuery(table, config, "2024'01"); !strings.Contains(quoted, "'2024''01'::timestamp") {
+		t.Errorf("Expected timestamp to be quoted as a literal, got:\n%s", quoted)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	base := Config{
+		UserSource:    "current_user",
+		IndexStrategy: "btree",
+		Retention:     "1 year",
+		Tables:        map[string]TableConfig{"users": {HistorySchema: "audit"}},
+	}
+
+	config, err := ParseConfig([]byte(`{
+		"track_user": true,
+		"partition": "month",
+		"partition_start": "2024-01-01",
+		"naming": {"history_table": "{{.Table}}_log"},
+		"context_columns": [{"name": "request_id"}, {"name": "tenant", "type": "INT", "expression": "42"}],
+		"tables": {
+			"users": {"ignore_columns": ["last_seen_at"], "partition": "none"},
+			"audit.events": {"exclude": true}
+		}
+	}`), base)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	if !config.TrackUser || config.Partitioning != "month" || config.Naming.HistoryTable != "{{.Table}}_log" {
+		t.Errorf("Expected file settings to be applied, got %+v", config)
+	}
+	if config.Retention != "1 year" || config.UserSource != "current_user" {
+		t.Errorf("Expected settings missing from the file to keep the base, got %+v", config)
+	}
+	if !config.PartitionStart.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected partition start 2024-01-01, got %v", config.PartitionStart)
+	}
+	if len(config.ContextColumns) != 2 || config.ContextColumns[1].DataType != "INT" {
+		t.Errorf("Expected two context columns, got %+v", config.ContextColumns)
+	}
+
+	users := config.Tables["users"]
+	if users.HistorySchema != "audit" || users.Partitioning != "none" || len(users.IgnoreColumns) != 1 {
+		t.Errorf("Expected the users section merged with the base, got %+v", users)
+	}
+	if !config.Tables["audit.events"].Exclude {
+		t.Error("Expected audit.events to be excluded")
+	}
+	if base.Tables["users"].Partitioning != "" {
+		t.Error("Expected the base config to be left unchanged")
+	}
+
+	invalid := map[string]string{
+		`{"track_user": "yes"}`:                               "track_user: expected true or false",
+		`{"partitions": -1}`:                                  "partitions: must not be negative",
+		`{"naming": {"index": "{{.Table"}}`:                   "naming.index: invalid template",
+		`{"tables": {"users": {"retention": 7}}}`:             "tables.users.retention: expected a string",
+		`{"tables": {"users": {"partition": "week"}}}`:        "tables.users.partition: must be one of",
+		`{"tables": {"users": {"ignore": ["a"]}}}`:            "tables.users.ignore: unknown key",
+		`{"context_columns": [{"name": ""}]}`:                 "context_columns[0].name: must not be empty",
+		`{"context_columns": [{"name": "a"}, {"name": "a"}]}`: "context_columns[1].name: duplicate column a",
+		"{\n  \"retention\": \"1 year\",\n}":                  "line 3",
+	}
+	for input, expected := range invalid {
+		_, err := ParseConfig([]byte(input), base)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q for %s, got: %v", expected, input, err)
+		}
+	}
+}
+
+func TestApplyTableConfig(t *testing.T) {
+	tables := []Table{
+		{Name: "users", Columns: []Column{
+			{Name: "id", DataType: "INT", Options: "PRIMARY KEY"},
+			{Name: "email", DataType: "TEXT"},
+			{Name: "last_seen_at", DataType: "TIMESTAMP"},
+		}},
+		{Name: "events", SchemaName: "audit", Columns: []Column{
+			{Name: "id", DataType: "INT", Options: "PRIMARY KEY"},
+		}},
+	}
+	config := Config{
+		UserSource:     "current_user",
+		ContextColumns: []ContextColumn{{Name: "request_id"}},
+		Tables: map[string]TableConfig{
+			"users":        {IgnoreColumns: []string{"last_seen_at"}},
+			"audit.events": {Exclude: true},
+		},
+	}
+
+	result, err := ApplyTableConfig(tables, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(result) != 1 || result[0].Name != "users" {
+		t.Fatalf("Expected only users to remain, got %+v", result)
+	}
+	if len(result[0].Columns) != 2 || len(result[0].IgnoredColumns) != 1 {
+		t.Errorf("Expected last_seen_at to be ignored, got %+v", result[0])
+	}
+	if len(tables[0].Columns) != 3 {
+		t.Error("Expected the input tables to be left unchanged")
+	}
+
+	sql, err := GenerateHistorySQL(result, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	expectedContains := []string{
+		"    request_id TEXT\n",
+		"WHEN (ROW(OLD.id, OLD.email) IS DISTINCT FROM ROW(NEW.id, NEW.email))",
+		"INSERT INTO users_history (id, email, valid_from, operation, request_id)",
+		"current_setting('app.request_id', true)",
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(sql, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+	if strings.Contains(sql, "last_seen_at") {
+		t.Error("Expected ignored column to be left out of history")
+	}
+
+	invalid := map[string]TableConfig{
+		"ignored column nope does not exist":      {IgnoreColumns: []string{"nope"}},
+		"primary key column id cannot be ignored": {IgnoreColumns: []string{"id"}},
+		"context column email conflicts":          {ContextColumns: []ContextColumn{{Name: "email"}}},
+	}
+	for expected, tableConfig := range invalid {
+		config := Config{Tables: map[string]TableConfig{"users": tableConfig}}
+		_, err := ApplyTableConfig(tables, config)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q, got: %v", expected, err)
+		}
+	}
+
+	if err := CheckTableConfig(tables, config); err != nil {
+		t.Errorf("Expected all table sections to match, got: %v", err)
+	}
+	config.Tables["audit.evnets"] = TableConfig{Exclude: true}
+	if err := CheckTableConfig(tables, config); err == nil || err.Error() != "tables.audit.evnets: no such table" {
+		t.Errorf("Expected misspelled table section to be reported, got: %v", err)
+	}
+
+	// Purging would break the hash chain, unless the table keeps history forever
+	hashConfig := Config{HashChain: true, Tables: map[string]TableConfig{"users": {Retention: "1 year"}, "audit.events": {Exclude: true}}}
+	if _, err := ApplyTableConfig(tables, hashConfig); err == nil || !strings.Contains(err.Error(), "cannot be combined with retention") {
+		t.Errorf("Expected hash chain with retention to be rejected, got: %v", err)
+	}
+	hashConfig = Config{HashChain: true, Retention: "1 year", Tables: map[string]TableConfig{"users": {Retention: "forever"}, "audit.events": {Exclude: true}}}
+	if _, err := ApplyTableConfig(tables, hashConfig); err != nil {
+		t.Errorf("Expected hash chain without retention for users, got: %v", err)
+	}
+}
+
+func TestParseAnnotations(t *testing.T) {
+	sql := `-- Schema with CREATE TABLE statements in comments
+/* CREATE TABLE ghost (id INT); */
+
+-- @history: skip
+CREATE TABLE sessions (
+    id INT PRIMARY KEY
+);
+
+CREATE INDEX sessions_idx ON sessions (id);
+
+-- @history: ignore-columns=updated_at retention="1 year"
+CREATE TABLE users (
+    id SERIAL PRIMARY KEY,
+    email TEXT NOT NULL, -- the user's email
+    last_seen_at TIMESTAMP, -- @history: ignore
+    updated_at TIMESTAMP
+);
+
+CREATE TABLE "Orders" ( -- @history: partition=month
+    id INT PRIMARY KEY,
+    note TEXT DEFAULT '-- not a comment'
+);
+COMMENT ON COLUMN "Orders".note IS '@history ignore';
+COMMENT ON TABLE users IS 'Registered users';`
+
+	tables, err := ParseCreateTables(sql)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(tables) != 3 {
+		t.Fatalf("Expected 3 tables, got %d", len(tables))
+	}
+
+	sessions, users, orders := tables[0], tables[1], tables[2]
+	if !sessions.Annotations.Exclude {
+		t.Error("Expected sessions to be skipped")
+	}
+	if users.Annotations.Exclude || fmt.Sprint(users.Annotations.IgnoreColumns) != "[updated_at last_seen_at]" || users.Annotations.Retention != "1 year" {
+		t.Errorf("Expected users annotations, got %+v", users.Annotations)
+	}
+	if orders.Annotations.Partitioning != "month" || fmt.Sprint(orders.Annotations.IgnoreColumns) != "[note]" {
+		t.Errorf("Expected Orders annotations, got %+v", orders.Annotations)
+	}
+	if orders.Columns[1].Options != "DEFAULT '-- not a comment'" {
+		t.Errorf("Expected comment markers in strings to be kept, got %q", orders.Columns[1].Options)
+	}
+
+	// Annotations override the config for their table.
+	config := Config{
+		UserSource:     "current_user",
+		Retention:      "7 years",
+		PartitionStart: time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+		Tables:         map[string]TableConfig{"users": {Retention: "forever", HistorySchema: "audit"}},
+	}
+	if _, err := ApplyTableConfig(tables, Config{UserSource: "current_user"}); err == nil || !strings.Contains(err.Error(), "partition_start") {
+		t.Errorf("Expected partitioning without a start date to be rejected, got %v", err)
+	}
+	tables, err = ApplyTableConfig(tables, config)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(tables) != 2 || len(tables[0].Columns) != 2 {
+		t.Fatalf("Expected sessions skipped and users columns ignored, got %+v", tables)
+	}
+	usersConfig := config.ForTable(tables[0])
+	if usersConfig.Retention != "1 year" || usersConfig.HistorySchema != "audit" {
+		t.Errorf("Expected annotations to override the config, got %+v", usersConfig)
+	}
+
+	invalid := map[string]string{
+		"-- @history: bogus\nCREATE TABLE t (id INT);":                                    "line 1: unknown @history setting \"bogus\"",
+		"-- @history: ignore\nCREATE TABLE t (id INT);":                                   "line 1: ignore applies to columns",
+		"CREATE TABLE t (\n  id INT, -- @history: skip\n  x INT\n);":                      "line 2: unknown @history setting \"skip\" for column id",
+		"CREATE TABLE t (id INT);\n-- @history: partition=week\nCREATE TABLE u (id INT);": "line 2: partition must be",
+		"CREATE TABLE t (id INT);\nCOMMENT ON TABLE t IS '@history retention';":           "line 2: retention needs a value",
+	}
+	for input, expected := range invalid {
+		_, err := ParseCreateTables(input)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error containing %q for %q, got: %v", expected, input, err)
+		}
+	}
+}
+
 func TestGetPrimaryKeyColumns(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -204,6 +1563,17 @@ func TestGetPrimaryKeyColumns(t *testing.T) {
 			},
 			expected: []string{"name"},
 		},
+		{
+			name: "Table-level composite primary key",
+			table: Table{
+				Columns: []Column{
+					{Name: "order_id", DataType: "INTEGER", Options: "NOT NULL"},
+					{Name: "line_no", DataType: "INTEGER", Options: "NOT NULL"},
+				},
+				PrimaryKey: []string{"order_id", "line_no"},
+			},
+			expected: []string{"order_id", "line_no"},
+		},
 		{
 			name: "Empty table",
 			table: Table{
@@ -305,7 +1675,7 @@ func TestSchemaHelperFunctions(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := GetHistoryTableName(tt.table); got != tt.expectedHist {
+			if got := GetHistoryTableName(tt.table, Config{}); got != tt.expectedHist {
 				t.Errorf("getHistoryTableName() = %v, want %v", got, tt.expectedHist)
 			}
 			if got := GetOriginalTableName(tt.table); got != tt.expectedOrig {
@@ -384,6 +1754,96 @@ func TestParseForeignKeys(t *testing.T) {
 	}
 }
 
+func TestParseQuotedIdentifiers(t *testing.T) {
+	sqlContent := `
+		CREATE TABLE "Sales"."OrderItems" (
+			"UserId" INTEGER NOT NULL REFERENCES "Users"("Id"),
+			"order" INTEGER NOT NULL,
+			"Line Note" TEXT,
+			Total NUMERIC(10,2),
+			PRIMARY KEY ("UserId", "order")
+		);
+	`
+
+	tables, err := ParseCreateTables(sqlContent)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("Expected 1 table, got: %d", len(tables))
+	}
+
+	table := tables[0]
+	if table.SchemaName != "Sales" || table.Name != "OrderItems" || !table.Quoted || !table.SchemaQuoted {
+		t.Errorf("Expected quoted Sales.OrderItems, got: %+v", table)
+	}
+
+	expectedColumns := []Column{
+		{Name: "UserId", Quoted: true},
+		{Name: "order", Quoted: true},
+		{Name: "Line Note", Quoted: true},
+		{Name: "total", Quoted: false},
+	}
+	if len(table.Columns) != len(expectedColumns) {
+		t.Fatalf("Expected %d columns, got: %d", len(expectedColumns), len(table.Columns))
+	}
+	for i, expected := range expectedColumns {
+		col := table.Columns[i]
+		if col.Name != expected.Name || col.Quoted != expected.Quoted {
+			t.Errorf("Column %d: expected %q (quoted %v), got %q (quoted %v)", i, expected.Name, expected.Quoted, col.Name, col.Quoted)
+		}
+	}
+
+	if strings.Join(table.PrimaryKey, ",") != "UserId,order" {
+		t.Errorf("Expected primary key UserId,order, got: %v", table.PrimaryKey)
+	}
+
+	if len(table.ForeignKeys) != 1 {
+		t.Fatalf("Expected 1 foreign key, got: %d", len(table.ForeignKeys))
+	}
+	fk := table.ForeignKeys[0]
+	if fk.ColumnName != "UserId" || fk.ReferencedTable != "Users" || fk.ReferencedColumn != "Id" || !fk.Quoted {
+		t.Errorf("Expected quoted UserId -> Users(Id), got: %+v", fk)
+	}
+
+	result := GenerateTriggers(table, Config{UserSource: "current_user"})
+	expectedContains := []string{
+		`CREATE OR REPLACE FUNCTION "Sales_OrderItems_insert_history"() RETURNS TRIGGER`,
+		`UPDATE "Sales"."OrderItems_history" SET valid_to = CURRENT_TIMESTAMP`,
+		`WHERE valid_to IS NULL AND "UserId" = NEW."UserId" AND "order" = NEW."order";`,
+		`INSERT INTO "Sales"."OrderItems_history" ("UserId", "order", "Line Note", total, valid_from, operation)`,
+		`VALUES (NEW."UserId", NEW."order", NEW."Line Note", NEW.total, CURRENT_TIMESTAMP, 'I');`,
+		`AFTER INSERT ON "Sales"."OrderItems"`,
+	}
+	for _, expected := range expectedContains {
+		if !strings.Contains(result, expected) {
+			t.Errorf("Expected result to contain '%s', but it didn't", expected)
+		}
+	}
+}
+
+func TestQuoteIdentifier(t *testing.T) {
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"users", "users"},
+		{"user_id2", "user_id2"},
+		{"UserId", `"UserId"`},
+		{"order", `"order"`},
+		{"user", `"user"`},
+		{"line note", `"line note"`},
+		{"2fa", `"2fa"`},
+		{`say "hi"`, `"say ""hi"""`},
+	}
+
+	for _, tt := range tests {
+		if got := QuoteIdentifier(tt.name); got != tt.expected {
+			t.Errorf("QuoteIdentifier(%q) = %v, want %v", tt.name, got, tt.expected)
+		}
+	}
+}
+
 func writeFile(filename, content string) error {
 	file, err := os.Create(filename)
 	if err != nil {
@@ -0,0 +1,126 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// partitionPeriod describes how one partition interval is truncated, stepped
+// and named, both in Go and in the generated PL/pgSQL helper.
+type partitionPeriod struct {
+	unit      string
+	goFormat  string
+	sqlFormat string
+}
+
+var partitionPeriods = map[string]partitionPeriod{
+	"month": {unit: "month", goFormat: "2006_01", sqlFormat: "YYYY_MM"},
+	"year":  {unit: "year", goFormat: "2006", sqlFormat: "YYYY"},
+}
+
+func isPartitioned(config Config) bool {
+	_, ok := partitionPeriods[config.Partitioning]
+	return ok
+}
+
+// GeneratePartitions creates the initial window of range partitions and the
+// default partition for a partitioned history table.
+func GeneratePartitions(table Table, config Config) string {
+	period, ok := partitionPeriods[config.Partitioning]
+	if !ok {
+		return ""
+	}
+
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+	start := truncateToPeriod(config.PartitionStart, period)
+
+	for i := 0; i < config.PartitionCount; i++ {
+		end := addPeriod(start, period)
+		partitionName := getPartitionName(table, config, "p"+start.Format(period.goFormat))
+		sb.WriteString(fmt.Sprintf("CREATE TABLE %s%s PARTITION OF %s\n", ifNotExists(config), partitionName, historyTableName))
+		sb.WriteString(fmt.Sprintf("    FOR VALUES FROM ('%s') TO ('%s');\n", start.Format("2006-01-02"), end.Format("2006-01-02")))
+		start = end
+	}
+	sb.WriteString(fmt.Sprintf("CREATE TABLE %s%s PARTITION OF %s DEFAULT;\n\n", ifNotExists(config), getPartitionName(table, config, "default"), historyTableName))
+
+	return sb.String()
+}
+
+// GeneratePartitionFunction creates a helper that adds future partitions, e.g.
+// SELECT users_partition_history(CURRENT_DATE, 3) from a scheduled job.
+// Partitions must exist before rows for their range arrive, otherwise those
+// rows land in the default partition and block creating the partition later.
+func GeneratePartitionFunction(table Table, config Config) string {
+	period, ok := partitionPeriods[config.Partitioning]
+	if !ok {
+		return ""
+	}
+
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+
+	sb.WriteString(fmt.Sprintf("-- Partition maintenance for %s\n", historyTableName))
+	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s(start_date DATE, partition_count INTEGER DEFAULT 1) RETURNS void AS $$\n", getFunctionName(table, config, "partition")))
+	historyName := mustRenderName(config.Naming.HistoryTable, DefaultHistoryTableTemplate, table, "")
+	partitionExpression := "quote_ident(partition_name)"
+	if schema := getHistorySchema(table, config); schema != "" {
+		partitionExpression = quoteLiteral(QuoteIdentifier(schema)+".") + " || quote_ident(partition_name)"
+	}
+	// Partition names have a fixed length, so shortening is only needed
+	// when the longest of them is over the limit.
+	needsShortening := len(historyName+"_p"+period.goFormat) > maxIdentifierLength
+	prefixLength := maxIdentifierLength - 9
+
+	sb.WriteString("DECLARE\n")
+	sb.WriteString(fmt.Sprintf("    partition_start DATE := date_trunc('%s', start_date);\n", period.unit))
+	sb.WriteString("    partition_end DATE;\n")
+	sb.WriteString("    partition_name TEXT;\n")
+	if needsShortening {
+		sb.WriteString("    partition_prefix TEXT;\n")
+	}
+	sb.WriteString("BEGIN\n")
+	sb.WriteString("    FOR i IN 1..partition_count LOOP\n")
+	sb.WriteString(fmt.Sprintf("        partition_end := partition_start + INTERVAL '1 %s';\n", period.unit))
+	sb.WriteString(fmt.Sprintf("        partition_name := %s || to_char(partition_start, '%s');\n", quoteLiteral(historyName+"_p"), period.sqlFormat))
+	if needsShortening {
+		// Same as shortenIdentifier: cut on a character boundary, add an MD5 suffix.
+		sb.WriteString(fmt.Sprintf("        IF octet_length(partition_name) > %d THEN\n", maxIdentifierLength))
+		sb.WriteString(fmt.Sprintf("            partition_prefix := left(partition_name, %d);\n", prefixLength))
+		sb.WriteString(fmt.Sprintf("            WHILE octet_length(partition_prefix) > %d LOOP\n", prefixLength))
+		sb.WriteString("                partition_prefix := left(partition_prefix, -1);\n")
+		sb.WriteString("            END LOOP;\n")
+		sb.WriteString("            partition_name := partition_prefix || '_' || left(md5(partition_name), 8);\n")
+		sb.WriteString("        END IF;\n")
+	}
+	sb.WriteString("        EXECUTE format('CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM (%L) TO (%L)',\n")
+	sb.WriteString(fmt.Sprintf("            %s, %s, partition_start, partition_end);\n",
+		partitionExpression, quoteLiteral(historyTableName)))
+	sb.WriteString("        partition_start := partition_end;\n")
+	sb.WriteString("    END LOOP;\n")
+	sb.WriteString("END;\n")
+	sb.WriteString("$$ LANGUAGE plpgsql;\n\n")
+
+	return sb.String()
+}
+
+func truncateToPeriod(t time.Time, period partitionPeriod) time.Time {
+	if period.unit == "year" {
+		return time.Date(t.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func addPeriod(t time.Time, period partitionPeriod) time.Time {
+	if period.unit == "year" {
+		return t.AddDate(1, 0, 0)
+	}
+	return t.AddDate(0, 1, 0)
+}
+
+func quoteLiteral(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,160 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// purgeSetting is the transaction-local setting that purge functions raise to
+// let the append-only guard accept their deletes. The guard also requires the
+// delete to run as the owner of the history table, so setting it by hand does
+// not let other roles delete.
+const purgeSetting = "sql_history.purge"
+
+// GenerateProtection makes a history table append-only: a guard trigger only
+// lets through the valid_to close-out issued from the generated triggers and
+// deletes issued by the purge functions, and direct write privileges are
+// revoked from PUBLIC. With Config.HistoryOwner set, the history table and all
+// its functions are handed to that role.
+func GenerateProtection(table Table, config Config) string {
+	config = config.ForTable(table)
+
+	var sb strings.Builder
+
+	if config.AppendOnly {
+		sb.WriteString(fmt.Sprintf("-- Append-only protection for %s\n", GetHistoryTableName(table, config)))
+		sb.WriteString(generateProtectFunction(table, config))
+		sb.WriteString(generateProtectTriggers(table, config))
+	}
+	sb.WriteString(generatePrivileges(table, config))
+
+	if sb.Len() > 0 {
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// generateProtectTriggers creates the guard triggers of an append-only
+// history table.
+func generateProtectTriggers(table Table, config Config) string {
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+	protectFunction := getFunctionName(table, config, "protect")
+
+	sb.WriteString(createTrigger(config, getTriggerName(table, config, "protect"), historyTableName))
+	sb.WriteString(fmt.Sprintf("    BEFORE UPDATE OR DELETE ON %s\n", historyTableName))
+	sb.WriteString("    FOR EACH ROW\n")
+	sb.WriteString(fmt.Sprintf("    EXECUTE FUNCTION %s();\n\n", protectFunction))
+
+	sb.WriteString(createTrigger(config, getTriggerName(table, config, "protect_truncate"), historyTableName))
+	sb.WriteString(fmt.Sprintf("    BEFORE TRUNCATE ON %s\n", historyTableName))
+	sb.WriteString("    FOR EACH STATEMENT\n")
+	sb.WriteString(fmt.Sprintf("    EXECUTE FUNCTION %s();\n\n", protectFunction))
+
+	return sb.String()
+}
+
+// generatePrivileges revokes direct writes to an append-only history table and
+// hands the history table and its functions to Config.HistoryOwner.
+func generatePrivileges(table Table, config Config) string {
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+
+	if config.AppendOnly {
+		sb.WriteString(fmt.Sprintf("REVOKE INSERT, UPDATE, DELETE, TRUNCATE ON %s FROM PUBLIC;\n", historyTableName))
+		if config.Retention != "" {
+			sb.WriteString(fmt.Sprintf("REVOKE EXECUTE ON FUNCTION %s(INTERVAL) FROM PUBLIC;\n", getPurgeFunctionName(table, config)))
+		}
+	}
+
+	if config.HistoryOwner != "" {
+		owner := QuoteIdentifier(config.HistoryOwner)
+		sb.WriteString(fmt.Sprintf("ALTER TABLE %s OWNER TO %s;\n", historyTableName, owner))
+		for _, function := range historyFunctionSignatures(table, config) {
+			sb.WriteString(fmt.Sprintf("ALTER FUNCTION %s OWNER TO %s;\n", function, owner))
+		}
+	}
+
+	return sb.String()
+}
+
+// generateProtectFunction creates or replaces the guard function of an
+// append-only history table. Only the close-out of an open version by the
+// history triggers, which sets valid_to and nothing else, and deletes by the
+// purge functions, running as the owner of the history table, get through.
+func generateProtectFunction(table Table, config Config) string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s() RETURNS TRIGGER AS $$", getFunctionName(table, config, "protect")))
+	sb.WriteString(protectFunctionBody(table, config))
+	sb.WriteString("$$ LANGUAGE plpgsql;\n\n")
+
+	return sb.String()
+}
+
+func protectFunctionBody(table Table, config Config) string {
+	columns := historyDataColumns(table, config)
+	newValues := make([]string, len(columns))
+	oldValues := make([]string, len(columns))
+	for i, col := range columns {
+		newValues[i] = "NEW." + QuoteIdentifier(col)
+		oldValues[i] = "OLD." + QuoteIdentifier(col)
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("\nBEGIN\n")
+	sb.WriteString("    IF TG_OP = 'UPDATE' AND pg_trigger_depth() > 1\n")
+	sb.WriteString("        AND OLD.valid_to IS NULL AND NEW.valid_to IS NOT NULL\n")
+	sb.WriteString(fmt.Sprintf("        AND ROW(%s) IS NOT DISTINCT FROM ROW(%s) THEN\n", strings.Join(newValues, ", "), strings.Join(oldValues, ", ")))
+	sb.WriteString("        RETURN NEW;\n")
+	sb.WriteString("    END IF;\n")
+	// Any role can raise the setting, but only the purge functions, which
+	// run as the owner of the history table, delete as that owner.
+	sb.WriteString(fmt.Sprintf("    IF TG_OP = 'DELETE' AND current_setting('%s', true) = 'on'\n", purgeSetting))
+	sb.WriteString(fmt.Sprintf("        AND current_user = (SELECT pg_get_userbyid(relowner) FROM pg_class WHERE oid = %s::regclass) THEN\n", quoteLiteral(GetHistoryTableName(table, config))))
+	sb.WriteString("        RETURN OLD;\n")
+	sb.WriteString("    END IF;\n")
+	sb.WriteString("    RAISE EXCEPTION '% on % is not allowed, history is append-only', TG_OP, TG_TABLE_NAME;\n")
+	sb.WriteString("END;\n")
+
+	return sb.String()
+}
+
+// historyFunctionSignatures lists the generated functions belonging to one
+// table, in the form accepted by ALTER FUNCTION and DROP FUNCTION.
+func historyFunctionSignatures(table Table, config Config) []string {
+	config = config.ForTable(table)
+
+	signatures := []string{
+		getFunctionName(table, config, "insert") + "()",
+		getFunctionName(table, config, "update") + "()",
+		getFunctionName(table, config, "delete") + "()",
+	}
+	if config.AppendOnly {
+		signatures = append(signatures, getFunctionName(table, config, "protect")+"()")
+	}
+	if isPartitioned(config) {
+		signatures = append(signatures, getFunctionName(table, config, "partition")+"(DATE, INTEGER)")
+	}
+	if config.HashChain {
+		signatures = append(signatures, getFunctionName(table, config, "hash")+"()")
+	}
+	if config.Retention != "" {
+		signatures = append(signatures, getPurgeFunctionName(table, config)+"(INTERVAL)")
+	}
+
+	return signatures
+}
+
+// functionAttributes returns the attributes appended to the LANGUAGE clause of
+// generated functions that write history.
+func functionAttributes(config Config) string {
+	if config.AppendOnly {
+		return " SECURITY DEFINER SET search_path FROM CURRENT"
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+package parser
+
+import (
+	"regexp"
+	"strings"
+)
+
+// plainIdentifier matches identifiers that PostgreSQL keeps as written when
+// they are not quoted.
+var plainIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_$]*$`)
+
+// reservedKeywords are the PostgreSQL keywords that cannot be used as column
+// or table names without quoting: the reserved ones and those reserved except
+// as function or type names.
+var reservedKeywords = map[string]bool{}
+
+func init() {
+	for _, keyword := range strings.Fields(`
+		all analyse analyze and any array as asc asymmetric both case cast check
+		collate column constraint create current_catalog current_date current_role
+		current_time current_timestamp current_user default deferrable desc distinct
+		do else end except false fetch for foreign from grant group having in
+		initially intersect into lateral leading limit localtime localtimestamp not
+		null offset on only or order placing primary references returning select
+		session_user some symmetric system_user table then to trailing true union
+		unique user using variadic when where window with
+		authorization binary collation concurrently cross current_schema freeze full
+		ilike inner is isnull join left like natural notnull outer overlaps right
+		similar tablesample verbose`) {
+		reservedKeywords[keyword] = true
+	}
+}
+
+// QuoteIdentifier returns name as it must be written in SQL: unchanged when
+// PostgreSQL would read it back as is, otherwise in double quotes. Names with
+// uppercase letters, spaces or other special characters and reserved words
+// are quoted.
+func QuoteIdentifier(name string) string {
+	if plainIdentifier.MatchString(name) && !reservedKeywords[name] {
+		return name
+	}
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// quoteQualified quotes a name and qualifies it with an optional schema.
+func quoteQualified(schema, name string) string {
+	if schema != "" {
+		return QuoteIdentifier(schema) + "." + QuoteIdentifier(name)
+	}
+	return QuoteIdentifier(name)
+}
+
+// quoteColumns quotes each of the given column names.
+func quoteColumns(columns []string) []string {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		quoted[i] = QuoteIdentifier(col)
+	}
+	return quoted
+}
+
+// parseIdentifier reads an identifier as written in the input. Quoted
+// identifiers ("x", `x` or [x]) keep their case; unquoted ones are folded to
+// lower case like PostgreSQL does.
+func parseIdentifier(raw string) (string, bool) {
+	raw = strings.TrimSpace(raw)
+	if len(raw) >= 2 {
+		switch {
+		case raw[0] == '"' && raw[len(raw)-1] == '"':
+			return strings.ReplaceAll(raw[1:len(raw)-1], `""`, `"`), true
+		case raw[0] == '`' && raw[len(raw)-1] == '`',
+			raw[0] == '[' && raw[len(raw)-1] == ']':
+			return raw[1 : len(raw)-1], true
+		}
+	}
+	return strings.ToLower(raw), false
+}
+
+// splitQualifiedName splits a possibly schema-qualified name on dots outside
+// of quotes.
+func splitQualifiedName(name string) []string {
+	var parts []string
+	var current strings.Builder
+	inQuotes := false
+
+	for _, r := range name {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case r == '.' && !inQuotes:
+			parts = append(parts, current.String())
+			current.Reset()
+		default:
+			current.WriteRune(r)
+		}
+	}
+
+	return append(parts, current.String())
+}
+
+// splitIdentifier splits the leading identifier off a column definition,
+// returning it and the rest of the definition.
+func splitIdentifier(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", ""
+	}
+
+	closing := map[byte]byte{'"': '"', '`': '`', '[': ']'}[line[0]]
+	if closing == 0 {
+		end := strings.IndexAny(line, " \t")
+		if end == -1 {
+			return line, ""
+		}
+		return line[:end], strings.TrimSpace(line[end:])
+	}
+
+	for i := 1; i < len(line); i++ {
+		if line[i] != closing {
+			continue
+		}
+		// A doubled quote is an escaped quote inside the identifier.
+		if closing == '"' && i+1 < len(line) && line[i+1] == '"' {
+			i++
+			continue
+		}
+		return line[:i+1], strings.TrimSpace(line[i+1:])
+	}
+
+	return line, ""
+}
+
+// parseIdentifierList reads a comma-separated list of identifiers, reporting
+// whether any of them was quoted.
+func parseIdentifierList(list string) ([]string, bool) {
+	var names []string
+	anyQuoted := false
+	for _, raw := range splitColumns(list) {
+		name, quoted := parseIdentifier(raw)
+		names = append(names, name)
+		anyQuoted = anyQuoted || quoted
+	}
+	return names, anyQuoted
+}
@@ -0,0 +1,129 @@
+package parser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GeneratePurgeFunction creates <table>_purge_history(older_than), which
+// deletes history versions closed longer ago than older_than. Open versions,
+// including the open 'D' row of a deleted key, are never removed. Tables
+// without a retention get no purge function.
+func GeneratePurgeFunction(table Table, config Config) string {
+	config = config.ForTable(table)
+	if config.Retention == "" {
+		return ""
+	}
+
+	var sb strings.Builder
+
+	historyTableName := GetHistoryTableName(table, config)
+
+	sb.WriteString(fmt.Sprintf("-- Retention for %s: %s\n", historyTableName, config.Retention))
+	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s(older_than INTERVAL DEFAULT %s) RETURNS BIGINT AS $$\n", getPurgeFunctionName(table, config), quoteLiteral(config.Retention)))
+	sb.WriteString("DECLARE\n")
+	sb.WriteString("    cutoff TIMESTAMP := CURRENT_TIMESTAMP - older_than;\n")
+	sb.WriteString("    purged BIGINT := 0;\n")
+	sb.WriteString("    deleted BIGINT;\n")
+	if isPartitioned(config) {
+		sb.WriteString("    part RECORD;\n")
+		sb.WriteString("    upper_bound TIMESTAMP;\n")
+		sb.WriteString("    kept BIGINT;\n")
+		sb.WriteString("    total BIGINT;\n")
+	}
+	sb.WriteString("BEGIN\n")
+	if config.AppendOnly {
+		sb.WriteString(fmt.Sprintf("    PERFORM set_config('%s', 'on', true);\n", purgeSetting))
+	}
+	if isPartitioned(config) {
+		// Whole partitions are dropped when their range ends before the cutoff
+		// and every row in them has been closed before the cutoff; rows that
+		// started long ago but are still open keep their partition alive.
+		sb.WriteString("    FOR part IN\n")
+		sb.WriteString("        SELECT c.oid::regclass AS name, pg_get_expr(c.relpartbound, c.oid) AS bound\n")
+		sb.WriteString("        FROM pg_inherits i JOIN pg_class c ON c.oid = i.inhrelid\n")
+		sb.WriteString(fmt.Sprintf("        WHERE i.inhparent = %s::regclass\n", quoteLiteral(historyTableName)))
+		sb.WriteString("    LOOP\n")
+		sb.WriteString("        CONTINUE WHEN part.bound = 'DEFAULT';\n")
+		sb.WriteString("        upper_bound := substring(part.bound from 'TO \\(''([^'']+)''\\)')::timestamp;\n")
+		sb.WriteString("        CONTINUE WHEN upper_bound > cutoff;\n")
+		sb.WriteString("        EXECUTE format('SELECT count(*) FILTER (WHERE valid_to IS NULL OR valid_to >= $1), count(*) FROM %s', part.name)\n")
+		sb.WriteString("            INTO kept, total USING cutoff;\n")
+		sb.WriteString("        IF kept = 0 THEN\n")
+		sb.WriteString("            EXECUTE format('DROP TABLE %s', part.name);\n")
+		sb.WriteString("            purged := purged + total;\n")
+		sb.WriteString("        END IF;\n")
+		sb.WriteString("    END LOOP;\n")
+	}
+	sb.WriteString(fmt.Sprintf("    DELETE FROM %s\n", historyTableName))
+	sb.WriteString("    WHERE valid_to IS NOT NULL AND valid_to < cutoff;\n")
+	sb.WriteString("    GET DIAGNOSTICS deleted = ROW_COUNT;\n")
+	if config.AppendOnly {
+		sb.WriteString(fmt.Sprintf("    PERFORM set_config('%s', 'off', true);\n", purgeSetting))
+	}
+	sb.WriteString("    RETURN purged + deleted;\n")
+	sb.WriteString("END;\n")
+	sb.WriteString(fmt.Sprintf("$$ LANGUAGE plpgsql%s;\n\n", functionAttributes(config)))
+
+	return sb.String()
+}
+
+// GeneratePurgeAllFunction creates purge_history(older_than), which purges
+// every table that has a retention. A NULL older_than applies each table's own
+// retention. It returns an empty string when no table has a retention.
+func GeneratePurgeAllFunction(tables []Table, config Config) string {
+	var calls []string
+	for _, table := range tables {
+		tableConfig := config.ForTable(table)
+		if tableConfig.Retention == "" {
+			continue
+		}
+		calls = append(calls, fmt.Sprintf("    purged := purged + %s(COALESCE(older_than, %s));\n", getPurgeFunctionName(table, config), quoteLiteral(tableConfig.Retention)))
+	}
+	if len(calls) == 0 {
+		return ""
+	}
+
+	var sb strings.Builder
+
+	purgeAll := getPurgeAllFunctionName(tables, config)
+
+	sb.WriteString("-- Purge expired history for all tables with a retention\n")
+	sb.WriteString(fmt.Sprintf("CREATE OR REPLACE FUNCTION %s(older_than INTERVAL DEFAULT NULL) RETURNS BIGINT AS $$\n", purgeAll))
+	sb.WriteString("DECLARE\n")
+	sb.WriteString("    purged BIGINT := 0;\n")
+	sb.WriteString("BEGIN\n")
+	for _, call := range calls {
+		sb.WriteString(call)
+	}
+	sb.WriteString("    RETURN purged;\n")
+	sb.WriteString("END;\n")
+	sb.WriteString(fmt.Sprintf("$$ LANGUAGE plpgsql%s;\n", functionAttributes(config)))
+
+	if config.AppendOnly || config.HistoryOwner != "" {
+		sb.WriteString("\n")
+	}
+	if config.AppendOnly {
+		sb.WriteString(fmt.Sprintf("REVOKE EXECUTE ON FUNCTION %s(INTERVAL) FROM PUBLIC;\n", purgeAll))
+	}
+	if config.HistoryOwner != "" {
+		sb.WriteString(fmt.Sprintf("ALTER FUNCTION %s(INTERVAL) OWNER TO %s;\n", purgeAll, QuoteIdentifier(config.HistoryOwner)))
+	}
+
+	return sb.String()
+}
+
+func getPurgeFunctionName(table Table, config Config) string {
+	return getFunctionName(table, config, "purge")
+}
+
+// getPurgeAllFunctionName returns the name of purge_history(), or an empty
+// string when no table has a retention and the function is not generated.
+func getPurgeAllFunctionName(tables []Table, config Config) string {
+	for _, table := range tables {
+		if config.ForTable(table).Retention != "" {
+			return quoteQualified(config.HistorySchema, "purge_history")
+		}
+	}
+	return ""
+}
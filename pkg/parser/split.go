@@ -0,0 +1,208 @@
+package parser
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// IndexFileName is the file of split output that includes all other files.
+const IndexFileName = "index.sql"
+
+// Split modes of GenerateHistoryFiles.
+const (
+	SplitByTable = "table"
+	SplitByType  = "type"
+)
+
+// OutputFile is one file of split output. Name is a slash-separated path
+// relative to the output directory.
+type OutputFile struct {
+	Name string
+	SQL  string
+}
+
+// GenerateHistoryFiles splits what GenerateHistorySQL installs into files, so
+// that a schema change only touches the files of the objects that changed.
+//
+// SplitByTable writes setup.sql with the pgcrypto extension and history
+// schemas, tables/<table>.sql with all history objects of each table, and
+// purge_history.sql. SplitByType writes schemas.sql, tables.sql,
+// functions.sql, triggers.sql and privileges.sql. Files that would be empty
+// are left out. The last file is IndexFileName, which includes the others
+// with psql's \ir in the order they must run, tables ordered by their foreign
+// keys.
+func GenerateHistoryFiles(tables []Table, config Config, split string) ([]OutputFile, error) {
+	if err := ValidateNames(tables, config); err != nil {
+		return nil, err
+	}
+
+	tables = SortTablesByDependency(tables)
+
+	var files []OutputFile
+	var err error
+	switch split {
+	case SplitByTable:
+		files, err = splitByTable(tables, config)
+	case SplitByType:
+		files = splitByType(tables, config)
+	default:
+		return nil, fmt.Errorf("split must be '%s' or '%s', got %q", SplitByTable, SplitByType, split)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var index strings.Builder
+	index.WriteString("-- Generated History Tables and Triggers\n")
+	index.WriteString("-- Includes the files of this directory in the order they must run:\n")
+	index.WriteString(fmt.Sprintf("--   psql -f %s\n\n", IndexFileName))
+	for _, file := range files {
+		index.WriteString(fmt.Sprintf("\\ir %s\n", file.Name))
+	}
+
+	return append(files, OutputFile{Name: IndexFileName, SQL: index.String()}), nil
+}
+
+// splitByTable writes the objects of each table to a file of its own.
+func splitByTable(tables []Table, config Config) ([]OutputFile, error) {
+	var files []OutputFile
+
+	var setup strings.Builder
+	if config.HashChain {
+		setup.WriteString("CREATE EXTENSION IF NOT EXISTS pgcrypto;\n")
+	}
+	setup.WriteString(GenerateHistorySchemas(tables, config))
+	if setup.Len() > 0 {
+		files = append(files, OutputFile{Name: "setup.sql", SQL: "-- Extensions and history schemas\n\n" + setup.String()})
+	}
+
+	// Names differing only in case would overwrite each other on
+	// case-insensitive file systems.
+	fileTables := map[string]string{}
+	for _, table := range tables {
+		name := GetOriginalTableName(table)
+		fileName := "tables/" + fileNameOf(name) + ".sql"
+		if other, ok := fileTables[strings.ToLower(fileName)]; ok {
+			return nil, fmt.Errorf("tables %s and %s would both be written to %s", other, name, fileName)
+		}
+		fileTables[strings.ToLower(fileName)] = name
+
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("-- History table and triggers for: %s\n\n", name))
+		if config.Idempotent {
+			sb.WriteString("BEGIN;\n\n")
+		}
+		sb.WriteString(generateTableHistory(table, config))
+		if config.Idempotent {
+			sb.WriteString("COMMIT;\n")
+		}
+		files = append(files, OutputFile{Name: fileName, SQL: sb.String()})
+	}
+
+	if purgeAll := GeneratePurgeAllFunction(tables, config); purgeAll != "" {
+		files = append(files, OutputFile{Name: "purge_history.sql", SQL: purgeAll})
+	}
+
+	return files, nil
+}
+
+// splitByType writes the objects of all tables to one file per kind of
+// object: history tables before the functions that reference them, and
+// functions before the triggers and privileges that name them.
+func splitByType(tables []Table, config Config) []OutputFile {
+	var schemas strings.Builder
+	if config.HashChain {
+		schemas.WriteString("CREATE EXTENSION IF NOT EXISTS pgcrypto;\n")
+	}
+	schemas.WriteString(GenerateHistorySchemas(tables, config))
+
+	sections := map[string]*strings.Builder{}
+	names := []string{"tables", "functions", "triggers", "privileges"}
+	for _, name := range names {
+		sections[name] = &strings.Builder{}
+	}
+
+	for _, table := range tables {
+		tableConfig := config.ForTable(table)
+		header := fmt.Sprintf("-- %s\n", GetOriginalTableName(table))
+
+		section := sections["tables"]
+		section.WriteString(header)
+		section.WriteString(generateHistoryTableDDL(table, tableConfig))
+		section.WriteString("\n")
+
+		section = sections["functions"]
+		section.WriteString(header)
+		for _, operation := range []string{"insert", "update", "delete"} {
+			section.WriteString(GenerateTriggerFunction(table, tableConfig, operation))
+		}
+		if isPartitioned(tableConfig) {
+			section.WriteString(GeneratePartitionFunction(table, tableConfig))
+		}
+		if tableConfig.HashChain {
+			section.WriteString(generateHashFunction(table, tableConfig))
+		}
+		section.WriteString(GeneratePurgeFunction(table, tableConfig))
+		if tableConfig.AppendOnly {
+			section.WriteString(generateProtectFunction(table, tableConfig))
+		}
+
+		section = sections["triggers"]
+		section.WriteString(header)
+		for _, operation := range []string{"insert", "update", "delete"} {
+			section.WriteString(generateTrigger(table, tableConfig, operation))
+		}
+		if tableConfig.HashChain {
+			section.WriteString(generateHashTrigger(table, tableConfig) + "\n")
+		}
+		if tableConfig.AppendOnly {
+			section.WriteString(generateProtectTriggers(table, tableConfig))
+		}
+
+		if privileges := generatePrivileges(table, tableConfig); privileges != "" {
+			sections["privileges"].WriteString(header + privileges + "\n")
+		}
+	}
+
+	if purgeAll := GeneratePurgeAllFunction(tables, config); purgeAll != "" {
+		sections["functions"].WriteString(purgeAll)
+	}
+
+	var files []OutputFile
+	if schemas.Len() > 0 {
+		files = append(files, OutputFile{Name: "schemas.sql", SQL: "-- Extensions and history schemas\n\n" + schemas.String()})
+	}
+	headings := map[string]string{
+		"tables":     "History tables, partitions and indexes",
+		"functions":  "History functions",
+		"triggers":   "History triggers",
+		"privileges": "Privileges and ownership of history objects",
+	}
+	for _, name := range names {
+		if sections[name].Len() == 0 {
+			continue
+		}
+		var sb strings.Builder
+		sb.WriteString(fmt.Sprintf("-- %s\n\n", headings[name]))
+		if config.Idempotent {
+			sb.WriteString("BEGIN;\n\n")
+		}
+		sb.WriteString(sections[name].String())
+		if config.Idempotent {
+			sb.WriteString("COMMIT;\n")
+		}
+		files = append(files, OutputFile{Name: name + ".sql", SQL: sb.String()})
+	}
+
+	return files
+}
+
+// unsafeFileNameChars matches characters replaced in file names derived from
+// table names.
+var unsafeFileNameChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// fileNameOf turns a table name into a file name without extension.
+func fileNameOf(name string) string {
+	return unsafeFileNameChars.ReplaceAllString(name, "_")
+}
@@ -3,10 +3,12 @@ package test
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/leinonen/sql-history/pkg/database"
 	"github.com/leinonen/sql-history/pkg/parser"
 )
 
@@ -53,6 +55,50 @@ func TestIntegration(t *testing.T) {
 	t.Run("UserTrackingWithForeignKeys", func(t *testing.T) {
 		testUserTrackingWithForeignKeys(t, ctx, conn)
 	})
+
+	t.Run("KeyReuse", func(t *testing.T) {
+		testKeyReuse(t, ctx, conn)
+	})
+
+	t.Run("HashChain", func(t *testing.T) {
+		testHashChain(t, ctx, conn)
+	})
+
+	t.Run("AppendOnly", func(t *testing.T) {
+		testAppendOnly(t, ctx, conn)
+	})
+
+	t.Run("IdempotentOutput", func(t *testing.T) {
+		testIdempotentOutput(t, ctx, conn)
+	})
+
+	t.Run("Uninstall", func(t *testing.T) {
+		testUninstall(t, ctx, conn)
+	})
+
+	t.Run("SchemaMigration", func(t *testing.T) {
+		testSchemaMigration(t, ctx, conn)
+	})
+
+	t.Run("DatabaseIntrospection", func(t *testing.T) {
+		testDatabaseIntrospection(t, ctx, conn)
+	})
+
+	t.Run("DriftDetection", func(t *testing.T) {
+		testDriftDetection(t, ctx, conn)
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		testApply(t, ctx, conn)
+	})
+
+	t.Run("Backfill", func(t *testing.T) {
+		testBackfill(t, ctx, conn)
+	})
+
+	t.Run("TableConfig", func(t *testing.T) {
+		testTableConfig(t, ctx, conn)
+	})
 }
 
 func connectToTestDB(ctx context.Context) (*pgx.Conn, error) {
@@ -1153,3 +1199,968 @@ func testUserTrackingWithForeignKeys(t *testing.T, ctx context.Context, conn *pg
 	// Note: Cascaded deletes don't trigger user triggers in PostgreSQL, so we won't have
 	// a delete history record for the order. This is expected behavior.
 }
+
+func testKeyReuse(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS reused_keys_history CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS reused_keys CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS reused_keys_insert_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS reused_keys_update_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS reused_keys_delete_history() CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	originalSQL := `
+	CREATE TABLE reused_keys (
+		id INTEGER PRIMARY KEY,
+		name VARCHAR(50) NOT NULL
+	);`
+
+	_, err := conn.Exec(ctx, originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to create key reuse test table: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse key reuse test tables: %v", err)
+	}
+
+	// The full output includes the unique index on open rows per key
+	installSQL, err := parser.GenerateHistorySQL(tables, parser.Config{UserSource: "current_user", Versioning: true})
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, installSQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v", err)
+	}
+
+	statements := []string{
+		"INSERT INTO reused_keys (id, name) VALUES (1, 'first')",
+		"DELETE FROM reused_keys WHERE id = 1",
+		"INSERT INTO reused_keys (id, name) VALUES (2, 'second')",
+		// Moves row 2 to the key deleted above, whose 'D' row is still open
+		"UPDATE reused_keys SET id = 1 WHERE id = 2",
+	}
+	for _, statement := range statements {
+		if _, err := conn.Exec(ctx, statement); err != nil {
+			t.Fatalf("Failed to run %q: %v", statement, err)
+		}
+	}
+
+	var operation, name string
+	var open int
+	err = conn.QueryRow(ctx, "SELECT COUNT(*), MIN(operation), MIN(name) FROM reused_keys_history WHERE id = 1 AND valid_to IS NULL").Scan(&open, &operation, &name)
+	if err != nil {
+		t.Fatalf("Failed to query open versions: %v", err)
+	}
+	if open != 1 || operation != "U" || name != "second" {
+		t.Errorf("Expected the update to be the only open version of key 1, got %d open, %s %s", open, operation, name)
+	}
+
+	var closedDeletes int
+	err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM reused_keys_history WHERE id = 1 AND operation = 'D' AND valid_to IS NOT NULL").Scan(&closedDeletes)
+	if err != nil {
+		t.Fatalf("Failed to query delete versions: %v", err)
+	}
+	if closedDeletes != 1 {
+		t.Errorf("Expected the delete of key 1 to be closed, got %d", closedDeletes)
+	}
+}
+
+func testHashChain(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS chain_accounts_history CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS chain_accounts CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS chain_accounts_insert_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS chain_accounts_update_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS chain_accounts_delete_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS chain_accounts_hash_history() CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	_, err := conn.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS pgcrypto")
+	if err != nil {
+		t.Skipf("pgcrypto is not available: %v", err)
+	}
+
+	originalSQL := `
+	CREATE TABLE chain_accounts (
+		id SERIAL PRIMARY KEY,
+		owner VARCHAR(50) NOT NULL,
+		balance DECIMAL(10,2) NOT NULL,
+		opened_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);`
+
+	_, err = conn.Exec(ctx, originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to create chain test table: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse chain test tables: %v", err)
+	}
+
+	config := parser.Config{UserSource: "current_user", HashChain: true}
+	_, err = conn.Exec(ctx, parser.GenerateHistoryTable(tables[0], config))
+	if err != nil {
+		t.Fatalf("Failed to create chain history table: %v", err)
+	}
+
+	_, err = conn.Exec(ctx, parser.GenerateTriggers(tables[0], config))
+	if err != nil {
+		t.Fatalf("Failed to create chain triggers: %v", err)
+	}
+
+	_, err = conn.Exec(ctx, "INSERT INTO chain_accounts (owner, balance) VALUES ($1, $2), ($3, $4)", "alice", 100.00, "bob", 50.00)
+	if err != nil {
+		t.Fatalf("Failed to insert accounts: %v", err)
+	}
+
+	for _, amount := range []float64{10, 20, 30} {
+		_, err = conn.Exec(ctx, "UPDATE chain_accounts SET balance = balance + $1 WHERE owner = 'alice'", amount)
+		if err != nil {
+			t.Fatalf("Failed to update account: %v", err)
+		}
+	}
+
+	// Hashes must not depend on the session's DateStyle
+	_, err = conn.Exec(ctx, "SET DateStyle = 'SQL, DMY'")
+	if err != nil {
+		t.Fatalf("Failed to set DateStyle: %v", err)
+	}
+	defer conn.Exec(ctx, "RESET DateStyle")
+
+	result, err := database.VerifyChain(ctx, conn, tables[0], config)
+	if err != nil {
+		t.Fatalf("Failed to verify chain: %v", err)
+	}
+	if !result.Intact {
+		t.Fatalf("Expected intact chain, broken at %s version %d", result.Key, result.Version)
+	}
+
+	// Tamper with the second version of alice's account
+	_, err = conn.Exec(ctx, "UPDATE chain_accounts_history SET balance = 1000000 WHERE owner = 'alice' AND version = 2")
+	if err != nil {
+		t.Fatalf("Failed to tamper with history: %v", err)
+	}
+
+	result, err = database.VerifyChain(ctx, conn, tables[0], config)
+	if err != nil {
+		t.Fatalf("Failed to verify tampered chain: %v", err)
+	}
+	if result.Intact {
+		t.Fatalf("Expected broken chain after tampering")
+	}
+	if result.Key != "id='1'" || result.Version != 2 {
+		t.Errorf("Expected break at id='1' version 2, got %s version %d", result.Key, result.Version)
+	}
+}
+
+func testAppendOnly(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS guard_items_history CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS guard_items CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS guard_items_insert_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS guard_items_update_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS guard_items_delete_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS guard_items_protect_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS guard_items_purge_history(INTERVAL) CASCADE")
+		_, _ = conn.Exec(ctx, "DROP ROLE IF EXISTS guard_writer")
+	}
+	cleanup()
+	defer cleanup()
+
+	originalSQL := `
+	CREATE TABLE guard_items (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) NOT NULL
+	);`
+
+	_, err := conn.Exec(ctx, originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to create append-only test table: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse append-only test tables: %v", err)
+	}
+
+	config := parser.Config{UserSource: "current_user", AppendOnly: true, Retention: "1 day"}
+	installSQL, err := parser.GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, installSQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v", err)
+	}
+
+	_, err = conn.Exec(ctx, "INSERT INTO guard_items (name) VALUES ('first')")
+	if err != nil {
+		t.Fatalf("Failed to insert item: %v", err)
+	}
+	_, err = conn.Exec(ctx, "UPDATE guard_items SET name = 'second'")
+	if err != nil {
+		t.Fatalf("Failed to update item: %v", err)
+	}
+
+	_, err = conn.Exec(ctx, "CREATE ROLE guard_writer")
+	if err != nil {
+		t.Skipf("Cannot create roles: %v", err)
+	}
+	_, err = conn.Exec(ctx, "GRANT SELECT, DELETE ON guard_items_history TO guard_writer")
+	if err != nil {
+		t.Fatalf("Failed to grant delete: %v", err)
+	}
+
+	// Raising the purge setting by hand must not let another role delete
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("Failed to begin transaction: %v", err)
+	}
+	_, err = tx.Exec(ctx, "SET LOCAL ROLE guard_writer")
+	if err != nil {
+		tx.Rollback(ctx)
+		t.Fatalf("Failed to set role: %v", err)
+	}
+	_, err = tx.Exec(ctx, "SET LOCAL sql_history.purge = on")
+	if err != nil {
+		tx.Rollback(ctx)
+		t.Fatalf("Failed to set purge setting: %v", err)
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM guard_items_history")
+	tx.Rollback(ctx)
+	if err == nil || !strings.Contains(err.Error(), "append-only") {
+		t.Fatalf("Expected delete with the purge setting to be rejected, got %v", err)
+	}
+
+	// The purge function still deletes closed versions
+	var purged int64
+	err = conn.QueryRow(ctx, "SELECT guard_items_purge_history('0 seconds')").Scan(&purged)
+	if err != nil {
+		t.Fatalf("Failed to purge history: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected 1 purged version, got %d", purged)
+	}
+}
+
+func testIdempotentOutput(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS rerun_items_history CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS rerun_items CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS rerun_items_insert_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS rerun_items_update_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS rerun_items_delete_history() CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	originalSQL := `
+	CREATE TABLE rerun_items (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) NOT NULL
+	);`
+
+	_, err := conn.Exec(ctx, originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to create rerun test table: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse rerun test tables: %v", err)
+	}
+
+	config := parser.Config{UserSource: "current_user", Versioning: true, Idempotent: true}
+	historySQL, err := parser.GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+
+	for run := 1; run <= 2; run++ {
+		_, err = conn.Exec(ctx, historySQL)
+		if err != nil {
+			t.Fatalf("Failed to apply history SQL (run %d): %v", run, err)
+		}
+	}
+
+	_, err = conn.Exec(ctx, "INSERT INTO rerun_items (name) VALUES ('widget')")
+	if err != nil {
+		t.Fatalf("Failed to insert item: %v", err)
+	}
+
+	var count int
+	err = conn.QueryRow(ctx, "SELECT COUNT(*) FROM rerun_items_history").Scan(&count)
+	if err != nil {
+		t.Fatalf("Failed to count history rows: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 history row after applying twice, got %d", count)
+	}
+}
+
+func testUninstall(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS down_orders_history CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS down_users_history CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS down_orders CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS down_users CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	originalSQL := `
+	CREATE TABLE down_users (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) NOT NULL
+	);
+
+	CREATE TABLE down_orders (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER REFERENCES down_users(id)
+	);`
+
+	_, err := conn.Exec(ctx, originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to create uninstall test tables: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(originalSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse uninstall test tables: %v", err)
+	}
+
+	config := parser.Config{UserSource: "current_user", AppendOnly: true}
+	installSQL, err := parser.GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, installSQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v", err)
+	}
+
+	countObjects := func() (triggers, functions, historyTables int) {
+		err := conn.QueryRow(ctx, `
+			SELECT
+				(SELECT COUNT(*) FROM pg_trigger WHERE NOT tgisinternal AND tgname LIKE 'down_%'),
+				(SELECT COUNT(*) FROM pg_proc WHERE proname LIKE 'down_%'),
+				(SELECT COUNT(*) FROM pg_tables WHERE tablename LIKE 'down_%_history')`).Scan(&triggers, &functions, &historyTables)
+		if err != nil {
+			t.Fatalf("Failed to count history objects: %v", err)
+		}
+		return triggers, functions, historyTables
+	}
+
+	downSQL, err := parser.GenerateDownSQL(tables, config, false)
+	if err != nil {
+		t.Fatalf("Failed to generate uninstall SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, downSQL)
+	if err != nil {
+		t.Fatalf("Failed to uninstall history: %v", err)
+	}
+
+	triggers, functions, historyTables := countObjects()
+	if triggers != 0 || functions != 0 {
+		t.Errorf("Expected no history triggers or functions, got %d triggers and %d functions", triggers, functions)
+	}
+	if historyTables != 2 {
+		t.Errorf("Expected history tables to be kept, got %d", historyTables)
+	}
+
+	downSQL, err = parser.GenerateDownSQL(tables, config, true)
+	if err != nil {
+		t.Fatalf("Failed to generate uninstall SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, downSQL)
+	if err != nil {
+		t.Fatalf("Failed to uninstall history with --drop-history: %v", err)
+	}
+
+	_, _, historyTables = countObjects()
+	if historyTables != 0 {
+		t.Errorf("Expected history tables to be dropped, got %d", historyTables)
+	}
+}
+
+func testSchemaMigration(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS evolving_history CASCADE")
+		_, _ = conn.Exec(ctx, "DROP TABLE IF EXISTS evolving CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS evolving_insert_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS evolving_update_history() CASCADE")
+		_, _ = conn.Exec(ctx, "DROP FUNCTION IF EXISTS evolving_delete_history() CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	oldSQL := `
+	CREATE TABLE evolving (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) NOT NULL,
+		legacy TEXT NOT NULL
+	);`
+	newSQL := `
+	CREATE TABLE evolving (
+		id SERIAL PRIMARY KEY,
+		full_name VARCHAR(50) NOT NULL,
+		email VARCHAR(100)
+	);`
+
+	_, err := conn.Exec(ctx, oldSQL)
+	if err != nil {
+		t.Fatalf("Failed to create migration test table: %v", err)
+	}
+
+	oldTables, err := parser.ParseCreateTables(oldSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse old tables: %v", err)
+	}
+	newTables, err := parser.ParseCreateTables(newSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse new tables: %v", err)
+	}
+
+	config := parser.Config{UserSource: "current_user"}
+	installSQL, err := parser.GenerateHistorySQL(oldTables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, installSQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v", err)
+	}
+
+	_, err = conn.Exec(ctx, "INSERT INTO evolving (name, legacy) VALUES ('alice', 'old value')")
+	if err != nil {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+
+	// Evolve the source table the way the new schema file describes
+	_, err = conn.Exec(ctx, `
+		ALTER TABLE evolving RENAME COLUMN name TO full_name;
+		ALTER TABLE evolving DROP COLUMN legacy;
+		ALTER TABLE evolving ADD COLUMN email VARCHAR(100);`)
+	if err != nil {
+		t.Fatalf("Failed to alter source table: %v", err)
+	}
+
+	renames := parser.ColumnRenames{"evolving": {"name": "full_name"}}
+	migrationSQL, err := parser.GenerateMigrationSQL(oldTables, newTables, config, renames)
+	if err != nil {
+		t.Fatalf("Failed to generate migration SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, migrationSQL)
+	if err != nil {
+		t.Fatalf("Failed to apply migration: %v\n%s", err, migrationSQL)
+	}
+
+	_, err = conn.Exec(ctx, "UPDATE evolving SET email = 'alice@example.com' WHERE full_name = 'alice'")
+	if err != nil {
+		t.Fatalf("Failed to update row after migration: %v", err)
+	}
+
+	var legacy, email *string
+	var fullName string
+	err = conn.QueryRow(ctx, "SELECT full_name, legacy, email FROM evolving_history WHERE operation = 'I'").Scan(&fullName, &legacy, &email)
+	if err != nil {
+		t.Fatalf("Failed to read original version: %v", err)
+	}
+	if fullName != "alice" || legacy == nil || *legacy != "old value" || email != nil {
+		t.Errorf("Expected original version to keep its data, got %s, %v, %v", fullName, legacy, email)
+	}
+
+	err = conn.QueryRow(ctx, "SELECT full_name, legacy, email FROM evolving_history WHERE operation = 'U'").Scan(&fullName, &legacy, &email)
+	if err != nil {
+		t.Fatalf("Failed to read migrated version: %v", err)
+	}
+	if legacy != nil || email == nil || *email != "alice@example.com" {
+		t.Errorf("Expected migrated version without legacy and with email, got %v, %v", legacy, email)
+	}
+}
+
+func testDatabaseIntrospection(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP SCHEMA IF EXISTS introspect_app CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	_, err := conn.Exec(ctx, `
+	CREATE SCHEMA introspect_app;
+	CREATE TABLE introspect_app.accounts (
+		id SERIAL PRIMARY KEY,
+		"DisplayName" VARCHAR(100) NOT NULL,
+		balance NUMERIC(12, 2)
+	);
+	CREATE TABLE introspect_app.entries (
+		account_id INTEGER NOT NULL REFERENCES introspect_app.accounts(id) ON DELETE CASCADE,
+		line INTEGER NOT NULL,
+		note TEXT,
+		PRIMARY KEY (account_id, line)
+	);
+	CREATE TABLE introspect_app.scratch (id INTEGER);
+	COMMENT ON TABLE introspect_app.accounts IS '@history retention="1 year"';
+	COMMENT ON COLUMN introspect_app.entries.note IS '@history ignore';`)
+	if err != nil {
+		t.Fatalf("Failed to create introspection test tables: %v", err)
+	}
+
+	filter := database.Filter{Schemas: []string{"introspect_app"}, ExcludeTables: []string{"scratch"}}
+	tables, err := database.ReadTables(ctx, conn, filter)
+	if err != nil {
+		t.Fatalf("Failed to read tables: %v", err)
+	}
+	if len(tables) != 2 {
+		t.Fatalf("Expected 2 tables, got %d", len(tables))
+	}
+
+	accounts, entries := tables[0], tables[1]
+	if parser.GetOriginalTableName(accounts) != "introspect_app.accounts" {
+		t.Errorf("Expected introspect_app.accounts, got %s", parser.GetOriginalTableName(accounts))
+	}
+	expectedColumns := []parser.Column{
+		{Name: "id", DataType: "integer", Options: "NOT NULL"},
+		{Name: "DisplayName", DataType: "character varying(100)", Options: "NOT NULL", Quoted: true},
+		{Name: "balance", DataType: "numeric(12,2)"},
+	}
+	if len(accounts.Columns) != len(expectedColumns) {
+		t.Fatalf("Expected %d columns, got %+v", len(expectedColumns), accounts.Columns)
+	}
+	for i, col := range expectedColumns {
+		if accounts.Columns[i] != col {
+			t.Errorf("Column %d: expected %+v, got %+v", i, col, accounts.Columns[i])
+		}
+	}
+
+	if fmt.Sprint(entries.PrimaryKey) != "[account_id line]" {
+		t.Errorf("Expected composite primary key, got %v", entries.PrimaryKey)
+	}
+	expectedFK := parser.ForeignKey{ColumnName: "account_id", ReferencedTable: "introspect_app.accounts", ReferencedColumn: "id", OnDelete: "CASCADE"}
+	if len(entries.ForeignKeys) != 1 || entries.ForeignKeys[0] != expectedFK {
+		t.Errorf("Expected foreign key %+v, got %+v", expectedFK, entries.ForeignKeys)
+	}
+
+	if accounts.Annotations.Retention != "1 year" {
+		t.Errorf("Expected retention from the table comment, got %+v", accounts.Annotations)
+	}
+	if fmt.Sprint(entries.Annotations.IgnoreColumns) != "[note]" {
+		t.Errorf("Expected note ignored by its column comment, got %+v", entries.Annotations)
+	}
+
+	// History generated from the database installs, and is not read back as
+	// source tables.
+	config := parser.Config{UserSource: "current_user"}
+	historySQL, err := parser.GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, historySQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v\n%s", err, historySQL)
+	}
+
+	tables, err = database.ReadTables(ctx, conn, filter)
+	if err != nil {
+		t.Fatalf("Failed to read tables: %v", err)
+	}
+	if len(tables) != 4 {
+		t.Fatalf("Expected tables and history tables, got %d tables", len(tables))
+	}
+	tables = database.ExcludeHistoryTables(tables, config)
+	if len(tables) != 2 {
+		t.Errorf("Expected history tables to be excluded, got %d tables", len(tables))
+	}
+}
+
+func testDriftDetection(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP SCHEMA IF EXISTS drift_app CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	schemaSQL := `
+	CREATE SCHEMA drift_app;
+	CREATE TABLE drift_app.tracked (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR(50) NOT NULL,
+		amount INT,
+		note TEXT
+	);
+	CREATE TABLE drift_app.untracked (id INT PRIMARY KEY);`
+	_, err := conn.Exec(ctx, schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to create drift test tables: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse tables: %v", err)
+	}
+
+	config := parser.Config{UserSource: "current_user", AppendOnly: true}
+	historySQL, err := parser.GenerateHistorySQL(tables[:1], config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, historySQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v", err)
+	}
+
+	drifts, err := database.CheckDrift(ctx, conn, tables[:1], config)
+	if err != nil {
+		t.Fatalf("Failed to check drift: %v", err)
+	}
+	if len(drifts) != 0 {
+		t.Fatalf("Expected no drift right after installing, got %v", drifts)
+	}
+
+	// Hotfixes applied by hand
+	_, err = conn.Exec(ctx, `
+		ALTER TABLE drift_app.tracked_history DROP COLUMN note;
+		ALTER TABLE drift_app.tracked_history ALTER COLUMN amount TYPE BIGINT;
+		DROP TRIGGER drift_app_tracked_delete_trigger ON drift_app.tracked;
+		ALTER TABLE drift_app.tracked DISABLE TRIGGER drift_app_tracked_update_trigger;
+		CREATE OR REPLACE FUNCTION drift_app_tracked_insert_history() RETURNS TRIGGER AS $$
+		BEGIN
+			RETURN NEW;
+		END;
+		$$ LANGUAGE plpgsql;`)
+	if err != nil {
+		t.Fatalf("Failed to alter history objects: %v", err)
+	}
+
+	drifts, err = database.CheckDrift(ctx, conn, tables, config)
+	if err != nil {
+		t.Fatalf("Failed to check drift: %v", err)
+	}
+
+	expected := []string{
+		"missing column: drift_app.tracked_history.note (text)",
+		"type mismatch: drift_app.tracked_history.amount (expected integer, found bigint)",
+		"disabled trigger: drift_app_tracked_update_trigger on drift_app.tracked",
+		"missing trigger: drift_app_tracked_delete_trigger on drift_app.tracked",
+		"function differs: drift_app_tracked_insert_history() (from line 2)",
+		"no history: drift_app.untracked_history",
+	}
+	found := map[string]bool{}
+	for _, drift := range drifts {
+		found[drift.String()] = true
+	}
+	for _, text := range expected {
+		if !found[text] {
+			t.Errorf("Expected drift %q, got %v", text, drifts)
+		}
+	}
+	if len(drifts) != len(expected) {
+		t.Errorf("Expected %d drifts, got %d: %v", len(expected), len(drifts), drifts)
+	}
+}
+
+func testApply(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP SCHEMA IF EXISTS apply_app CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	schemaSQL := `
+	CREATE SCHEMA apply_app;
+	CREATE TABLE apply_app.first (id INT PRIMARY KEY, name TEXT);
+	CREATE TABLE apply_app.second (id INT PRIMARY KEY, name TEXT);`
+	_, err := conn.Exec(ctx, schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to create apply test tables: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse tables: %v", err)
+	}
+	config := parser.Config{UserSource: "current_user"}
+	steps, err := parser.GenerateHistorySteps(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate steps: %v", err)
+	}
+
+	historyTables := func() int {
+		var count int
+		err := conn.QueryRow(ctx, "SELECT count(*) FROM pg_tables WHERE schemaname = 'apply_app' AND tablename LIKE '%_history'").Scan(&count)
+		if err != nil {
+			t.Fatalf("Failed to count history tables: %v", err)
+		}
+		return count
+	}
+
+	var progress []string
+	err = database.Apply(ctx, conn, steps, true, func(step parser.Step) {
+		progress = append(progress, step.Name)
+	})
+	if err != nil {
+		t.Fatalf("Dry run failed: %v", err)
+	}
+	if fmt.Sprint(progress) != "[apply_app.first apply_app.second]" {
+		t.Errorf("Expected progress for each table, got %v", progress)
+	}
+	if count := historyTables(); count != 0 {
+		t.Errorf("Expected dry run to leave nothing behind, found %d history tables", count)
+	}
+
+	// A failing step rolls back the steps before it.
+	_, err = conn.Exec(ctx, "CREATE TABLE apply_app.second_history (id INT)")
+	if err != nil {
+		t.Fatalf("Failed to create conflicting table: %v", err)
+	}
+	err = database.Apply(ctx, conn, steps, false, nil)
+	if err == nil {
+		t.Fatal("Expected apply to fail on an existing history table")
+	}
+	if count := historyTables(); count != 1 {
+		t.Errorf("Expected failed apply to roll back, found %d history tables", count)
+	}
+	_, err = conn.Exec(ctx, "DROP TABLE apply_app.second_history")
+	if err != nil {
+		t.Fatalf("Failed to drop conflicting table: %v", err)
+	}
+
+	err = database.Apply(ctx, conn, steps, false, nil)
+	if err != nil {
+		t.Fatalf("Apply failed: %v", err)
+	}
+	if count := historyTables(); count != 2 {
+		t.Errorf("Expected 2 history tables after apply, found %d", count)
+	}
+
+	_, err = conn.Exec(ctx, "INSERT INTO apply_app.first VALUES (1, 'applied')")
+	if err != nil {
+		t.Fatalf("Failed to insert row: %v", err)
+	}
+	var operation string
+	err = conn.QueryRow(ctx, "SELECT operation FROM apply_app.first_history WHERE id = 1").Scan(&operation)
+	if err != nil || operation != "I" {
+		t.Errorf("Expected insert to be recorded after apply, got %q, %v", operation, err)
+	}
+}
+
+func testBackfill(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP SCHEMA IF EXISTS backfill_app CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	schemaSQL := `
+	CREATE SCHEMA backfill_app;
+	CREATE TABLE backfill_app.items (
+		id INT PRIMARY KEY,
+		name TEXT,
+		created_at TIMESTAMP
+	);`
+	_, err := conn.Exec(ctx, schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to create backfill test table: %v", err)
+	}
+	_, err = conn.Exec(ctx, `
+		INSERT INTO backfill_app.items
+		SELECT i, 'item ' || i, TIMESTAMP '2020-01-01' + i * INTERVAL '1 day'
+		FROM generate_series(1, 5) i;
+		UPDATE backfill_app.items SET created_at = NULL WHERE id = 5;`)
+	if err != nil {
+		t.Fatalf("Failed to insert existing rows: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse tables: %v", err)
+	}
+	config := parser.Config{UserSource: "current_user", Versioning: true, BackfillFrom: "created_at"}
+	historySQL, err := parser.GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, historySQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v", err)
+	}
+
+	// A change after installing is recorded by the triggers and left alone.
+	_, err = conn.Exec(ctx, "UPDATE backfill_app.items SET name = 'changed' WHERE id = 3")
+	if err != nil {
+		t.Fatalf("Failed to update row: %v", err)
+	}
+
+	backfills, err := parser.GenerateBackfills(tables, config, 2)
+	if err != nil {
+		t.Fatalf("Failed to generate backfill: %v", err)
+	}
+
+	// A backfill interrupted after key 2 resumes after it.
+	_, err = conn.Exec(ctx, backfills[0].Procedure)
+	if err != nil {
+		t.Fatalf("Failed to create backfill: %v", err)
+	}
+	_, err = conn.Exec(ctx, "INSERT INTO backfill_app.items_history_backfill VALUES (2)")
+	if err != nil {
+		t.Fatalf("Failed to record backfill progress: %v", err)
+	}
+	var recorded int64
+	err = database.Backfill(ctx, conn, backfills, func(backfill parser.Backfill, count int64) {
+		recorded = count
+	})
+	if err != nil {
+		t.Fatalf("Resumed backfill failed: %v", err)
+	}
+	if recorded != 2 {
+		t.Errorf("Expected the resumed backfill to record keys 4 and 5, got %d row(s)", recorded)
+	}
+	var progressTable *string
+	err = conn.QueryRow(ctx, "SELECT to_regclass('backfill_app.items_history_backfill')::text").Scan(&progressTable)
+	if err != nil || progressTable != nil {
+		t.Errorf("Expected the progress table to be dropped after the backfill, got %v, %v", progressTable, err)
+	}
+
+	// A new backfill starts over and records the keys skipped above.
+	err = database.Backfill(ctx, conn, backfills, func(backfill parser.Backfill, count int64) {
+		recorded = count
+	})
+	if err != nil {
+		t.Fatalf("Backfill failed: %v", err)
+	}
+	if recorded != 2 {
+		t.Errorf("Expected keys 1 and 2 to be backfilled, got %d row(s)", recorded)
+	}
+
+	var validFrom time.Time
+	var version int
+	err = conn.QueryRow(ctx, "SELECT valid_from, version FROM backfill_app.items_history WHERE id = 2 AND operation = 'I'").Scan(&validFrom, &version)
+	if err != nil {
+		t.Fatalf("Failed to read backfilled version: %v", err)
+	}
+	if !validFrom.Equal(time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)) || version != 1 {
+		t.Errorf("Expected version 1 valid from created_at, got %v, %d", validFrom, version)
+	}
+
+	var recent bool
+	err = conn.QueryRow(ctx, "SELECT valid_from > CURRENT_TIMESTAMP - INTERVAL '1 hour' FROM backfill_app.items_history WHERE id = 5").Scan(&recent)
+	if err != nil || !recent {
+		t.Errorf("Expected NULL created_at to fall back to the backfill time, got %v, %v", recent, err)
+	}
+
+	var keyVersions int
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM backfill_app.items_history WHERE id = 3").Scan(&keyVersions)
+	if err != nil || keyVersions != 1 {
+		t.Errorf("Expected the updated key to keep only its trigger version, got %d, %v", keyVersions, err)
+	}
+
+	// Running it again finds nothing left to do.
+	err = database.Backfill(ctx, conn, backfills, func(backfill parser.Backfill, count int64) {
+		recorded = count
+	})
+	if err != nil {
+		t.Fatalf("Second backfill failed: %v", err)
+	}
+	if recorded != 0 {
+		t.Errorf("Expected second backfill to record nothing, got %d", recorded)
+	}
+}
+
+func testTableConfig(t *testing.T, ctx context.Context, conn *pgx.Conn) {
+	cleanup := func() {
+		_, _ = conn.Exec(ctx, "DROP SCHEMA IF EXISTS config_app CASCADE")
+	}
+	cleanup()
+	defer cleanup()
+
+	schemaSQL := `
+	CREATE SCHEMA config_app;
+	CREATE TABLE config_app.accounts (
+		id INT PRIMARY KEY,
+		email TEXT,
+		last_seen_at TIMESTAMP
+	);
+	CREATE TABLE config_app.sessions (
+		id INT PRIMARY KEY
+	);`
+	_, err := conn.Exec(ctx, schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to create config test tables: %v", err)
+	}
+
+	config, err := parser.ParseConfig([]byte(`{
+		"context_columns": [{"name": "request_id"}],
+		"tables": {
+			"config_app.accounts": {"ignore_columns": ["last_seen_at"]},
+			"config_app.sessions": {"exclude": true}
+		}
+	}`), parser.Config{UserSource: "current_user", IndexStrategy: "btree"})
+	if err != nil {
+		t.Fatalf("Failed to parse config: %v", err)
+	}
+
+	tables, err := parser.ParseCreateTables(schemaSQL)
+	if err != nil {
+		t.Fatalf("Failed to parse tables: %v", err)
+	}
+	tables, err = parser.ApplyTableConfig(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to apply table config: %v", err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("Expected the excluded table to be dropped, got %d tables", len(tables))
+	}
+
+	historySQL, err := parser.GenerateHistorySQL(tables, config)
+	if err != nil {
+		t.Fatalf("Failed to generate history SQL: %v", err)
+	}
+	_, err = conn.Exec(ctx, historySQL)
+	if err != nil {
+		t.Fatalf("Failed to install history: %v", err)
+	}
+
+	_, err = conn.Exec(ctx, `
+		SELECT set_config('app.request_id', 'req-1', false);
+		INSERT INTO config_app.accounts VALUES (1, 'a@example.com', NULL);
+		UPDATE config_app.accounts SET last_seen_at = CURRENT_TIMESTAMP WHERE id = 1;`)
+	if err != nil {
+		t.Fatalf("Failed to change rows: %v", err)
+	}
+
+	var versions int
+	var requestID string
+	err = conn.QueryRow(ctx, "SELECT count(*), max(request_id) FROM config_app.accounts_history").Scan(&versions, &requestID)
+	if err != nil {
+		t.Fatalf("Failed to read history: %v", err)
+	}
+	if versions != 1 {
+		t.Errorf("Expected changes to ignored columns to record no version, got %d versions", versions)
+	}
+	if requestID != "req-1" {
+		t.Errorf("Expected request_id 'req-1', got %q", requestID)
+	}
+
+	_, err = conn.Exec(ctx, "UPDATE config_app.accounts SET email = 'b@example.com' WHERE id = 1")
+	if err != nil {
+		t.Fatalf("Failed to update tracked column: %v", err)
+	}
+	err = conn.QueryRow(ctx, "SELECT count(*) FROM config_app.accounts_history").Scan(&versions)
+	if err != nil || versions != 2 {
+		t.Errorf("Expected a version for the tracked change, got %d, %v", versions, err)
+	}
+
+	var exists bool
+	err = conn.QueryRow(ctx, "SELECT to_regclass('config_app.sessions_history') IS NOT NULL").Scan(&exists)
+	if err != nil || exists {
+		t.Errorf("Expected no history table for the excluded table, got %v, %v", exists, err)
+	}
+}